@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// defaultActionConcurrency is how many actions run at once unless -action-concurrency says otherwise
+const defaultActionConcurrency = 3
+
+// actionResult is the outcome of one post-processing action
+type actionResult struct {
+	Action   *PostAction
+	File     string // Output file, empty if the action failed; a .partial file if a budget stopped it
+	Err      error
+	Duration time.Duration
+}
+
+// lockedBuffer collects output from goroutines writing concurrently
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) WriteTo(w io.Writer) (int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.WriteTo(w)
+}
+
+// runActions applies each action to the transcript with at most limit running at once
+// and returns the results in the order given. One action failing doesn't stop the
+// others. With a limit above 1, each action's progress is buffered and printed to out
+// in order as soon as it and every action before it have finished, so the console reads
+// the same on every run.
+func runActions(actions []*PostAction, transcription, apiKey string, limit int, outputFile func(*PostAction) string, out io.Writer) []actionResult {
+	results := make([]actionResult, len(actions))
+	buffers := make([]*lockedBuffer, len(actions))
+	done := make([]chan struct{}, len(actions))
+	for i := range actions {
+		buffers[i] = &lockedBuffer{}
+		done[i] = make(chan struct{})
+	}
+
+	go runConcurrently(len(actions), limit, func(i int) error {
+		defer close(done[i])
+
+		// A single action at a time can report progress live
+		var actionOut io.Writer = buffers[i]
+		if limit <= 1 {
+			actionOut = out
+		}
+
+		results[i] = runAction(actions[i], i, len(actions), transcription, apiKey, outputFile(actions[i]), actionOut)
+		return results[i].Err
+	})
+
+	for i := range actions {
+		<-done[i]
+		buffers[i].WriteTo(out)
+	}
+
+	return results
+}
+
+// runAction applies one action and saves its output, reporting progress to out
+func runAction(action *PostAction, idx, total int, transcription, apiKey, filename string, out io.Writer) actionResult {
+	start := time.Now()
+	result := actionResult{Action: action}
+
+	fmt.Fprintf(out, "\n[%d/%d] Applying post-processing: %s...\n", idx+1, total, action.Name)
+	processed, err := processWithOpenAIChunked(transcription, action, apiKey, out)
+	if err != nil && processed != "" {
+		// Stopped by the budget part way through: keep what was paid for
+		partial := partialFilename(filename)
+		fmt.Fprintf(out, "⚠ Warning: Post-processing stopped: %v\n", err)
+		if werr := os.WriteFile(partial, []byte(processed), 0644); werr != nil {
+			fmt.Fprintf(out, "⚠ Error writing partial output: %v\n", werr)
+		} else {
+			fmt.Fprintf(out, "✓ Partial output saved to %s\n", partial)
+			result.File = partial
+		}
+		result.Err = err
+	} else if err != nil {
+		fmt.Fprintf(out, "⚠ Warning: Post-processing failed: %v\n", err)
+		result.Err = err
+	} else if err := os.WriteFile(filename, []byte(processed), 0644); err != nil {
+		fmt.Fprintf(out, "⚠ Error writing processed file: %v\n", err)
+		result.Err = err
+	} else {
+		fmt.Fprintf(out, "✓ Post-processed output saved to %s\n", filename)
+		result.File = filename
+	}
+
+	result.Duration = time.Since(start)
+	return result
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const (
+	defaultAnthropicBaseURL = "https://api.anthropic.com/v1"
+	anthropicAPIVersion     = "2023-06-01"
+)
+
+// AnthropicMessagesRequest is the body of a Messages API call
+type AnthropicMessagesRequest struct {
+	Model       string               `json:"model"`
+	Messages    []Message            `json:"messages"`
+	System      string               `json:"system,omitempty"`
+	Temperature float64              `json:"temperature"`
+	MaxTokens   int                  `json:"max_tokens"`
+	Tools       []AnthropicTool      `json:"tools,omitempty"`
+	ToolChoice  *AnthropicToolChoice `json:"tool_choice,omitempty"`
+}
+
+// AnthropicTool declares a tool; structured output is requested as a tool whose input
+// is the schema
+type AnthropicTool struct {
+	Name        string                 `json:"name"`
+	Description string                 `json:"description,omitempty"`
+	InputSchema map[string]interface{} `json:"input_schema"`
+}
+
+// AnthropicToolChoice forces the model to call a tool
+type AnthropicToolChoice struct {
+	Type string `json:"type"` // "tool"
+	Name string `json:"name"`
+}
+
+// AnthropicMessagesResponse is the subset of a Messages API response goscribe uses
+type AnthropicMessagesResponse struct {
+	Content []struct {
+		Type  string          `json:"type"`
+		Text  string          `json:"text"`
+		Input json.RawMessage `json:"input"` // tool_use blocks
+	} `json:"content"`
+	StopReason string `json:"stop_reason"`
+	Usage      struct {
+		InputTokens  int `json:"input_tokens"`
+		OutputTokens int `json:"output_tokens"`
+	} `json:"usage"`
+}
+
+// resolveAnthropicEndpoint returns the Messages API endpoint for an anthropic action.
+// The key comes from anthropic_api_key in the config or $ANTHROPIC_API_KEY.
+func resolveAnthropicEndpoint(action *PostAction) (apiEndpoint, error) {
+	apiKey := activeConfig.AnthropicAPIKey
+	if apiKey == "" {
+		apiKey = os.Getenv("ANTHROPIC_API_KEY")
+	}
+	if apiKey == "" {
+		return apiEndpoint{}, fmt.Errorf("anthropic API key is not set (set anthropic_api_key in config or ANTHROPIC_API_KEY)")
+	}
+
+	baseURL := defaultAnthropicBaseURL
+	if action != nil && action.BaseURL != "" {
+		baseURL = action.BaseURL
+	}
+
+	endpoint := apiEndpoint{
+		BaseURL:   baseURL,
+		APIKey:    apiKey,
+		KeyHeader: "x-api-key",
+		Headers:   mergeHeaders(action, false),
+	}
+	endpoint.Headers["anthropic-version"] = anthropicAPIVersion
+
+	return endpoint, nil
+}
+
+// sendAnthropicMessages sends a chat request through the Messages API. System messages
+// are moved to the top-level system field, which is where Anthropic expects them.
+func sendAnthropicMessages(endpoint apiEndpoint, chatReq ChatCompletionRequest, out io.Writer) (string, tokenUsage, error) {
+	reqBody := AnthropicMessagesRequest{
+		Model:       chatReq.Model,
+		Temperature: chatReq.Temperature,
+		MaxTokens:   chatReq.MaxTokens,
+	}
+	var system []string
+	for _, msg := range chatReq.Messages {
+		if msg.Role == "system" {
+			system = append(system, msg.Content)
+			continue
+		}
+		reqBody.Messages = append(reqBody.Messages, msg)
+	}
+	reqBody.System = strings.Join(system, "\n\n")
+
+	// The Messages API has no response_format: a forced tool call returns the JSON instead
+	if format := chatReq.ResponseFormat; format != nil && format.JSONSchema != nil {
+		reqBody.Tools = []AnthropicTool{{
+			Name:        format.JSONSchema.Name,
+			Description: "Record the result in the required structure",
+			InputSchema: format.JSONSchema.Schema,
+		}}
+		reqBody.ToolChoice = &AnthropicToolChoice{Type: "tool", Name: format.JSONSchema.Name}
+	}
+
+	jsonData, err := json.Marshal(reqBody)
+	if err != nil {
+		return "", tokenUsage{}, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	req, err := endpoint.newRequest("POST", "/messages", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return "", tokenUsage{}, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	statusCode, respBody, err := apiClient.send(req, out)
+	if err != nil {
+		return "", tokenUsage{}, fmt.Errorf("failed to send request: %w", err)
+	}
+
+	if statusCode != http.StatusOK {
+		return "", tokenUsage{}, fmt.Errorf("API request failed with status %d: %s", statusCode, string(respBody))
+	}
+
+	var messagesResp AnthropicMessagesResponse
+	err = json.Unmarshal(respBody, &messagesResp)
+	if err != nil {
+		return "", tokenUsage{}, fmt.Errorf("failed to parse response: %w", err)
+	}
+
+	var text strings.Builder
+	for _, block := range messagesResp.Content {
+		if block.Type == "tool_use" {
+			// A structured reply: the tool input is the result
+			text.Reset()
+			text.Write(block.Input)
+			break
+		}
+		if block.Type == "text" {
+			text.WriteString(block.Text)
+		}
+	}
+	if text.Len() == 0 {
+		return "", tokenUsage{}, fmt.Errorf("no response from API")
+	}
+
+	usage := tokenUsage{InputTokens: messagesResp.Usage.InputTokens, OutputTokens: messagesResp.Usage.OutputTokens}
+	return text.String(), usage, nil
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// defaultOpenAIBaseURL is used when neither the config nor the action sets base_url
+const defaultOpenAIBaseURL = "https://api.openai.com/v1"
+
+// Action types accepted in the "type" field of post_actions
+const (
+	actionTypeOpenAI      = "openai"
+	actionTypeAzureOpenAI = "azure-openai"
+	actionTypeAnthropic   = "anthropic"
+	actionTypeOllama      = "ollama"
+)
+
+// validActionTypes lists every provider an action (or -provider) can use
+var validActionTypes = []string{actionTypeOpenAI, actionTypeAzureOpenAI, actionTypeAnthropic, actionTypeOllama}
+
+// selectionOverride replaces the default gpt-3.5-turbo request used for --auto selection
+// when -provider or -model is given
+var selectionOverride *PostAction
+
+// apiEndpoint is an OpenAI-compatible server and the credentials used to call it
+type apiEndpoint struct {
+	BaseURL    string
+	APIKey     string
+	KeyHeader  string // Header carrying the key as-is (Azure "api-key"); empty means Authorization: Bearer
+	APIVersion string // Sent as the api-version query parameter when set (Azure)
+	Headers    map[string]string
+}
+
+// resolveEndpoint returns the endpoint for an action: its own base_url and headers
+// take precedence over the global ones. The OpenAI key and the global headers are
+// only sent to the global base URL; a server set on the action gets the action's
+// api_key and headers, if any. A nil action gives the endpoint used for requests not
+// tied to an action, such as --auto selection.
+func resolveEndpoint(action *PostAction, apiKey string) (apiEndpoint, error) {
+	var endpoint apiEndpoint
+	var err error
+	global := false
+
+	switch {
+	case action != nil && action.Type == actionTypeAzureOpenAI:
+		endpoint, err = resolveAzureEndpoint(action.Endpoint, action.Deployment, action.APIVersion, action.Model)
+	case action == nil && activeConfig.Azure.Deployment != "":
+		endpoint, err = resolveAzureEndpoint("", "", "", "")
+	default:
+		endpoint = openAIEndpoint(apiKey)
+		global = true
+		if action != nil && action.BaseURL != "" && action.BaseURL != endpoint.BaseURL {
+			endpoint.BaseURL = action.BaseURL
+			endpoint.APIKey = os.ExpandEnv(action.APIKey)
+			global = false
+		}
+	}
+	if err != nil {
+		return apiEndpoint{}, err
+	}
+
+	endpoint.Headers = mergeHeaders(action, global)
+	return endpoint, nil
+}
+
+// openAIEndpoint returns the global OpenAI (or OpenAI-compatible) endpoint
+func openAIEndpoint(apiKey string) apiEndpoint {
+	baseURL := activeConfig.BaseURL
+	if baseURL == "" {
+		baseURL = defaultOpenAIBaseURL
+	}
+	return apiEndpoint{BaseURL: baseURL, APIKey: apiKey, Headers: mergeHeaders(nil, true)}
+}
+
+// mergeHeaders combines the global headers with the action's own, which win. The global
+// headers are only included for the global base URL, since they may carry gateway
+// credentials that other servers mustn't see.
+func mergeHeaders(action *PostAction, global bool) map[string]string {
+	headers := map[string]string{}
+	if global {
+		for name, value := range activeConfig.Headers {
+			headers[name] = value
+		}
+	}
+	if action != nil {
+		for name, value := range action.Headers {
+			headers[name] = value
+		}
+	}
+	return headers
+}
+
+// url joins an API path such as "/chat/completions" onto the base URL
+func (e apiEndpoint) url(path string) string {
+	u := strings.TrimRight(e.BaseURL, "/") + path
+	if e.APIVersion != "" {
+		u += "?api-version=" + url.QueryEscape(e.APIVersion)
+	}
+	return u
+}
+
+// newRequest builds a request with authorization and any extra headers set. Header
+// values may reference environment variables, e.g. "Bearer ${GATEWAY_TOKEN}".
+func (e apiEndpoint) newRequest(method, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, e.url(path), body)
+	if err != nil {
+		return nil, err
+	}
+
+	if e.APIKey != "" {
+		if e.KeyHeader != "" {
+			req.Header.Set(e.KeyHeader, e.APIKey)
+		} else {
+			req.Header.Set("Authorization", "Bearer "+e.APIKey)
+		}
+	}
+	for name, value := range e.Headers {
+		req.Header.Set(name, os.ExpandEnv(value))
+	}
+
+	return req, nil
+}
+
+// sendActionChat sends a chat request to the provider selected by the action's type,
+// within the run's budget, and records its token usage under the action. A nil action
+// uses the global endpoint. Retry notices are written to out.
+func sendActionChat(action *PostAction, apiKey string, reqBody ChatCompletionRequest, out io.Writer) (string, error) {
+	model := reqBody.Model
+	local := action != nil && action.Type == actionTypeOllama
+	if local {
+		model = ollamaModel(model)
+	}
+
+	// Check the spending caps before sending; the reservation is released once the
+	// real usage is recorded
+	release, err := reserveChat(model, reqBody, local)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+
+	content, usage, err := sendChat(action, apiKey, reqBody, out)
+	if err != nil {
+		return "", err
+	}
+
+	if usage.InputTokens == 0 && usage.OutputTokens == 0 {
+		usage = countChatUsage(reqBody, content)
+	}
+	runUsage.addChat(usageStep(action), model, usage, local)
+
+	return content, nil
+}
+
+// chatEndpoint returns the endpoint an action's chat requests go to, for any provider
+func chatEndpoint(action *PostAction, apiKey string) (apiEndpoint, error) {
+	if action != nil && action.Type == actionTypeAnthropic {
+		return resolveAnthropicEndpoint(action)
+	}
+	if action != nil && action.Type == actionTypeOllama {
+		return resolveOllamaEndpoint(action), nil
+	}
+	return resolveEndpoint(action, apiKey)
+}
+
+// sendChat dispatches a chat request to the action's provider
+func sendChat(action *PostAction, apiKey string, reqBody ChatCompletionRequest, out io.Writer) (string, tokenUsage, error) {
+	endpoint, err := chatEndpoint(action, apiKey)
+	if err != nil {
+		return "", tokenUsage{}, err
+	}
+
+	switch {
+	case action != nil && action.Type == actionTypeAnthropic:
+		return sendAnthropicMessages(endpoint, reqBody, out)
+	case action != nil && action.Type == actionTypeOllama:
+		return sendOllamaChat(endpoint, reqBody, out)
+	default:
+		return sendChatCompletion(endpoint, reqBody, out)
+	}
+}
+
+// sendChatCompletion posts a chat completion request and returns the first choice and
+// the reported usage
+func sendChatCompletion(endpoint apiEndpoint, reqBody ChatCompletionRequest, out io.Writer) (string, tokenUsage, error) {
+	jsonData, err := json.Marshal(reqBody)
+	if err != nil {
+		return "", tokenUsage{}, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	req, err := endpoint.newRequest("POST", "/chat/completions", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return "", tokenUsage{}, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	statusCode, respBody, err := apiClient.send(req, out)
+	if err != nil {
+		return "", tokenUsage{}, fmt.Errorf("failed to send request: %w", err)
+	}
+
+	if statusCode != http.StatusOK {
+		return "", tokenUsage{}, fmt.Errorf("API request failed with status %d: %s", statusCode, string(respBody))
+	}
+
+	var chatResp ChatCompletionResponse
+	err = json.Unmarshal(respBody, &chatResp)
+	if err != nil {
+		return "", tokenUsage{}, fmt.Errorf("failed to parse response: %w", err)
+	}
+
+	if len(chatResp.Choices) == 0 {
+		return "", tokenUsage{}, fmt.Errorf("no response from API")
+	}
+
+	usage := tokenUsage{InputTokens: chatResp.Usage.PromptTokens, OutputTokens: chatResp.Usage.CompletionTokens}
+	return chatResp.Choices[0].Message.Content, usage, nil
+}
+
+// applyProviderOverride points every action at another provider and/or model for this
+// run, e.g. -provider ollama to keep confidential transcripts on this machine
+func applyProviderOverride(actions []PostAction, provider, model string) error {
+	if provider != "" {
+		valid := false
+		for _, actionType := range validActionTypes {
+			valid = valid || provider == actionType
+		}
+		if !valid {
+			return fmt.Errorf("invalid -provider '%s' (valid: %s)", provider, strings.Join(validActionTypes, ", "))
+		}
+	}
+
+	if model == "" && provider == actionTypeOllama {
+		model = activeConfig.Ollama.Model
+	}
+	if model == "" && provider != "" && provider != actionTypeOpenAI && provider != actionTypeAzureOpenAI {
+		return fmt.Errorf("-provider %s needs a model (use -model)", provider)
+	}
+
+	for i := range actions {
+		action := &actions[i]
+		if provider != "" && provider != action.Type {
+			action.Type = provider
+			// Endpoints configured for the old provider don't apply to the new one
+			action.BaseURL = ""
+			action.APIKey = ""
+			action.Endpoint = ""
+			action.Deployment = ""
+		}
+		if model != "" {
+			action.Model = model
+		}
+		if action.Type == actionTypeAnthropic && action.Temperature > 1 {
+			action.Temperature = 1
+		}
+		if err := checkContextRoom(&activeConfig, action); err != nil {
+			return err
+		}
+	}
+
+	selectionOverride = &PostAction{Type: actionTypeOpenAI, Model: "gpt-3.5-turbo"}
+	if provider != "" {
+		selectionOverride.Type = provider
+	}
+	if model != "" {
+		selectionOverride.Model = model
+	}
+
+	return nil
+}
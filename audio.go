@@ -0,0 +1,590 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// Audio splitting modes
+const (
+	splitModeSilence = "silence" // Cut inside pauses near the target chunk duration
+	splitModeFixed   = "fixed"   // Cut every chunk duration regardless of content
+)
+
+// silenceDetectArgs are the ffmpeg silencedetect settings: anything quieter than
+// -30 dB for at least half a second is considered a pause worth cutting in
+const silenceDetectArgs = "silencedetect=noise=-30dB:d=0.5"
+
+// cutSearchWindowRatio is how far before the target duration (as a fraction of it)
+// a pause may start and still be used as a cut point
+const cutSearchWindowRatio = 0.2
+
+// defaultChunkDurationSeconds is used when the bitrate of a file can't be probed; ten
+// minutes stays well under 25MB for most audio formats
+const defaultChunkDurationSeconds = 600
+
+// chunkSizeSafetyRatio leaves headroom under the upload limit for container overhead
+// and variable bitrate peaks when sizing chunks from the average bitrate
+const chunkSizeSafetyRatio = 0.9
+
+// minChunkDurationSeconds is the shortest chunk produced when sizing or re-splitting
+const minChunkDurationSeconds = 30
+
+// speechOpusBitRate is the Opus bitrate in bits per second used when transcoding for
+// upload; 24 kb/s mono is plenty for speech and fits over two hours of audio under the
+// 25MB limit
+const speechOpusBitRate = 24000
+
+// mediaStream is one stream of a media file as reported by ffprobe
+type mediaStream struct {
+	Index       int    `json:"index"`
+	CodecType   string `json:"codec_type"`
+	CodecName   string `json:"codec_name"`
+	Disposition struct {
+		AttachedPic int `json:"attached_pic"`
+	} `json:"disposition"`
+	Tags struct {
+		Language string `json:"language"`
+		Title    string `json:"title"`
+	} `json:"tags"`
+}
+
+// audioInfo is the subset of ffprobe metadata used to plan chunks
+type audioInfo struct {
+	Duration float64 // Seconds
+	BitRate  int64   // Bits per second
+}
+
+// silenceInterval is a stretch of silence in seconds from the start of the audio
+type silenceInterval struct {
+	Start float64
+	End   float64
+}
+
+var (
+	silenceStartPattern = regexp.MustCompile(`silence_start:\s*(-?[0-9.]+)`)
+	silenceEndPattern   = regexp.MustCompile(`silence_end:\s*([0-9.]+)`)
+	durationPattern     = regexp.MustCompile(`Duration:\s*(\d+):(\d+):(\d+(?:\.\d+)?)`)
+)
+
+// detectSilences runs ffmpeg silencedetect over the file and returns the pauses found
+// along with the total duration of the audio
+func detectSilences(audioPath string) ([]silenceInterval, float64, error) {
+	cmd := fmt.Sprintf("ffmpeg -hide_banner -nostats -i %s -af %s -f null -",
+		shellescape(audioPath), silenceDetectArgs)
+
+	output, err := exec.Command("bash", "-c", cmd).CombinedOutput()
+	if err != nil {
+		return nil, 0, fmt.Errorf("ffmpeg silencedetect failed: %w\nOutput: %s", err, string(output))
+	}
+
+	silences, duration := parseSilenceDetect(string(output))
+	if duration <= 0 {
+		return nil, 0, fmt.Errorf("could not determine audio duration")
+	}
+
+	return silences, duration, nil
+}
+
+// parseSilenceDetect extracts silence intervals and the input duration from ffmpeg output
+func parseSilenceDetect(output string) ([]silenceInterval, float64) {
+	var silences []silenceInterval
+	var duration float64
+	open := -1.0
+
+	for _, line := range strings.Split(output, "\n") {
+		if duration == 0 {
+			if m := durationPattern.FindStringSubmatch(line); m != nil {
+				hours, _ := strconv.ParseFloat(m[1], 64)
+				minutes, _ := strconv.ParseFloat(m[2], 64)
+				seconds, _ := strconv.ParseFloat(m[3], 64)
+				duration = hours*3600 + minutes*60 + seconds
+			}
+		}
+
+		if m := silenceStartPattern.FindStringSubmatch(line); m != nil {
+			start, err := strconv.ParseFloat(m[1], 64)
+			if err == nil {
+				open = max64(start, 0)
+			}
+			continue
+		}
+
+		if m := silenceEndPattern.FindStringSubmatch(line); m != nil && open >= 0 {
+			end, err := strconv.ParseFloat(m[1], 64)
+			if err == nil {
+				silences = append(silences, silenceInterval{Start: open, End: end})
+			}
+			open = -1
+		}
+	}
+
+	// Silence that runs to the end of the file has no silence_end line
+	if open >= 0 && duration > open {
+		silences = append(silences, silenceInterval{Start: open, End: duration})
+	}
+
+	return silences, duration
+}
+
+// chooseCutPoints picks split times so that no chunk is longer than target seconds.
+// Each cut is placed in the pause closest to (but not after) the target, searching
+// back up to window seconds; when no pause is in range it cuts at the target itself.
+func chooseCutPoints(silences []silenceInterval, duration, target, window float64) []float64 {
+	var cuts []float64
+	last := 0.0
+
+	for duration-last > target {
+		ideal := last + target
+		cut := ideal
+
+		best := -1.0
+		for _, s := range silences {
+			if s.Start > ideal {
+				break
+			}
+			// Cut in the middle of the pause, but never past the target
+			point := (s.Start + s.End) / 2
+			if point > ideal {
+				point = ideal
+			}
+			if point > last && point >= ideal-window && point > best {
+				best = point
+			}
+		}
+		if best > 0 {
+			cut = best
+		}
+
+		cuts = append(cuts, cut)
+		last = cut
+	}
+
+	return cuts
+}
+
+// splitAudioFileAtSilences splits the file into chunks of at most chunkDurationSeconds,
+// cutting inside pauses so that words and sentences are not chopped at the seams
+func splitAudioFileAtSilences(audioPath string, chunkDurationSeconds int) ([]AudioChunk, error) {
+	silences, duration, err := detectSilences(audioPath)
+	if err != nil {
+		return nil, err
+	}
+	if len(silences) == 0 {
+		return nil, fmt.Errorf("no pauses detected")
+	}
+
+	target := float64(chunkDurationSeconds)
+	cuts := chooseCutPoints(silences, duration, target, target*cutSearchWindowRatio)
+	if len(cuts) == 0 {
+		return nil, fmt.Errorf("audio is shorter than one chunk")
+	}
+
+	times := make([]string, len(cuts))
+	for i, cut := range cuts {
+		times[i] = strconv.FormatFloat(cut, 'f', 3, 64)
+	}
+
+	bounds := append(append([]float64{0}, cuts...), duration)
+	return segmentAudio(audioPath, "-segment_times "+strings.Join(times, ","), func(i int) (float64, float64) {
+		if i+1 < len(bounds) {
+			return bounds[i], bounds[i+1]
+		}
+		return duration, duration
+	})
+}
+
+// splitAudio splits the file using the requested mode, falling back to fixed-time
+// cuts when silence detection is not possible
+func splitAudio(audioPath string, chunkDurationSeconds int, mode string) ([]AudioChunk, error) {
+	if mode == splitModeSilence {
+		chunks, err := splitAudioFileAtSilences(audioPath, chunkDurationSeconds)
+		if err == nil {
+			fmt.Println("✓ Cut points chosen at pauses in speech")
+			return chunks, nil
+		}
+		fmt.Printf("⚠ Silence-aware splitting unavailable (%v), using fixed %ds chunks\n", err, chunkDurationSeconds)
+	}
+
+	return splitAudioFile(audioPath, chunkDurationSeconds)
+}
+
+// videoExtensions are containers that can hold video. Only these, or an explicit
+// -audio-stream, are probed for a stream to extract; audio files are uploaded as they are.
+var videoExtensions = map[string]bool{
+	".mp4": true, ".m4v": true, ".mov": true, ".mkv": true, ".webm": true, ".avi": true,
+	".wmv": true, ".flv": true, ".mpg": true, ".mpeg": true, ".ts": true, ".mts": true,
+	".m2ts": true, ".3gp": true, ".ogv": true,
+}
+
+// mayContainVideo reports whether a file's extension is a video container
+func mayContainVideo(mediaPath string) bool {
+	return videoExtensions[strings.ToLower(filepath.Ext(mediaPath))]
+}
+
+// probeStreams lists the streams in a media file with ffprobe
+func probeStreams(mediaPath string) ([]mediaStream, error) {
+	cmd := fmt.Sprintf("ffprobe -v error -show_entries stream=index,codec_type,codec_name:stream_disposition=attached_pic:stream_tags=language,title -of json %s",
+		shellescape(mediaPath))
+
+	output, err := exec.Command("bash", "-c", cmd).Output()
+	if err != nil {
+		return nil, fmt.Errorf("ffprobe failed: %w", err)
+	}
+
+	return parseStreams(output)
+}
+
+// parseStreams decodes the JSON stream list printed by ffprobe
+func parseStreams(output []byte) ([]mediaStream, error) {
+	var probe struct {
+		Streams []mediaStream `json:"streams"`
+	}
+	if err := json.Unmarshal(output, &probe); err != nil {
+		return nil, fmt.Errorf("failed to parse ffprobe output: %w", err)
+	}
+
+	return probe.Streams, nil
+}
+
+// hasVideoStream reports whether any stream is real video (cover art embedded in audio
+// files shows up as a video stream flagged as an attached picture)
+func hasVideoStream(streams []mediaStream) bool {
+	for _, stream := range streams {
+		if stream.CodecType == "video" && stream.Disposition.AttachedPic == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// audioStreams returns only the audio streams, in the order ffmpeg numbers them for 0:a:N
+func audioStreams(streams []mediaStream) []mediaStream {
+	var audio []mediaStream
+	for _, stream := range streams {
+		if stream.CodecType == "audio" {
+			audio = append(audio, stream)
+		}
+	}
+	return audio
+}
+
+// describeStream formats an audio stream for listing, e.g. "0: aac (eng) Commentary"
+func describeStream(n int, stream mediaStream) string {
+	desc := fmt.Sprintf("%d: %s", n, stream.CodecName)
+	if stream.Tags.Language != "" {
+		desc += fmt.Sprintf(" (%s)", stream.Tags.Language)
+	}
+	if stream.Tags.Title != "" {
+		desc += " " + stream.Tags.Title
+	}
+	return desc
+}
+
+// extractAudioInput pulls the selected audio stream out of a video container (or a
+// multi-track audio file) into a compact speech-quality file. It returns an empty path
+// when the input can be uploaded as it is.
+func extractAudioInput(mediaPath string, audioStream int) (string, error) {
+	if audioStream < 0 && !mayContainVideo(mediaPath) {
+		return "", nil
+	}
+
+	streams, err := probeStreams(mediaPath)
+	if err != nil {
+		if audioStream >= 0 {
+			return "", fmt.Errorf("cannot select audio stream: %w", err)
+		}
+		fmt.Printf("⚠ Could not inspect media streams (%v), uploading file as-is\n", err)
+		return "", nil
+	}
+
+	isVideo := hasVideoStream(streams)
+	if !isVideo && audioStream < 0 {
+		return "", nil
+	}
+
+	audio := audioStreams(streams)
+	if len(audio) == 0 {
+		return "", fmt.Errorf("no audio stream found in %s", filepath.Base(mediaPath))
+	}
+	if audioStream >= len(audio) {
+		return "", fmt.Errorf("audio stream %d not found, %s has %d audio stream(s)",
+			audioStream, filepath.Base(mediaPath), len(audio))
+	}
+
+	if audioStream < 0 {
+		audioStream = 0
+		if len(audio) > 1 {
+			fmt.Printf("Found %d audio streams, using stream 0 (choose another with -audio-stream N):\n", len(audio))
+			for n, stream := range audio {
+				fmt.Printf("  %s\n", describeStream(n, stream))
+			}
+		}
+	}
+
+	if isVideo {
+		fmt.Printf("Extracting audio stream %d from video...\n", audioStream)
+	} else {
+		fmt.Printf("Extracting audio stream %d...\n", audioStream)
+	}
+
+	return transcodeForSpeech(mediaPath, audioStream)
+}
+
+// probeAudio reads the duration and average bitrate of a file with ffprobe
+func probeAudio(audioPath string) (audioInfo, error) {
+	cmd := fmt.Sprintf("ffprobe -v error -show_entries format=duration,bit_rate,size -of json %s", shellescape(audioPath))
+
+	output, err := exec.Command("bash", "-c", cmd).Output()
+	if err != nil {
+		return audioInfo{}, fmt.Errorf("ffprobe failed: %w", err)
+	}
+
+	return parseProbeOutput(output)
+}
+
+// parseProbeOutput parses ffprobe's JSON format section. When the container does not
+// report a bitrate it is derived from the file size and duration.
+func parseProbeOutput(output []byte) (audioInfo, error) {
+	var probe struct {
+		Format struct {
+			Duration string `json:"duration"`
+			BitRate  string `json:"bit_rate"`
+			Size     string `json:"size"`
+		} `json:"format"`
+	}
+	if err := json.Unmarshal(output, &probe); err != nil {
+		return audioInfo{}, fmt.Errorf("failed to parse ffprobe output: %w", err)
+	}
+
+	duration, err := strconv.ParseFloat(probe.Format.Duration, 64)
+	if err != nil || duration <= 0 {
+		return audioInfo{}, fmt.Errorf("ffprobe reported no duration")
+	}
+
+	info := audioInfo{Duration: duration}
+	if bitRate, err := strconv.ParseInt(probe.Format.BitRate, 10, 64); err == nil && bitRate > 0 {
+		info.BitRate = bitRate
+	} else if size, err := strconv.ParseInt(probe.Format.Size, 10, 64); err == nil && size > 0 {
+		info.BitRate = int64(float64(size*8) / duration)
+	}
+
+	return info, nil
+}
+
+// chunkDurationForBitrate returns the longest chunk, in seconds, that stays under the
+// upload limit at the given bitrate once the overlap with the previous chunk is added
+func chunkDurationForBitrate(bitRate int64, overlap float64) int {
+	if bitRate <= 0 {
+		return defaultChunkDurationSeconds
+	}
+
+	seconds := float64(maxFileSizeBytes)*chunkSizeSafetyRatio*8/float64(bitRate) - overlap
+	return max(minChunkDurationSeconds, int(seconds))
+}
+
+// extractAudioRange copies duration seconds of audio starting at start into outputPath
+func extractAudioRange(audioPath string, start, duration float64, outputPath string) error {
+	cmd := fmt.Sprintf("ffmpeg -y -ss %.3f -i %s -t %.3f -c copy %s %s",
+		start, shellescape(audioPath), duration, ffmpegBitexactArgs, shellescape(outputPath))
+
+	output, err := exec.Command("bash", "-c", cmd).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ffmpeg failed: %w\nOutput: %s", err, string(output))
+	}
+
+	return nil
+}
+
+// resplitOversizedChunks replaces any chunk over limit bytes with shorter pieces cut
+// from the original audio, repeating until every piece fits. Pieces are written next
+// to the chunk they replace so they are cleaned up with it.
+func resplitOversizedChunks(audioPath string, chunks []AudioChunk, limit int64) ([]AudioChunk, error) {
+	var result []AudioChunk
+
+	pending := append([]AudioChunk{}, chunks...)
+	for len(pending) > 0 {
+		chunk := pending[0]
+		pending = pending[1:]
+
+		size, err := getFileSize(chunk.Path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get chunk size: %w", err)
+		}
+		if size <= limit {
+			result = append(result, chunk)
+			continue
+		}
+
+		length := chunk.End - chunk.Start
+		pieces := int(float64(size)/(float64(limit)*chunkSizeSafetyRatio)) + 1
+		pieceLength := length / float64(pieces)
+		if pieceLength < minChunkDurationSeconds {
+			return nil, fmt.Errorf("chunk %s is %.1f MB for only %.0fs of audio - bitrate too high to split",
+				filepath.Base(chunk.Path), float64(size)/(1024*1024), length)
+		}
+
+		fmt.Printf("⚠ Chunk %s is %.1f MB, re-splitting into %d pieces\n",
+			filepath.Base(chunk.Path), float64(size)/(1024*1024), pieces)
+
+		ext := filepath.Ext(chunk.Path)
+		base := strings.TrimSuffix(chunk.Path, ext)
+		var replacements []AudioChunk
+		for k := 0; k < pieces; k++ {
+			piece := AudioChunk{
+				Path:  fmt.Sprintf("%s_%d%s", base, k, ext),
+				Start: chunk.Start + float64(k)*pieceLength,
+				End:   chunk.Start + float64(k+1)*pieceLength,
+			}
+			if k == 0 {
+				piece.Overlap = chunk.Overlap
+			}
+			if k == pieces-1 {
+				piece.End = chunk.End
+			}
+			if err := extractAudioRange(audioPath, piece.Start, piece.End-piece.Start, piece.Path); err != nil {
+				return nil, fmt.Errorf("failed to re-split chunk %s: %w", filepath.Base(chunk.Path), err)
+			}
+			replacements = append(replacements, piece)
+		}
+		os.Remove(chunk.Path)
+
+		// Check the new pieces before anything after them
+		pending = append(replacements, pending...)
+	}
+
+	return result, nil
+}
+
+// addChunkOverlap re-extracts every chunk after the first from the original file so
+// that it starts overlap seconds before its cut point. Words at a seam then appear
+// whole in at least one of the two chunks and can be reconciled after transcription.
+func addChunkOverlap(audioPath string, chunks []AudioChunk, overlap float64) error {
+	// Walk backwards so each chunk is clamped against its neighbour's original start
+	for i := len(chunks) - 1; i >= 1; i-- {
+		start := max64(chunks[i].Start-overlap, chunks[i-1].Start)
+		if err := extractAudioRange(audioPath, start, chunks[i].End-start, chunks[i].Path); err != nil {
+			return fmt.Errorf("failed to extract overlapping chunk %d: %w", i+1, err)
+		}
+
+		chunks[i].Overlap = chunks[i].Start - start
+		chunks[i].Start = start
+	}
+
+	return nil
+}
+
+// ffmpegBitexactArgs make ffmpeg write the same bytes on every run. Without them the Ogg
+// muxer picks a random stream serial, so transcoded or split files would never match
+// their transcription cache key again.
+const ffmpegBitexactArgs = "-fflags +bitexact -flags:a +bitexact"
+
+// transcodeForSpeech converts the file to a compact mono 16 kHz Opus/OGG file, which is
+// all Whisper needs for speech. audioStream selects which audio stream to use (0-based
+// among audio streams); a negative value lets ffmpeg pick. The result is written to a
+// new temp directory; the caller removes it with removeTempDir(filepath.Dir(path)).
+func transcodeForSpeech(audioPath string, audioStream int) (string, error) {
+	tmpDir, err := createTempDir("goscribe-transcode-*")
+	if err != nil {
+		return "", err
+	}
+
+	baseName := filepath.Base(audioPath)
+	outputPath := filepath.Join(tmpDir, strings.TrimSuffix(baseName, filepath.Ext(baseName))+".ogg")
+
+	streamArgs := ""
+	if audioStream >= 0 {
+		streamArgs = fmt.Sprintf("-map 0:a:%d ", audioStream)
+	}
+
+	cmd := fmt.Sprintf("ffmpeg -y -i %s %s-vn -map_metadata -1 -ac 1 -ar 16000 -c:a libopus -b:a %d -application voip %s %s",
+		shellescape(audioPath), streamArgs, speechOpusBitRate, ffmpegBitexactArgs, shellescape(outputPath))
+
+	output, err := exec.Command("bash", "-c", cmd).CombinedOutput()
+	if err != nil {
+		removeTempDir(tmpDir)
+		return "", fmt.Errorf("ffmpeg transcode failed: %w\nOutput: %s", err, string(output))
+	}
+
+	return outputPath, nil
+}
+
+// convertToWAV writes the first audio stream as 16 kHz mono 16-bit PCM WAV, the input
+// format local whisper.cpp builds expect
+func convertToWAV(audioPath, outputPath string) error {
+	cmd := fmt.Sprintf("ffmpeg -y -i %s -vn -ac 1 -ar 16000 -c:a pcm_s16le %s",
+		shellescape(audioPath), shellescape(outputPath))
+
+	output, err := exec.Command("bash", "-c", cmd).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ffmpeg WAV conversion failed: %w\nOutput: %s", err, string(output))
+	}
+
+	return nil
+}
+
+func max64(a, b float64) float64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// Temp directories created while preparing audio are tracked so they can be removed
+// even when the run is interrupted
+var (
+	tempDirsMu sync.Mutex
+	tempDirs   = map[string]bool{}
+)
+
+// createTempDir creates a temp directory that is removed on interrupt
+func createTempDir(pattern string) (string, error) {
+	dir, err := os.MkdirTemp("", pattern)
+	if err != nil {
+		return "", fmt.Errorf("failed to create temp directory: %w", err)
+	}
+
+	tempDirsMu.Lock()
+	tempDirs[dir] = true
+	tempDirsMu.Unlock()
+
+	return dir, nil
+}
+
+// removeTempDir removes a directory created with createTempDir
+func removeTempDir(dir string) {
+	tempDirsMu.Lock()
+	delete(tempDirs, dir)
+	tempDirsMu.Unlock()
+
+	os.RemoveAll(dir)
+}
+
+// handleInterrupt deletes any remaining temp directories when the process receives
+// Ctrl-C or SIGTERM, so large extracted audio files are not left behind, and records
+// what the run has been billed so far in the usage ledger before exiting
+func handleInterrupt(inputs []string) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		<-signals
+		tempDirsMu.Lock()
+		for dir := range tempDirs {
+			os.RemoveAll(dir)
+		}
+		tempDirsMu.Unlock()
+		fmt.Println("\nInterrupted, temporary files removed")
+		logRunUsage(inputs)
+		os.Exit(130)
+	}()
+}
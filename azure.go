@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// azureDefaultAPIVersion is sent as api-version when neither the action nor the azure
+// config section sets one
+const azureDefaultAPIVersion = "2024-06-01"
+
+// AzureConfig holds the Azure OpenAI resource shared by azure-openai actions and the
+// azure-openai transcriber; each of them can override endpoint, deployment and version
+type AzureConfig struct {
+	Endpoint   string `yaml:"endpoint,omitempty"`    // e.g. https://my-resource.openai.azure.com
+	APIKey     string `yaml:"api_key,omitempty"`     // Falls back to $AZURE_OPENAI_API_KEY
+	APIVersion string `yaml:"api_version,omitempty"` // Default: azureDefaultAPIVersion
+	Deployment string `yaml:"deployment,omitempty"`  // Used for --auto selection and actions without a model
+}
+
+// resolveAzureEndpoint builds the endpoint for one Azure deployment. Empty arguments fall
+// back to the azure config section. Without an explicit deployment, the model is used
+// (deployments are often named after models) before the section's default deployment,
+// so an action asking for another model never silently runs on the default one.
+func resolveAzureEndpoint(endpoint, deployment, apiVersion, model string) (apiEndpoint, error) {
+	azure := activeConfig.Azure
+
+	if endpoint == "" {
+		endpoint = azure.Endpoint
+	}
+	if deployment == "" {
+		deployment = model
+	}
+	if deployment == "" {
+		deployment = azure.Deployment
+	}
+	if apiVersion == "" {
+		apiVersion = azure.APIVersion
+	}
+	if apiVersion == "" {
+		apiVersion = azureDefaultAPIVersion
+	}
+
+	apiKey := azure.APIKey
+	if apiKey == "" {
+		apiKey = os.Getenv("AZURE_OPENAI_API_KEY")
+	}
+
+	if endpoint == "" {
+		return apiEndpoint{}, fmt.Errorf("azure endpoint is not set (set azure.endpoint in config)")
+	}
+	if deployment == "" {
+		return apiEndpoint{}, fmt.Errorf("azure deployment is not set")
+	}
+	if apiKey == "" {
+		return apiEndpoint{}, fmt.Errorf("azure API key is not set (set azure.api_key in config or AZURE_OPENAI_API_KEY)")
+	}
+
+	return apiEndpoint{
+		BaseURL:    strings.TrimRight(endpoint, "/") + "/openai/deployments/" + deployment,
+		APIKey:     apiKey,
+		KeyHeader:  "api-key",
+		APIVersion: apiVersion,
+	}, nil
+}
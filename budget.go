@@ -0,0 +1,214 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BudgetConfig caps what goscribe may spend. Calls to local backends (Ollama,
+// whisper.cpp, faster-whisper) are free and don't count.
+type BudgetConfig struct {
+	MaxCost        float64 `yaml:"max_cost,omitempty"`         // USD per run
+	MaxTokens      int     `yaml:"max_tokens,omitempty"`       // Chat input + output tokens per run
+	MonthlyMaxCost float64 `yaml:"monthly_max_cost,omitempty"` // USD per calendar month for runs with this config file
+}
+
+// errBudgetExceeded is wrapped by every error caused by a spending cap
+var errBudgetExceeded = errors.New("budget exceeded")
+
+// spendingBudget enforces the caps for one run. Requests reserve their worst case
+// before they are sent so concurrent chunks and actions can't overshoot together.
+type spendingBudget struct {
+	mu             sync.Mutex
+	maxCost        float64 // 0 means no cost cap
+	maxTokens      int     // 0 means no token cap
+	reservedCost   float64
+	reservedTokens int
+	reached        bool
+}
+
+// runBudget is the active budget; nil when no cap is set
+var runBudget *spendingBudget
+
+// runProfile is the config file a run uses; monthly caps and the ledger are kept per profile
+var runProfile string
+
+// newSpendingBudget combines the config's caps with -max-cost/-max-tokens, which
+// override the per-run caps, and what the profile has already spent this month. It
+// returns nil if nothing is capped.
+func newSpendingBudget(config BudgetConfig, maxCost float64, maxTokens int, profile string, now time.Time) (*spendingBudget, error) {
+	budget := &spendingBudget{maxCost: config.MaxCost, maxTokens: config.MaxTokens}
+	if maxCost > 0 {
+		budget.maxCost = maxCost
+	}
+	if maxTokens > 0 {
+		budget.maxTokens = maxTokens
+	}
+
+	if config.MonthlyMaxCost > 0 {
+		spent, err := monthlySpending(profile, now)
+		if err != nil {
+			return nil, err
+		}
+		remaining := config.MonthlyMaxCost - spent
+		if remaining <= 0 {
+			return nil, fmt.Errorf("%w: monthly budget of $%.2f for %s is used up ($%.2f spent)", errBudgetExceeded, config.MonthlyMaxCost, profile, spent)
+		}
+		if budget.maxCost == 0 || remaining < budget.maxCost {
+			budget.maxCost = remaining
+		}
+	}
+
+	if budget.maxCost == 0 && budget.maxTokens == 0 {
+		return nil, nil
+	}
+	return budget, nil
+}
+
+// monthlySpending adds up the ledger's cost for a profile in now's calendar month
+func monthlySpending(profile string, now time.Time) (float64, error) {
+	path, err := usageLedgerPath()
+	if err != nil {
+		return 0, err
+	}
+	entries, err := readUsageLedger(path)
+	if err != nil {
+		return 0, err
+	}
+
+	month := now.Format("2006-01")
+	spent := 0.0
+	for _, entry := range entries {
+		if entry.Profile == profile && entry.Time.Local().Format("2006-01") == month {
+			spent += entry.Cost
+		}
+	}
+	return spent, nil
+}
+
+// profileName identifies a config file in the ledger
+func profileName(configPath string) string {
+	if abs, err := filepath.Abs(configPath); err == nil {
+		return abs
+	}
+	return configPath
+}
+
+// spent returns what the run has been billed so far
+func (b *spendingBudget) spent() (float64, int) {
+	cost, tokens := 0.0, 0
+	for _, r := range runUsage.snapshot() {
+		if !r.Local {
+			cost += r.Cost
+			tokens += r.InputTokens + r.OutputTokens
+		}
+	}
+	return cost, tokens
+}
+
+// reserve checks a request's worst case against the caps before it is sent. The
+// reservation holds until release, once the request's real usage has been recorded.
+func (b *spendingBudget) reserve(model string, cost float64, priced bool, tokens int) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.maxCost > 0 && !priced {
+		return fmt.Errorf("%w: %s has no price in the model registry, so the $%.2f cap can't be enforced (add its prices under models: in config, e.g. input_price: 0 for a free self-hosted model)", errBudgetExceeded, model, b.maxCost)
+	}
+
+	spentCost, spentTokens := b.spent()
+	if b.maxCost > 0 && spentCost+b.reservedCost+cost > b.maxCost {
+		b.reached = true
+		return fmt.Errorf("%w: request to %s could cost up to $%.2f with $%.2f of $%.2f already spent or reserved", errBudgetExceeded, model, cost, spentCost+b.reservedCost, b.maxCost)
+	}
+	if b.maxTokens > 0 && spentTokens+b.reservedTokens+tokens > b.maxTokens {
+		b.reached = true
+		return fmt.Errorf("%w: request to %s could use up to %d tokens with %d of %d already used or reserved", errBudgetExceeded, model, tokens, spentTokens+b.reservedTokens, b.maxTokens)
+	}
+
+	b.reservedCost += cost
+	b.reservedTokens += tokens
+	return nil
+}
+
+// release drops a reservation and checks what has actually been spent, which can be
+// more than was reserved when a server reports more tokens than counted locally
+func (b *spendingBudget) release(cost float64, tokens int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.reservedCost -= cost
+	b.reservedTokens -= tokens
+
+	spentCost, spentTokens := b.spent()
+	if (b.maxCost > 0 && spentCost >= b.maxCost) || (b.maxTokens > 0 && spentTokens >= b.maxTokens) {
+		b.reached = true
+	}
+}
+
+// describe summarizes the caps, e.g. "$2.00, 100000 tokens"
+func (b *spendingBudget) describe() string {
+	var caps []string
+	if b.maxCost > 0 {
+		caps = append(caps, fmt.Sprintf("$%.2f", b.maxCost))
+	}
+	if b.maxTokens > 0 {
+		caps = append(caps, fmt.Sprintf("%d tokens", b.maxTokens))
+	}
+	return strings.Join(caps, ", ")
+}
+
+// reserveChat checks a chat request against the budget. Output is assumed to reach
+// max_tokens. It returns a function that releases the reservation.
+func reserveChat(model string, reqBody ChatCompletionRequest, local bool) (func(), error) {
+	if runBudget == nil || local {
+		return func() {}, nil
+	}
+
+	usage := countChatUsage(reqBody, "")
+	usage.OutputTokens = reqBody.MaxTokens
+	if usage.OutputTokens <= 0 {
+		usage.OutputTokens = modelInfo(model).MaxOutput
+	}
+	cost, priced := priceTokens(model, usage.InputTokens, usage.OutputTokens)
+	tokens := usage.InputTokens + usage.OutputTokens
+
+	if err := runBudget.reserve(model, cost, priced, tokens); err != nil {
+		return nil, err
+	}
+	return func() { runBudget.release(cost, tokens) }, nil
+}
+
+// reserveAudio checks a transcription upload of seconds of audio against the budget
+func reserveAudio(model string, seconds float64) (func(), error) {
+	if runBudget == nil {
+		return func() {}, nil
+	}
+
+	info, _ := lookupModel(activeConfig.Models, strings.TrimPrefix(model, "azure:"))
+	cost := seconds / 60 * info.AudioPrice
+	if err := runBudget.reserve(model, cost, info.AudioPriced, 0); err != nil {
+		return nil, err
+	}
+	return func() { runBudget.release(cost, 0) }, nil
+}
+
+// budgetReached reports whether the run stopped, or is at, a spending cap
+func budgetReached() bool {
+	if runBudget == nil {
+		return false
+	}
+	runBudget.mu.Lock()
+	defer runBudget.mu.Unlock()
+	return runBudget.reached
+}
+
+// partialFilename marks an output file as incomplete: notes.txt becomes notes.partial.txt
+func partialFilename(filename string) string {
+	ext := filepath.Ext(filename)
+	return strings.TrimSuffix(filename, ext) + ".partial" + ext
+}
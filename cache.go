@@ -0,0 +1,365 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// transcriptionCacheVersion is part of every transcription cache key; bump it when the
+// cached format or the way requests are built changes
+const transcriptionCacheVersion = "1"
+
+// responseCacheVersion is part of every response cache key
+const responseCacheVersion = "2"
+
+// noResponseCache turns off the post-processing response cache (-no-cache)
+var noResponseCache bool
+
+// getCacheDir returns (and creates) ~/.goscribe/cache/<kind>
+func getCacheDir(kind string) (string, error) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to get home directory: %w", err)
+	}
+
+	dir := filepath.Join(homeDir, ".goscribe", "cache", kind)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create cache directory: %w", err)
+	}
+
+	return dir, nil
+}
+
+// transcriptionCacheKey identifies a transcription by the audio content and every
+// setting that changes what the API returns for it
+func transcriptionCacheKey(audioPath, transcriberID string, opts TranscriptionOptions) (string, error) {
+	file, err := os.Open(audioPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to open audio file: %w", err)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", fmt.Errorf("failed to hash audio file: %w", err)
+	}
+
+	settings, err := json.Marshal(struct {
+		Version    string `json:"version"`
+		Model      string `json:"model"`
+		Timestamps bool   `json:"timestamps"`
+		Prompt     string `json:"prompt"`
+	}{transcriptionCacheVersion, transcriberID, opts.Timestamps, opts.Prompt})
+	if err != nil {
+		return "", fmt.Errorf("failed to encode cache settings: %w", err)
+	}
+	hash.Write(settings)
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// loadCachedTranscript returns the cached transcript for key, if there is one, and marks
+// it as used
+func loadCachedTranscript(key string) (*Transcript, bool) {
+	dir, err := getCacheDir("transcriptions")
+	if err != nil {
+		return nil, false
+	}
+
+	path := filepath.Join(dir, key+".json")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+
+	var transcript Transcript
+	if err := json.Unmarshal(data, &transcript); err != nil {
+		return nil, false
+	}
+
+	// Hits count as use, so prune -older-than keeps transcripts that are still resumed
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	return &transcript, true
+}
+
+// storeCachedTranscript saves a transcript under key, replacing any previous entry
+func storeCachedTranscript(key string, transcript *Transcript) error {
+	dir, err := getCacheDir("transcriptions")
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(transcript)
+	if err != nil {
+		return fmt.Errorf("failed to encode transcript: %w", err)
+	}
+
+	return writeFileAtomic(filepath.Join(dir, key+".json"), data)
+}
+
+// writeFileAtomic writes data to a temp file next to path and renames it into place,
+// so an interrupted run never leaves a truncated cache entry
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write temp file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close temp file: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to move file into place: %w", err)
+	}
+
+	return nil
+}
+
+// transcribeAudioCached transcribes a file, reusing a previous result for identical
+// audio and settings so an interrupted run only re-sends what is missing
+func transcribeAudioCached(audioPath string, transcriber Transcriber, opts TranscriptionOptions) (*Transcript, bool, error) {
+	if opts.NoCache {
+		transcript, err := transcribeRecorded(transcriber, audioPath, opts)
+		return transcript, false, err
+	}
+
+	key, err := transcriptionCacheKey(audioPath, transcriber.CacheID(), opts)
+	if err != nil {
+		fmt.Printf("⚠ Warning: transcription cache unavailable: %v\n", err)
+		transcript, err := transcribeRecorded(transcriber, audioPath, opts)
+		return transcript, false, err
+	}
+
+	if transcript, ok := loadCachedTranscript(key); ok {
+		return transcript, true, nil
+	}
+
+	transcript, err := transcribeRecorded(transcriber, audioPath, opts)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if err := storeCachedTranscript(key, transcript); err != nil {
+		fmt.Printf("⚠ Warning: failed to cache transcription: %v\n", err)
+	}
+
+	return transcript, false, nil
+}
+
+// cachedResponse is a chat reply stored in ~/.goscribe/cache/responses
+type cachedResponse struct {
+	Model   string    `json:"model"`
+	Content string    `json:"content"`
+	Created time.Time `json:"created"`
+}
+
+// responseCacheKey identifies a chat request by everything that shapes the reply: the
+// provider and the endpoint it resolves to (URL, Azure deployment and api-version,
+// request headers), model, messages (prompt and input text), temperature, max_tokens
+// and any output schema. The API key is left out.
+func responseCacheKey(action *PostAction, apiKey string, reqBody ChatCompletionRequest) (string, error) {
+	endpoint, err := chatEndpoint(action, apiKey)
+	if err != nil {
+		return "", err
+	}
+
+	provider, model := actionTypeOpenAI, reqBody.Model
+	if action != nil {
+		provider = action.Type
+		if action.Type == actionTypeOllama {
+			model = ollamaModel(model)
+		}
+	}
+
+	data, err := json.Marshal(struct {
+		Version        string            `json:"version"`
+		Provider       string            `json:"provider"`
+		BaseURL        string            `json:"base_url"`
+		APIVersion     string            `json:"api_version,omitempty"`
+		Headers        map[string]string `json:"headers,omitempty"`
+		Model          string            `json:"model"`
+		Messages       []Message         `json:"messages"`
+		Temperature    float64           `json:"temperature"`
+		MaxTokens      int               `json:"max_tokens"`
+		ResponseFormat *ResponseFormat   `json:"response_format,omitempty"`
+	}{responseCacheVersion, provider, strings.TrimRight(endpoint.BaseURL, "/"), endpoint.APIVersion, endpoint.Headers, model, reqBody.Messages, reqBody.Temperature, reqBody.MaxTokens, reqBody.ResponseFormat})
+	if err != nil {
+		return "", fmt.Errorf("failed to encode cache key: %w", err)
+	}
+
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// loadCachedResponse returns the cached reply for key, if there is one. A hit refreshes
+// the entry's modification time so prune keeps entries that are still used.
+func loadCachedResponse(key string) (string, bool) {
+	dir, err := getCacheDir("responses")
+	if err != nil {
+		return "", false
+	}
+
+	path := filepath.Join(dir, key+".json")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", false
+	}
+
+	var response cachedResponse
+	if err := json.Unmarshal(data, &response); err != nil {
+		return "", false
+	}
+
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	return response.Content, true
+}
+
+// storeCachedResponse saves a reply under key, replacing any previous entry
+func storeCachedResponse(key, model, content string) error {
+	dir, err := getCacheDir("responses")
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(cachedResponse{Model: model, Content: content, Created: time.Now()})
+	if err != nil {
+		return fmt.Errorf("failed to encode response: %w", err)
+	}
+
+	return writeFileAtomic(filepath.Join(dir, key+".json"), data)
+}
+
+// sendActionChatCached answers a post-processing request from the response cache when
+// the same request was sent before, so re-running an action over an unchanged
+// transcript (or its unchanged chunks) isn't billed again. Cache hits make no request
+// and record no usage.
+func sendActionChatCached(action *PostAction, apiKey string, reqBody ChatCompletionRequest, out io.Writer) (string, error) {
+	if noResponseCache {
+		return sendActionChat(action, apiKey, reqBody, out)
+	}
+
+	key, err := responseCacheKey(action, apiKey, reqBody)
+	if err != nil {
+		fmt.Fprintf(out, "  ⚠ Warning: response cache unavailable: %v\n", err)
+		return sendActionChat(action, apiKey, reqBody, out)
+	}
+
+	if content, ok := loadCachedResponse(key); ok {
+		fmt.Fprintf(out, "  ✓ Using cached response\n")
+		return content, nil
+	}
+
+	content, err := sendActionChat(action, apiKey, reqBody, out)
+	if err != nil {
+		return "", err
+	}
+
+	if err := storeCachedResponse(key, reqBody.Model, content); err != nil {
+		fmt.Fprintf(out, "  ⚠ Warning: failed to cache response: %v\n", err)
+	}
+
+	return content, nil
+}
+
+// parseAge reads a prune age: a number of days ("30d") or a Go duration ("12h")
+func parseAge(value string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid age '%s' (use e.g. 30d or 12h)", value)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid age '%s' (use e.g. 30d or 12h)", value)
+	}
+	return d, nil
+}
+
+// pruneCache removes entries of the given cache kinds last used before cutoff and
+// returns how many files and bytes were removed
+func pruneCache(kinds []string, cutoff time.Time) (int, int64, error) {
+	removed, freed := 0, int64(0)
+	for _, kind := range kinds {
+		dir, err := getCacheDir(kind)
+		if err != nil {
+			return removed, freed, err
+		}
+
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return removed, freed, fmt.Errorf("failed to read cache directory: %w", err)
+		}
+		for _, entry := range entries {
+			info, err := entry.Info()
+			if err != nil || entry.IsDir() || !info.ModTime().Before(cutoff) {
+				continue
+			}
+			if err := os.Remove(filepath.Join(dir, entry.Name())); err != nil {
+				return removed, freed, fmt.Errorf("failed to remove cache entry: %w", err)
+			}
+			removed++
+			freed += info.Size()
+		}
+	}
+	return removed, freed, nil
+}
+
+// runCacheCommand implements `goscribe cache prune`
+func runCacheCommand(args []string, out io.Writer) error {
+	if len(args) == 0 || args[0] != "prune" {
+		return fmt.Errorf("usage: goscribe cache prune [-older-than 30d] [-kind responses|transcriptions] [-all]")
+	}
+
+	flags := flag.NewFlagSet("cache prune", flag.ContinueOnError)
+	olderThan := flags.String("older-than", "30d", "Remove entries not used for this long (e.g. 30d, 12h)")
+	kind := flags.String("kind", "", "Only prune 'responses' or 'transcriptions' (default: both)")
+	all := flags.Bool("all", false, "Remove every entry regardless of age")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	kinds := []string{"responses", "transcriptions"}
+	switch *kind {
+	case "":
+	case "responses", "transcriptions":
+		kinds = []string{*kind}
+	default:
+		return fmt.Errorf("invalid -kind '%s' (valid: responses, transcriptions)", *kind)
+	}
+
+	cutoff := time.Now().Add(time.Minute) // Everything, including entries written just now
+	if !*all {
+		age, err := parseAge(*olderThan)
+		if err != nil {
+			return err
+		}
+		cutoff = time.Now().Add(-age)
+	}
+
+	removed, freed, err := pruneCache(kinds, cutoff)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "✓ Removed %d cache entries (%.1f MB) from %s\n", removed, float64(freed)/(1024*1024), strings.Join(kinds, " and "))
+	return nil
+}
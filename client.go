@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultRequestTimeoutSeconds = 300 // Whisper uploads and local models can be slow
+	defaultMaxAttempts           = 4
+	retryBaseDelay               = 1 * time.Second
+	retryMaxDelay                = 30 * time.Second
+	maxRetryAfter                = 5 * time.Minute // Ignore Retry-After values beyond this
+)
+
+// HTTPConfig tunes the client shared by every API call
+type HTTPConfig struct {
+	TimeoutSeconds int `yaml:"timeout_seconds,omitempty"` // Per attempt, including reading the response (default 300)
+	MaxAttempts    int `yaml:"max_attempts,omitempty"`    // Total tries for 429, 5xx and network errors (default 4)
+}
+
+// retryingClient sends API requests, retrying rate limits, server errors and network
+// failures with exponential backoff and jitter
+type retryingClient struct {
+	client      *http.Client
+	maxAttempts int
+	sleep       func(time.Duration) // Replaced in tests
+}
+
+// apiClient is shared by every API call; main rebuilds it from the config's http section
+var apiClient = newRetryingClient(HTTPConfig{})
+
+// newRetryingClient builds a client from the config, filling in defaults
+func newRetryingClient(cfg HTTPConfig) *retryingClient {
+	timeout := cfg.TimeoutSeconds
+	if timeout <= 0 {
+		timeout = defaultRequestTimeoutSeconds
+	}
+	attempts := cfg.MaxAttempts
+	if attempts <= 0 {
+		attempts = defaultMaxAttempts
+	}
+
+	return &retryingClient{
+		client:      &http.Client{Timeout: time.Duration(timeout) * time.Second},
+		maxAttempts: attempts,
+		sleep:       time.Sleep,
+	}
+}
+
+// send performs the request and returns the final status code and body, writing retry
+// notices to out. Requests whose body can't be replayed are sent only once.
+func (c *retryingClient) send(req *http.Request, out io.Writer) (int, []byte, error) {
+	for attempt := 1; ; attempt++ {
+		if attempt > 1 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return 0, nil, fmt.Errorf("failed to rewind request body: %w", err)
+			}
+			req.Body = body
+		}
+
+		statusCode, respBody, retryAfter, err := c.attempt(req)
+
+		canRetry := attempt < c.maxAttempts && (req.Body == nil || req.GetBody != nil)
+		if !canRetry || (err == nil && !isRetryableStatus(statusCode)) {
+			return statusCode, respBody, err
+		}
+
+		delay := backoffDelay(attempt)
+		if retryAfter > 0 {
+			delay = retryAfter
+		}
+
+		reason := fmt.Sprintf("status %d", statusCode)
+		if err != nil {
+			reason = err.Error()
+		}
+		fmt.Fprintf(out, "  ⚠ API request failed (%s), retrying in %.1fs (attempt %d/%d)...\n",
+			reason, delay.Seconds(), attempt+1, c.maxAttempts)
+		c.sleep(delay)
+	}
+}
+
+// attempt sends the request once, returning the status, body and any Retry-After delay
+func (c *retryingClient) attempt(req *http.Request) (int, []byte, time.Duration, error) {
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, 0, fmt.Errorf("failed to read response: %w", err)
+	}
+
+	return resp.StatusCode, respBody, parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()), nil
+}
+
+// isRetryableStatus reports whether a response is worth retrying: rate limits and
+// server-side errors usually clear up on their own
+func isRetryableStatus(statusCode int) bool {
+	return statusCode == http.StatusTooManyRequests || statusCode >= 500
+}
+
+// backoffDelay returns the wait before retry number attempt: exponential from
+// retryBaseDelay, capped at retryMaxDelay, with the upper half randomized so parallel
+// chunk uploads don't retry in lockstep
+func backoffDelay(attempt int) time.Duration {
+	delay := retryBaseDelay << (attempt - 1)
+	if delay > retryMaxDelay || delay <= 0 {
+		delay = retryMaxDelay
+	}
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// parseRetryAfter reads a Retry-After header given either in seconds or as an HTTP
+// date. It returns 0 when the header is missing, invalid or unreasonably long.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+
+	var delay time.Duration
+	if seconds, err := strconv.Atoi(value); err == nil {
+		delay = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(value); err == nil {
+		delay = date.Sub(now)
+	}
+
+	if delay <= 0 || delay > maxRetryAfter {
+		return 0
+	}
+	return delay
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// runConcurrently calls fn for every index in [0, count) with at most limit calls in
+// flight, and returns each call's error at its index. With a limit of 1 the calls run
+// strictly in order, each one starting after the previous has returned.
+func runConcurrently(count, limit int, fn func(i int) error) []error {
+	return runPool(count, limit, false, fn)
+}
+
+// runUntilError is runConcurrently for work that is wasted once any call fails: after
+// the first error no new calls start, while calls already in flight finish. Calls that
+// never started leave a nil error at their index.
+func runUntilError(count, limit int, fn func(i int) error) []error {
+	return runPool(count, limit, true, fn)
+}
+
+func runPool(count, limit int, stopOnError bool, fn func(i int) error) []error {
+	if limit < 1 {
+		limit = 1
+	}
+
+	errs := make([]error, count)
+	sem := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+	var failed atomic.Bool
+
+	for i := 0; i < count; i++ {
+		sem <- struct{}{}
+		if stopOnError && failed.Load() {
+			<-sem
+			break
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			// Mark the failure before the slot is released so the next call sees it
+			if errs[i] = fn(i); errs[i] != nil {
+				failed.Store(true)
+			}
+		}(i)
+	}
+
+	wg.Wait()
+	return errs
+}
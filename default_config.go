@@ -8,6 +8,83 @@ func getDefaultConfigContent() string {
 # If set here, you don't need to provide -k flag every time
 openai_api_key: ""
 
+# Anthropic API Key (optional) - used by actions with type "anthropic".
+# Can also be stored with -set-anthropic-key or set as ANTHROPIC_API_KEY.
+# anthropic_api_key: ""
+
+# OpenAI-compatible server (optional) - point goscribe at LocalAI, vLLM, LiteLLM
+# or a corporate gateway instead of api.openai.com. Actions can set their own
+# base_url and headers, which take precedence. Header values may use ${ENV_VAR}.
+# The OpenAI key and these headers are only sent to this base_url; an action with
+# its own base_url sends its own api_key and headers (e.g. api_key: "${VLLM_API_KEY}").
+# base_url: "http://localhost:8080/v1"
+# headers:
+#   X-Gateway-Token: "${GATEWAY_TOKEN}"
+
+# Azure OpenAI (optional) - used by actions with type "azure-openai" and by the
+# "azure-openai" transcriber. Actions can set their own endpoint, deployment
+# and api_version; deployment defaults to the action's model name, then to
+# azure.deployment.
+# azure:
+#   endpoint: "https://my-resource.openai.azure.com"
+#   api_key: ""                        # or set AZURE_OPENAI_API_KEY
+#   api_version: "2024-06-01"
+#   deployment: "gpt-4o"               # also used for --auto selection
+
+# Ollama (optional) - local server for actions with type "ollama", or for any
+# action when run with -provider ollama. Nothing leaves this machine.
+# ollama:
+#   host: "http://localhost:11434"     # or set OLLAMA_HOST
+#   model: "llama3.1"                  # default model for ollama actions
+#   context_window: 8192               # num_ctx; transcripts are chunked to fit
+
+# HTTP (optional) - every API call retries rate limits (429), server errors
+# (5xx) and network failures with exponential backoff, honoring Retry-After.
+# http:
+#   timeout_seconds: 300               # per attempt
+#   max_attempts: 4
+
+# Models (optional) - context windows, output limits, tokenizer encodings and
+# prices (USD per 1M tokens, or per audio minute) used for chunking, validation
+# and cost figures. Entries extend or override the built-in table field by field
+# (an explicit 0 applies); a name also covers its dated variants, e.g. gpt-4o
+# covers gpt-4o-2024-08-06.
+# models:
+#   gpt-4o:
+#     input_price: 2.50
+#     output_price: 10.00
+#   my-finetune:
+#     context_window: 128000
+#     max_output: 16384
+#     encoding: "o200k_base"           # or cl100k_base
+#     input_price: 3.75
+#     output_price: 15.00
+
+# Spending caps, checked before every API request. A run that reaches one stops
+# and saves what it has as .partial files. -max-cost/-max-tokens override the
+# per-run caps; monthly_max_cost covers all runs using this config file.
+# budget:
+#   max_cost: 2.00                     # USD per run
+#   max_tokens: 200000                 # chat tokens per run
+#   monthly_max_cost: 50.00            # USD per calendar month
+
+# Glossary (optional) - names, acronyms and product terms passed to Whisper so
+# they are spelled consistently across long recordings. Terms given with the
+# -glossary flag are added to this list.
+# glossary:
+#   - "Kubernetes"
+#   - "Jane Doe"
+
+# Transcriber (optional) - defaults to the OpenAI Whisper API. Use a local
+# whisper.cpp or faster-whisper install for recordings that must stay on this
+# machine. The -transcriber flag overrides the backend.
+# transcriber:
+#   backend: "whisper-cpp"             # openai, azure-openai, whisper-cpp or faster-whisper
+#   binary: "whisper-cli"              # faster-whisper default: whisper-ctranslate2
+#   model_path: "~/models/ggml-large-v3.bin"
+#   language: "en"                     # omit to auto-detect
+#   threads: 8
+
 post_actions:
   - id: "openai-meeting-summary"
     name: "Smart Meeting Summary"
@@ -43,6 +120,33 @@ post_actions:
     temperature: 0.2
     max_tokens: 1000
 
+  - id: "openai-action-items-json"
+    name: "Action Items (JSON)"
+    description: "Extract action items as JSON for scripts and task trackers"
+    type: "openai"
+    prompt: |
+      Extract all action items, tasks, deadlines, and assignments from this transcript.
+      Use null for an owner or due date that isn't mentioned.
+    model: "gpt-4o-mini"
+    temperature: 0.2
+    max_tokens: 2000
+    schema:
+      type: object
+      properties:
+        action_items:
+          type: array
+          items:
+            type: object
+            properties:
+              task: {type: string}
+              owner: {type: [string, "null"]}
+              due: {type: [string, "null"]}
+              priority: {type: string, enum: [high, medium, low]}
+            required: [task, owner, due, priority]
+            additionalProperties: false
+      required: [action_items]
+      additionalProperties: false
+
   - id: "openai-executive-brief"
     name: "Executive Brief"
     description: "Concise executive summary for leadership review"
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+)
+
+// spokenTokensPerMinute estimates a transcript's length before it exists: about 150
+// spoken words a minute at roughly 1.3 tokens per word
+const spokenTokensPerMinute = 200
+
+// costEstimate is the predicted usage and price of one step of a run
+type costEstimate struct {
+	Step         string
+	Model        string
+	Calls        int
+	InputTokens  int
+	OutputTokens int // Upper bound: every call is assumed to use its max_tokens
+	AudioMinutes float64
+	Cost         float64
+	Priced       bool // The registry has a price for the model
+	Local        bool // Runs on this machine, nothing is billed
+	Note         string
+}
+
+// transcriptionPlan is what transcribeAudioWithSplitting would do with a file
+type transcriptionPlan struct {
+	Duration     float64 // Seconds of audio
+	UploadSize   int64   // Bytes to upload after extraction or transcoding
+	Converted    bool    // The audio is extracted or transcoded to Opus first
+	Chunks       int
+	ChunkSeconds int // Target chunk length when splitting
+}
+
+// planTranscription probes a file with ffprobe and works out how it would be uploaded:
+// whether its audio is extracted or transcoded first, and into how many chunks it is
+// split. Silence-based splitting may cut a chunk or two more than planned.
+func planTranscription(audioPath string, transcriber Transcriber, opts TranscriptionOptions) (transcriptionPlan, error) {
+	info, err := probeAudio(audioPath)
+	if err != nil {
+		return transcriptionPlan{}, fmt.Errorf("failed to probe audio: %w", err)
+	}
+	size, err := getFileSize(audioPath)
+	if err != nil {
+		return transcriptionPlan{}, fmt.Errorf("failed to get file size: %w", err)
+	}
+
+	plan := transcriptionPlan{Duration: info.Duration, UploadSize: size, Chunks: 1}
+	bitRate := info.BitRate
+
+	// Videos and selected audio streams are extracted to Opus, as is anything with -transcode
+	converted := opts.Transcode || opts.AudioStream >= 0
+	if !converted && mayContainVideo(audioPath) {
+		streams, err := probeStreams(audioPath)
+		converted = err == nil && hasVideoStream(streams)
+	}
+	if converted {
+		plan.Converted = true
+		bitRate = speechOpusBitRate
+		plan.UploadSize = int64(info.Duration * speechOpusBitRate / 8)
+	}
+
+	if limit := transcriber.MaxFileSize(); limit > 0 && plan.UploadSize > limit {
+		plan.ChunkSeconds = chunkDurationForBitrate(bitRate, opts.Overlap)
+		plan.Chunks = (int(info.Duration) + plan.ChunkSeconds - 1) / plan.ChunkSeconds
+	}
+
+	return plan, nil
+}
+
+// estimateTranscription prices a transcription plan. Overlapping chunks upload their
+// shared seconds twice, so those are billed twice too.
+func estimateTranscription(plan transcriptionPlan, transcriber Transcriber, overlap float64) costEstimate {
+	est := costEstimate{
+		Step:         "transcription",
+		Calls:        plan.Chunks,
+		AudioMinutes: (plan.Duration + overlap*float64(plan.Chunks-1)) / 60,
+	}
+	if plan.Chunks > 1 {
+		est.Note = fmt.Sprintf("%d chunks of up to %ds", plan.Chunks, plan.ChunkSeconds)
+	}
+
+	remote, ok := transcriber.(*openAITranscriber)
+	if !ok {
+		est.Model = transcriber.Name()
+		est.Local = true
+		return est
+	}
+
+	est.Model = remote.Model
+	if info, _ := lookupModel(activeConfig.Models, strings.TrimPrefix(remote.Model, "azure:")); info.AudioPriced {
+		est.Cost = est.AudioMinutes * info.AudioPrice
+		est.Priced = true
+	}
+	return est
+}
+
+// estimateAction predicts the requests processWithOpenAIChunked would send for an
+// action. With the transcript at hand its chunks are planned exactly; before
+// transcription, transcriptTokens is an estimate and chunks are assumed equal.
+func estimateAction(action *PostAction, transcript string, transcriptTokens int) costEstimate {
+	est := costEstimate{Step: action.ID, Model: action.Model}
+	if action.Type == actionTypeOllama {
+		est.Model = ollamaModel(action.Model)
+		est.Local = true
+	}
+
+	if transcript != "" {
+		transcriptTokens = countTokens(transcript, action.Model)
+	}
+	limit := getActionContextLimit(action)
+	promptTokens := countTokens(action.Prompt, action.Model)
+	overhead := countTokens(buildActionPrompt(action, ""), action.Model)
+	if action.Schema != nil {
+		overhead = countTokens(buildStructuredPrompt(action, ""), action.Model)
+	}
+
+	// The same decision and chunk size as processWithOpenAIChunked
+	var inputs []int
+	maxChunkTokens := limit - promptTokens - 500
+	switch {
+	case promptTokens+transcriptTokens <= limit:
+		inputs = []int{overhead + transcriptTokens}
+	case transcript != "":
+		for _, chunk := range splitTranscriptIntoChunks(transcript, action.Model, maxChunkTokens) {
+			inputs = append(inputs, overhead+countTokens(chunk, action.Model))
+		}
+	default:
+		maxChunkTokens = max(1, maxChunkTokens)
+		chunks := (transcriptTokens + maxChunkTokens - 1) / maxChunkTokens
+		for i := 0; i < chunks; i++ {
+			inputs = append(inputs, overhead+transcriptTokens/chunks)
+		}
+	}
+
+	for _, input := range inputs {
+		est.Calls++
+		est.InputTokens += input
+		est.OutputTokens += action.MaxTokens
+	}
+
+	// Structured results are merged locally. Other chunk results are merged in one
+	// request, or in pairs when together they take more than half the context (assuming
+	// every result is max_tokens long).
+	if chunks := len(inputs); chunks > 1 && action.Schema != nil {
+		est.Note = fmt.Sprintf("%d chunks, merged locally", chunks)
+	} else if chunks > 1 {
+		merges, perMerge := 1, chunks
+		est.Note = fmt.Sprintf("%d chunks + 1 merge", chunks)
+		if chunks*action.MaxTokens > limit/2 {
+			merges, perMerge = chunks-1, 2
+			est.Note = fmt.Sprintf("%d chunks + %d hierarchical merges", chunks, merges)
+		}
+		mergeOverhead := countTokens(buildMergePrompt(action, perMerge, strings.Repeat(chunkBoundary, perMerge-1)), action.Model)
+
+		est.Calls += merges
+		est.InputTokens += merges * (mergeOverhead + perMerge*action.MaxTokens)
+		est.OutputTokens += merges * action.MaxTokens
+	}
+
+	est.Cost, est.Priced = priceTokens(est.Model, est.InputTokens, est.OutputTokens)
+	return est
+}
+
+// estimateSelection predicts the --auto request, which sees the start of the transcript
+func estimateSelection(transcript string, transcriptTokens int) costEstimate {
+	_, model := selectionModel()
+	est := costEstimate{Step: "auto-select", Model: model, Calls: 1, OutputTokens: selectionMaxTokens,
+		Note: "selected actions not included"}
+
+	if transcript != "" {
+		est.InputTokens = countTokens(buildSelectionPrompt(transcript), model)
+	} else {
+		est.InputTokens = countTokens(buildSelectionPrompt(""), model) + min(transcriptTokens, 2000/avgCharsPerToken)
+	}
+	if selectionOverride != nil && selectionOverride.Type == actionTypeOllama {
+		est.Local = true
+	}
+
+	est.Cost, est.Priced = priceTokens(model, est.InputTokens, est.OutputTokens)
+	return est
+}
+
+// priceTokens returns what the tokens cost with model, if the registry has its prices.
+// A model configured with input_price: 0 is priced and free.
+func priceTokens(model string, inputTokens, outputTokens int) (float64, bool) {
+	info, _ := lookupModel(activeConfig.Models, model)
+	if !info.TokensPriced {
+		return 0, false
+	}
+	return float64(inputTokens)*info.InputPrice/1e6 + float64(outputTokens)*info.OutputPrice/1e6, true
+}
+
+// printCostEstimates writes the estimates as a table with a total
+func printCostEstimates(estimates []costEstimate, out io.Writer) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "Step\tModel\tCalls\tInput\tOutput (max)\tCost\t")
+
+	total, unpriced, calls := 0.0, 0, 0
+	for _, est := range estimates {
+		input := fmt.Sprintf("%d tok", est.InputTokens)
+		output := fmt.Sprintf("%d tok", est.OutputTokens)
+		if est.AudioMinutes > 0 {
+			input, output = fmt.Sprintf("%.1f min", est.AudioMinutes), "-"
+		}
+
+		cost := "no price"
+		switch {
+		case est.Local:
+			cost = "local"
+		case est.Priced:
+			cost = fmt.Sprintf("$%.2f", est.Cost)
+			total += est.Cost
+		default:
+			unpriced++
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\t%s\n", est.Step, est.Model, est.Calls, input, output, cost, est.Note)
+		calls += est.Calls
+	}
+	fmt.Fprintf(w, "Total\t\t%d\t\t\t$%.2f\t\n", calls, total)
+	w.Flush()
+
+	if unpriced > 0 {
+		fmt.Fprintf(out, "⚠ %d step(s) have no price in the model registry; add input_price/output_price (or audio_price) under models: in config\n", unpriced)
+	}
+}
+
+// runDryRun shows what a run would do and roughly what it would cost without calling
+// any API. Either audioPath or transcript is set. Chat costs assume every response uses
+// max_tokens, so they are upper bounds.
+func runDryRun(audioPath, transcript string, transcriber Transcriber, opts TranscriptionOptions, actions []*PostAction, autoSelect bool, out io.Writer) error {
+	fmt.Fprintln(out, "Dry run: no API calls will be made")
+	fmt.Fprintln(out)
+
+	var estimates []costEstimate
+	transcriptTokens := 0
+
+	if audioPath != "" {
+		plan, err := planTranscription(audioPath, transcriber, opts)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(out, "Audio: %.1f min, %.1f MB to upload", plan.Duration/60, float64(plan.UploadSize)/(1024*1024))
+		if plan.Converted {
+			fmt.Fprint(out, " after converting to Opus")
+		}
+		fmt.Fprintf(out, ", %d chunk(s)\n", plan.Chunks)
+
+		transcriptTokens = int(plan.Duration / 60 * spokenTokensPerMinute)
+		fmt.Fprintf(out, "Transcript: ~%d tokens (estimated from duration)\n", transcriptTokens)
+		estimates = append(estimates, estimateTranscription(plan, transcriber, opts.Overlap))
+	} else {
+		fmt.Fprintf(out, "Transcript: %d characters\n", len(transcript))
+	}
+	fmt.Fprintln(out)
+
+	if autoSelect {
+		estimates = append(estimates, estimateSelection(transcript, transcriptTokens))
+	}
+	for _, action := range actions {
+		estimates = append(estimates, estimateAction(action, transcript, transcriptTokens))
+	}
+
+	printCostEstimates(estimates, out)
+	return nil
+}
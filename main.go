@@ -2,7 +2,9 @@ package main
 
 import (
 	"bytes"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -11,20 +13,52 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
+	"unicode"
 
 	"gopkg.in/yaml.v3"
 )
 
 type TranscriptionResponse struct {
-	Text string `json:"text"`
+	Text     string              `json:"text"`
+	Segments []TranscriptSegment `json:"segments"`
+}
+
+// TranscriptSegment is a timed span of speech, in seconds from the start of the audio
+type TranscriptSegment struct {
+	Start float64 `json:"start"`
+	End   float64 `json:"end"`
+	Text  string  `json:"text"`
+}
+
+// Transcript is the result of transcribing an audio file
+type Transcript struct {
+	Text     string              `json:"text"`
+	Segments []TranscriptSegment `json:"segments,omitempty"`
+}
+
+// TranscriptionOptions controls how audio is sent to the transcription API
+type TranscriptionOptions struct {
+	Timestamps  bool    // Request verbose_json with per-segment timings
+	SplitMode   string  // How large files are split: "silence" or "fixed"
+	Overlap     float64 // Seconds of audio shared by adjacent chunks
+	Glossary    []string
+	Prompt      string // Whisper prompt for this request (set per chunk)
+	Concurrency int    // Maximum number of chunks uploaded at once
+	NoCache     bool   // Skip the on-disk transcription cache
+	Transcode   bool   // Convert to mono 16 kHz Opus before uploading
+	AudioStream int    // Audio stream to extract from multi-track input (-1 for automatic)
 }
 
 type ChatCompletionRequest struct {
-	Model       string    `json:"model"`
-	Messages    []Message `json:"messages"`
-	Temperature float64   `json:"temperature,omitempty"`
-	MaxTokens   int       `json:"max_tokens,omitempty"`
+	Model          string          `json:"model"`
+	Messages       []Message       `json:"messages"`
+	Temperature    float64         `json:"temperature,omitempty"`
+	MaxTokens      int             `json:"max_tokens,omitempty"`
+	ResponseFormat *ResponseFormat `json:"response_format,omitempty"` // Structured output for actions with a schema
 }
 
 type Message struct {
@@ -36,22 +70,43 @@ type ChatCompletionResponse struct {
 	Choices []struct {
 		Message Message `json:"message"`
 	} `json:"choices"`
+	Usage struct {
+		PromptTokens     int `json:"prompt_tokens"`
+		CompletionTokens int `json:"completion_tokens"`
+	} `json:"usage"`
 }
 
 type PostAction struct {
-	ID          string  `yaml:"id"`
-	Name        string  `yaml:"name"`
-	Description string  `yaml:"description"`
-	Type        string  `yaml:"type"`
-	Prompt      string  `yaml:"prompt"`
-	Model       string  `yaml:"model"`
-	Temperature float64 `yaml:"temperature"`
-	MaxTokens   int     `yaml:"max_tokens"`
+	ID          string                 `yaml:"id"`
+	Name        string                 `yaml:"name"`
+	Description string                 `yaml:"description"`
+	Type        string                 `yaml:"type"`
+	Prompt      string                 `yaml:"prompt"`
+	Model       string                 `yaml:"model"`
+	Temperature float64                `yaml:"temperature"`
+	MaxTokens   int                    `yaml:"max_tokens"`
+	BaseURL     string                 `yaml:"base_url,omitempty"`    // Overrides the global base_url
+	APIKey      string                 `yaml:"api_key,omitempty"`     // Bearer key for the action's own base_url; may use ${ENV_VAR}
+	Headers     map[string]string      `yaml:"headers,omitempty"`     // Added to (and override) the global headers
+	Endpoint    string                 `yaml:"endpoint,omitempty"`    // azure-openai: resource endpoint (default: azure.endpoint)
+	Deployment  string                 `yaml:"deployment,omitempty"`  // azure-openai: deployment name (default: model, then azure.deployment)
+	APIVersion  string                 `yaml:"api_version,omitempty"` // azure-openai: api-version (default: azure.api_version)
+	Schema      map[string]interface{} `yaml:"schema,omitempty"`      // JSON Schema for structured output; the action writes a .json file
 }
 
 type Config struct {
-	OpenAIAPIKey string       `yaml:"openai_api_key"`
-	PostActions  []PostAction `yaml:"post_actions"`
+	OpenAIAPIKey    string                   `yaml:"openai_api_key"`
+	AnthropicAPIKey string                   `yaml:"anthropic_api_key,omitempty"` // Falls back to $ANTHROPIC_API_KEY
+	BaseURL         string                   `yaml:"base_url,omitempty"`          // OpenAI-compatible server, e.g. http://localhost:8080/v1
+	Headers         map[string]string        `yaml:"headers,omitempty"`           // Extra headers sent with every API request
+	Glossary        []string                 `yaml:"glossary,omitempty"`
+	Transcriber     TranscriberConfig        `yaml:"transcriber,omitempty"`
+	Azure           AzureConfig              `yaml:"azure,omitempty"`
+	Ollama          OllamaConfig             `yaml:"ollama,omitempty"`
+	HTTP            HTTPConfig               `yaml:"http,omitempty"`
+	Models          map[string]ModelOverride `yaml:"models,omitempty"` // Context windows, encodings and prices; extends the built-in table
+	Budget          BudgetConfig             `yaml:"budget,omitempty"`
+	PostActions     []PostAction             `yaml:"post_actions"`
 }
 
 type multiStringFlag []string
@@ -78,30 +133,69 @@ func (m *multiStringFlag) Set(value string) error {
 
 var postActions = []PostAction{}
 
+// activeConfig is the config file loaded at startup
+var activeConfig Config
+
 const maxFileSizeBytes = 25 * 1024 * 1024 // 25MB - OpenAI Whisper API limit
 
-// Approximate token limits for different models (leaving room for prompt and response)
+const maxChunkOverlapSeconds = 60 // Upper bound for -overlap, keeps chunks well under the size limit
+
+// chunkConcurrency limits how many transcript chunks (and hierarchical merge pairs) of
+// one action are sent at once; set with -chunk-concurrency
+var chunkConcurrency = defaultChunkConcurrency
+
+const defaultChunkConcurrency = 4
+
+// avgCharsPerToken estimates token counts when a tokenizer can't be loaded
 const avgCharsPerToken = 4 // Rough estimate: 1 token ≈ 4 characters
 
-// getModelContextLimit returns the safe context limit for a model (input tokens only)
-func getModelContextLimit(model string) int {
-	switch {
-	case model == "gpt-4":
-		return 6000 // 8K total, leaving 2K for completion
-	case model == "gpt-4-32k":
-		return 24000 // 32K total, leaving 8K for completion
-	case strings.HasPrefix(model, "gpt-4-turbo") || model == "gpt-4-1106-preview" || model == "gpt-4-0125-preview":
-		return 100000 // 128K total, leaving 28K for completion
-	case strings.HasPrefix(model, "gpt-4o"):
-		return 100000 // 128K total
-	case strings.HasPrefix(model, "gpt-3.5-turbo"):
-		return 12000 // 16K total, leaving 4K for completion
-	default:
-		return 6000 // Conservative default
+// minActionInputTokens is the least input room an action's max_tokens may leave in its
+// context window: enough for the prompt, the chunking buffer and some transcript
+const minActionInputTokens = 2000
+
+// getActionContextLimit returns the safe input token limit for an action: the model's
+// context window minus room for the response
+func getActionContextLimit(action *PostAction) int {
+	return actionContextWindow(&activeConfig, action) - action.MaxTokens
+}
+
+// actionContextWindow returns the context window an action runs with. Ollama runs every
+// model with the configured num_ctx, so the model name says nothing about its window.
+func actionContextWindow(config *Config, action *PostAction) int {
+	if action.Type == actionTypeOllama {
+		return ollamaContextWindow(config.Ollama)
+	}
+	if info, _ := lookupModel(config.Models, action.Model); info.ContextWindow > 0 {
+		return info.ContextWindow
+	}
+	return defaultModelContextWindow
+}
+
+// checkContextRoom makes sure an action's max_tokens leaves room in the context window
+// for its input; requests that ask for more than the window are rejected by the API
+func checkContextRoom(config *Config, action *PostAction) error {
+	window := actionContextWindow(config, action)
+	if window-action.MaxTokens < minActionInputTokens {
+		return fmt.Errorf("action '%s' sets max_tokens %d, leaving %d of %s's %d-token context window for input (need at least %d; lower max_tokens)",
+			action.ID, action.MaxTokens, window-action.MaxTokens, action.Model, window, minActionInputTokens)
 	}
+	return nil
 }
 
 func main() {
+	// Subcommands
+	if len(os.Args) > 1 && (os.Args[1] == "usage" || os.Args[1] == "cache") {
+		run := runUsageCommand
+		if os.Args[1] == "cache" {
+			run = runCacheCommand
+		}
+		if err := run(os.Args[2:], os.Stdout); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Preprocess arguments to allow multiple values after -transcript without repeating the flag
 	if len(os.Args) > 1 {
 		rawArgs := os.Args[1:]
@@ -152,8 +246,26 @@ func main() {
 	configFile := flag.String("config", "", "Path to YAML config file with custom post-actions (default: ~/.goscribe/config.yml)")
 	initConfig := flag.Bool("init", false, "Reset config file to defaults (overwrites ~/.goscribe/config.yml)")
 	setKey := flag.String("set-key", "", "Store OpenAI API key in config file")
+	setAnthropicKey := flag.String("set-anthropic-key", "", "Store Anthropic API key in config file (for anthropic actions)")
+	timestamps := flag.Bool("timestamps", false, "Request segment timestamps and write .srt/.vtt subtitle files")
+	splitMode := flag.String("split-mode", splitModeSilence, "How to split audio over 25MB: 'silence' (cut at pauses) or 'fixed' (fixed-length chunks)")
+	overlap := flag.Float64("overlap", 0, "Seconds of audio shared by adjacent chunks when splitting, e.g. 5 (repeated words are de-duplicated)")
 	var transcriptFiles multiStringFlag
 	flag.Var(&transcriptFiles, "transcript", "Process existing transcript file(s) (skips transcription)")
+	concurrency := flag.Int("concurrency", 1, "Number of audio chunks to transcribe in parallel when splitting large files")
+	audioStream := flag.Int("audio-stream", -1, "Audio stream to transcribe from video or multi-track files (0 = first; default: automatic)")
+	transcode := flag.Bool("transcode", false, "Convert audio to compact mono 16 kHz Opus before uploading (splits only if still over 25MB)")
+	transcriberBackend := flag.String("transcriber", "", "Transcription backend: openai, azure-openai, whisper-cpp or faster-whisper (default: config transcriber.backend, else openai)")
+	actionConcurrency := flag.Int("action-concurrency", defaultActionConcurrency, "Number of post-processing actions run in parallel")
+	chunkConcurrencyFlag := flag.Int("chunk-concurrency", defaultChunkConcurrency, "Number of transcript chunks processed in parallel when an action splits a long transcript")
+	provider := flag.String("provider", "", "Run actions with another provider for this run: openai, azure-openai, anthropic or ollama")
+	modelOverride := flag.String("model", "", "Run actions with this model for this run (e.g. llama3.1 with -provider ollama)")
+	noCache := flag.Bool("no-cache", false, "Don't read or write the on-disk cache (~/.goscribe/cache)")
+	dryRun := flag.Bool("dry-run", false, "Show the planned chunks, API calls and estimated cost without calling any API")
+	maxCost := flag.Float64("max-cost", 0, "Stop the run before it spends more than this many USD (overrides config budget.max_cost)")
+	maxTokensFlag := flag.Int("max-tokens", 0, "Stop the run before its chat calls use more than this many tokens (overrides config budget.max_tokens)")
+	var glossary multiStringFlag
+	flag.Var(&glossary, "glossary", "Comma-separated names and terms to keep spelled consistently (added to config glossary)")
 
 	// Custom usage message
 	flag.Usage = func() {
@@ -169,6 +281,14 @@ func main() {
 		fmt.Fprintf(os.Stderr, "  goscribe -k YOUR_API_KEY -action openai-meeting-summary meeting.mp3\n\n")
 		fmt.Fprintf(os.Stderr, "  # Transcribe technical meeting\n")
 		fmt.Fprintf(os.Stderr, "  goscribe -k YOUR_API_KEY -action openai-tech-meeting standup.mp3\n\n")
+		fmt.Fprintf(os.Stderr, "  # Transcribe and write SRT/WebVTT subtitles\n")
+		fmt.Fprintf(os.Stderr, "  goscribe -timestamps talk.mp3\n\n")
+		fmt.Fprintf(os.Stderr, "  # Transcribe locally with whisper.cpp (set transcriber.model_path in config)\n")
+		fmt.Fprintf(os.Stderr, "  goscribe -transcriber whisper-cpp confidential.mp3\n\n")
+		fmt.Fprintf(os.Stderr, "  # Keep everything offline: local transcription and a local Ollama model\n")
+		fmt.Fprintf(os.Stderr, "  goscribe -transcriber whisper-cpp -provider ollama -model llama3.1 -action openai-hr-meeting hr.mp3\n\n")
+		fmt.Fprintf(os.Stderr, "  # Transcribe a video recording, using its second audio track\n")
+		fmt.Fprintf(os.Stderr, "  goscribe -audio-stream 1 meeting.mkv\n\n")
 		fmt.Fprintf(os.Stderr, "  # Custom output file\n")
 		fmt.Fprintf(os.Stderr, "  goscribe -k YOUR_API_KEY -o transcript.txt audio.mp3\n\n")
 		fmt.Fprintf(os.Stderr, "  # List all available post-processing actions\n")
@@ -180,6 +300,14 @@ func main() {
 		fmt.Fprintf(os.Stderr, "  goscribe -action openai-meeting-summary,openai-action-items meeting.mp3\n\n")
 		fmt.Fprintf(os.Stderr, "  # Automatically select best actions\n")
 		fmt.Fprintf(os.Stderr, "  goscribe --auto meeting.mp3\n\n")
+		fmt.Fprintf(os.Stderr, "  # Estimate calls and cost before running\n")
+		fmt.Fprintf(os.Stderr, "  goscribe -dry-run -action openai-meeting-summary,openai-action-items long-meeting.mp3\n\n")
+		fmt.Fprintf(os.Stderr, "  # Stop before spending more than $2 on this run\n")
+		fmt.Fprintf(os.Stderr, "  goscribe -max-cost 2 --auto long-meeting.mp3\n\n")
+		fmt.Fprintf(os.Stderr, "  # Show spending by month from the usage ledger\n")
+		fmt.Fprintf(os.Stderr, "  goscribe usage -by month\n\n")
+		fmt.Fprintf(os.Stderr, "  # Remove cached transcriptions and responses unused for 30 days\n")
+		fmt.Fprintf(os.Stderr, "  goscribe cache prune -older-than 30d\n\n")
 		fmt.Fprintf(os.Stderr, "  # Store API key in config file\n")
 		fmt.Fprintf(os.Stderr, "  goscribe -set-key YOUR_API_KEY\n\n")
 		fmt.Fprintf(os.Stderr, "  # Reset config to defaults\n")
@@ -188,10 +316,13 @@ func main() {
 		fmt.Fprintf(os.Stderr, "  goscribe -config my-actions.yml -action custom-action audio.mp3\n\n")
 		fmt.Fprintf(os.Stderr, "OUTPUT FILES:\n")
 		fmt.Fprintf(os.Stderr, "  <filename>-transcript.txt              Raw transcription\n")
-		fmt.Fprintf(os.Stderr, "  <filename>-<action-id>.txt             Post-processed output (if -action used)\n\n")
+		fmt.Fprintf(os.Stderr, "  <filename>-transcript.srt/.vtt         Subtitles (if -timestamps used)\n")
+		fmt.Fprintf(os.Stderr, "  <filename>-<action-id>.txt             Post-processed output (if -action used)\n")
+		fmt.Fprintf(os.Stderr, "  <filename>-<action-id>.json            Structured output (actions with a schema)\n\n")
 		fmt.Fprintf(os.Stderr, "CONFIGURATION:\n")
 		fmt.Fprintf(os.Stderr, "  Config file: ~/.goscribe/config.yml\n")
 		fmt.Fprintf(os.Stderr, "  - Store your OpenAI API key (openai_api_key field)\n")
+		fmt.Fprintf(os.Stderr, "  - Store your Anthropic API key for anthropic actions (anthropic_api_key field)\n")
 		fmt.Fprintf(os.Stderr, "  - Customize or add your own post-processing actions\n\n")
 		fmt.Fprintf(os.Stderr, "POPULAR ACTIONS:\n")
 		fmt.Fprintf(os.Stderr, "  openai-meeting-summary      Comprehensive meeting summary\n")
@@ -204,6 +335,43 @@ func main() {
 
 	flag.Parse()
 
+	if *splitMode != splitModeSilence && *splitMode != splitModeFixed {
+		fmt.Printf("Error: invalid -split-mode '%s' (valid: %s, %s)\n", *splitMode, splitModeSilence, splitModeFixed)
+		os.Exit(1)
+	}
+
+	if *concurrency < 1 {
+		fmt.Printf("Error: invalid -concurrency %d (must be at least 1)\n", *concurrency)
+		os.Exit(1)
+	}
+
+	if *overlap < 0 || *overlap > maxChunkOverlapSeconds {
+		fmt.Printf("Error: invalid -overlap %.1f (must be between 0 and %d seconds)\n", *overlap, maxChunkOverlapSeconds)
+		os.Exit(1)
+	}
+
+	if *actionConcurrency < 1 {
+		fmt.Printf("Error: invalid -action-concurrency %d (must be at least 1)\n", *actionConcurrency)
+		os.Exit(1)
+	}
+
+	if *chunkConcurrencyFlag < 1 {
+		fmt.Printf("Error: invalid -chunk-concurrency %d (must be at least 1)\n", *chunkConcurrencyFlag)
+		os.Exit(1)
+	}
+	chunkConcurrency = *chunkConcurrencyFlag
+	noResponseCache = *noCache
+
+	if *audioStream < -1 {
+		fmt.Printf("Error: invalid -audio-stream %d (must be 0 or greater)\n", *audioStream)
+		os.Exit(1)
+	}
+
+	if *maxCost < 0 || *maxTokensFlag < 0 {
+		fmt.Println("Error: -max-cost and -max-tokens must not be negative")
+		os.Exit(1)
+	}
+
 	// Store API key if requested
 	if *setKey != "" {
 		err := storeAPIKey(*setKey)
@@ -213,6 +381,14 @@ func main() {
 		}
 		return
 	}
+	if *setAnthropicKey != "" {
+		err := storeAnthropicAPIKey(*setAnthropicKey)
+		if err != nil {
+			fmt.Printf("Error storing API key: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
 
 	// Reset config if requested
 	if *initConfig {
@@ -258,6 +434,14 @@ func main() {
 		fmt.Println("Using API key from config file")
 	}
 
+	// Point actions at another provider/model for this run if requested
+	if *provider != "" || *modelOverride != "" {
+		if err := applyProviderOverride(postActions, *provider, *modelOverride); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
 	// List actions and exit if requested
 	if *listActions {
 		fmt.Println("Available post-processing actions:")
@@ -272,9 +456,58 @@ func main() {
 		return
 	}
 
+	// Show what the run would do and cost, without calling any API
+	if *dryRun {
+		var actions []*PostAction
+		if *postAction != "" {
+			if actions, err = resolveActions(strings.Split(*postAction, ",")); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+		}
+
+		var transcript, dryRunAudio string
+		var transcriber Transcriber
+		if len(transcriptFiles) > 0 {
+			if transcript, err = loadTranscripts(transcriptFiles); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+		} else {
+			if flag.NArg() < 1 {
+				fmt.Println("Error: Audio file path is required")
+				os.Exit(1)
+			}
+			dryRunAudio = flag.Arg(0)
+			if transcriber, err = selectTranscriber(*transcriberBackend, *apiKey); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+		}
+
+		opts := TranscriptionOptions{Overlap: *overlap, Transcode: *transcode, AudioStream: *audioStream}
+		if err := runDryRun(dryRunAudio, transcript, transcriber, opts, actions, *autoSelect, os.Stdout); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Enforce the spending caps from config and flags for every request of this run
+	runProfile = profileName(configPath)
+	runBudget, err = newSpendingBudget(activeConfig.Budget, *maxCost, *maxTokensFlag, runProfile, time.Now())
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	if runBudget != nil {
+		fmt.Printf("Budget: %s for this run\n", runBudget.describe())
+	}
+
 	var transcription string
 	var audioPath string
 	var transcriptFilename string
+	var subtitleFiles []string
 
 	// Handle transcript file mode
 	if len(transcriptFiles) > 0 {
@@ -284,37 +517,14 @@ func main() {
 			os.Exit(1)
 		}
 
-		var combined strings.Builder
-		for idx, file := range transcriptFiles {
-			// Check if transcript file exists
-			if _, err := os.Stat(file); os.IsNotExist(err) {
-				fmt.Printf("Error: Transcript file '%s' not found.\n", file)
-				os.Exit(1)
-			}
-
-			// Read the transcript file
-			data, err := os.ReadFile(file)
-			if err != nil {
-				fmt.Printf("Error reading transcript file '%s': %v\n", file, err)
-				os.Exit(1)
-			}
-
-			content := string(data)
-			if len(transcriptFiles) == 1 {
-				transcription = content
-			} else {
-				fmt.Fprintf(&combined, "Transcript %d (%s):\n\n%s", idx+1, file, content)
-				if idx < len(transcriptFiles)-1 {
-					combined.WriteString("\n\n" + strings.Repeat("-", 70) + "\n\n")
-				}
-			}
-
-			fmt.Printf("Loaded transcript from %s\n", file)
+		transcription, err = loadTranscripts(transcriptFiles)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
 		}
 
-		if len(transcriptFiles) > 1 {
-			transcription = combined.String()
-		}
+		// Record the actions' usage even if the run is interrupted
+		handleInterrupt(runInputs("", transcriptFiles))
 	} else {
 		// Standard audio transcription mode
 		// Get the audio file path from remaining arguments
@@ -345,22 +555,67 @@ func main() {
 			transcriptFilename = outputFilename
 		}
 
+		// Extracted audio and chunks live in temp directories; don't leave them behind on
+		// Ctrl-C, and record the usage billed so far
+		handleInterrupt(runInputs(audioPath, nil))
+
 		// Transcribe the audio file (with automatic splitting if needed)
 		fmt.Println("Transcribing audio...")
-		var err error
-		transcription, err = transcribeAudioWithSplitting(audioPath, *apiKey)
+		opts := TranscriptionOptions{
+			Timestamps:  *timestamps,
+			SplitMode:   *splitMode,
+			Overlap:     *overlap,
+			Glossary:    append(append([]string{}, activeConfig.Glossary...), glossary...),
+			Concurrency: *concurrency,
+			NoCache:     *noCache,
+			Transcode:   *transcode,
+			AudioStream: *audioStream,
+		}
+		transcriber, err := selectTranscriber(*transcriberBackend, *apiKey)
 		if err != nil {
 			fmt.Printf("Error: %v\n", err)
 			os.Exit(1)
 		}
 
+		transcript, err := transcribeAudioWithSplitting(audioPath, transcriber, opts)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			if transcript != nil {
+				// Stopped by the budget: keep the part that was transcribed
+				partial := partialFilename(transcriptFilename)
+				if err := os.WriteFile(partial, []byte(transcript.Text), 0644); err != nil {
+					fmt.Printf("Error writing partial transcript: %v\n", err)
+				} else {
+					fmt.Printf("Partial transcript saved to %s\n", partial)
+				}
+			}
+			exitWithUsage(runInputs(audioPath, nil)) // Chunks uploaded before the failure were billed
+		}
+		transcription = transcript.Text
+
 		// Always save the raw transcript
 		err = os.WriteFile(transcriptFilename, []byte(transcription), 0644)
 		if err != nil {
 			fmt.Printf("Error writing transcript file: %v\n", err)
-			os.Exit(1)
+			exitWithUsage(runInputs(audioPath, nil))
 		}
 		fmt.Printf("Raw transcript saved to %s\n", transcriptFilename)
+
+		// Write subtitle files alongside the transcript if timestamps were requested
+		if *timestamps {
+			if len(transcript.Segments) == 0 {
+				fmt.Println("⚠ Warning: No timed segments returned, skipping subtitle files")
+			} else {
+				subtitleFiles, err = writeSubtitleFiles(transcriptFilename, transcript.Segments)
+				if err != nil {
+					fmt.Printf("Error writing subtitle files: %v\n", err)
+					exitWithUsage(runInputs(audioPath, nil))
+				}
+				for _, sf := range subtitleFiles {
+					fmt.Printf("Subtitles saved to %s\n", sf)
+				}
+			}
+		}
 	}
 
 	// Apply post-processing action(s) if specified
@@ -383,63 +638,56 @@ func main() {
 		actionIDs = strings.Split(*postAction, ",")
 	}
 
-	// Trim whitespace from action IDs
-	for i, id := range actionIDs {
-		actionIDs[i] = strings.TrimSpace(id)
-	}
-
 	// Process selected actions
+	var actionResults []actionResult
 	if len(actionIDs) > 0 {
-		fmt.Printf("\nProcessing %d action(s)...\n", len(actionIDs))
+		actions, err := resolveActions(actionIDs)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			exitWithUsage(runInputs(audioPath, transcriptFiles))
+		}
 
-		for idx, actionID := range actionIDs {
-			if actionID == "" {
-				continue
+		// Generate filename for post-processed output
+		outputFile := func(action *PostAction) string {
+			// Structured output actions write JSON
+			outExt := ".txt"
+			if action.Schema != nil {
+				outExt = ".json"
 			}
 
-			action := findAction(actionID)
-			if action == nil {
-				fmt.Printf("Error: Unknown action '%s'. Use -list-actions to see available options.\n", actionID)
-				os.Exit(1)
+			if len(transcriptFiles) > 0 {
+				// For transcript mode, use the transcript filename(s) as base
+				first := transcriptFiles[0]
+				ext := filepath.Ext(first)
+				baseName := strings.TrimSuffix(first, ext)
+				if len(transcriptFiles) == 1 {
+					return fmt.Sprintf("%s-%s%s", baseName, action.ID, outExt)
+				}
+				return fmt.Sprintf("%s+%d-%s%s", baseName, len(transcriptFiles)-1, action.ID, outExt)
 			}
+			// For audio mode, use the audio filename as base
+			ext := filepath.Ext(audioPath)
+			baseName := strings.TrimSuffix(audioPath, ext)
+			return fmt.Sprintf("%s-%s%s", baseName, action.ID, outExt)
+		}
 
-			fmt.Printf("\n[%d/%d] Applying post-processing: %s...\n", idx+1, len(actionIDs), action.Name)
-			processed, err := processWithOpenAIChunked(transcription, action, *apiKey)
-			if err != nil {
-				fmt.Printf("⚠ Warning: Post-processing failed: %v\n", err)
-				if len(transcriptFiles) == 0 && len(actionIDs) == 1 {
-					fmt.Println("Only raw transcript was saved.")
-				}
-			} else {
-				// Generate filename for post-processed output
-				var processedFilename string
-				if len(transcriptFiles) > 0 {
-					// For transcript mode, use the transcript filename(s) as base
-					first := transcriptFiles[0]
-					ext := filepath.Ext(first)
-					baseName := strings.TrimSuffix(first, ext)
-					if len(transcriptFiles) == 1 {
-						processedFilename = fmt.Sprintf("%s-%s.txt", baseName, action.ID)
-					} else {
-						processedFilename = fmt.Sprintf("%s+%d-%s.txt", baseName, len(transcriptFiles)-1, action.ID)
-					}
-				} else {
-					// For audio mode, use the audio filename as base
-					ext := filepath.Ext(audioPath)
-					baseName := strings.TrimSuffix(audioPath, ext)
-					processedFilename = fmt.Sprintf("%s-%s.txt", baseName, action.ID)
-				}
+		limit := min(*actionConcurrency, len(actions))
+		if limit > 1 {
+			fmt.Printf("\nProcessing %d action(s), up to %d in parallel...\n", len(actions), limit)
+		} else {
+			fmt.Printf("\nProcessing %d action(s)...\n", len(actions))
+		}
 
-				err = os.WriteFile(processedFilename, []byte(processed), 0644)
-				if err != nil {
-					fmt.Printf("⚠ Error writing processed file: %v\n", err)
-				} else {
-					fmt.Printf("✓ Post-processed output saved to %s\n", processedFilename)
-					processedFiles = append(processedFiles, processedFilename)
-				}
+		actionResults = runActions(actions, transcription, *apiKey, limit, outputFile, os.Stdout)
+
+		for _, result := range actionResults {
+			if result.File != "" {
+				processedFiles = append(processedFiles, result.File)
 			}
 		}
-
+		if len(processedFiles) == 0 && len(transcriptFiles) == 0 && len(actions) == 1 {
+			fmt.Println("Only raw transcript was saved.")
+		}
 		if len(processedFiles) > 0 {
 			fmt.Printf("\n✓ Post-processing completed! Generated %d file(s)\n", len(processedFiles))
 		}
@@ -460,17 +708,44 @@ func main() {
 	} else {
 		fmt.Printf("  Audio file: %s\n", audioPath)
 		fmt.Printf("  Transcript: %s\n", transcriptFilename)
+		for _, sf := range subtitleFiles {
+			fmt.Printf("  Subtitles:  %s\n", sf)
+		}
 	}
-	if len(processedFiles) > 0 {
-		fmt.Printf("  Processed files (%d):\n", len(processedFiles))
-		for _, pf := range processedFiles {
-			fmt.Printf("    - %s\n", pf)
+	if len(actionResults) > 0 {
+		fmt.Printf("  Actions (%d):\n", len(actionResults))
+		for _, result := range actionResults {
+			stats := fmt.Sprintf("%.1fs", result.Duration.Seconds())
+			if usage, ok := runUsage.step(result.Action.ID); ok {
+				stats += ", " + formatUsage(usage)
+			}
+			if result.Err != nil && result.File != "" {
+				fmt.Printf("    ✗ %s (%s): %v → %s\n", result.Action.ID, stats, result.Err, result.File)
+			} else if result.Err != nil {
+				fmt.Printf("    ✗ %s (%s): %v\n", result.Action.ID, stats, result.Err)
+			} else {
+				fmt.Printf("    ✓ %s (%s) → %s\n", result.Action.ID, stats, result.File)
+			}
 		}
 	}
+	printRunUsage()
+	if budgetReached() {
+		fmt.Printf("  ⚠ Budget:    stopped at the spending cap (%s); partial outputs end in .partial\n", runBudget.describe())
+	}
 	if *apiKey != "XXXX" {
 		fmt.Printf("  API key:    %s\n", *apiKey)
 	}
 	fmt.Println(strings.Repeat("=", 70))
+
+	logRunUsage(runInputs(audioPath, transcriptFiles))
+}
+
+// runInputs names what a run processed, for the usage ledger
+func runInputs(audioPath string, transcriptFiles []string) []string {
+	if audioPath != "" {
+		return []string{audioPath}
+	}
+	return transcriptFiles
 }
 
 func findAction(id string) *PostAction {
@@ -482,6 +757,70 @@ func findAction(id string) *PostAction {
 	return nil
 }
 
+// resolveActions looks up action IDs, skipping empty ones
+func resolveActions(ids []string) ([]*PostAction, error) {
+	var actions []*PostAction
+	for _, id := range ids {
+		id = strings.TrimSpace(id)
+		if id == "" {
+			continue
+		}
+
+		action := findAction(id)
+		if action == nil {
+			return nil, fmt.Errorf("unknown action '%s'. Use -list-actions to see available options", id)
+		}
+		actions = append(actions, action)
+	}
+	return actions, nil
+}
+
+// loadTranscripts reads existing transcript files. Several files are combined into
+// one transcript, each under a heading naming it.
+func loadTranscripts(files []string) (string, error) {
+	if len(files) == 1 {
+		data, err := os.ReadFile(files[0])
+		if err != nil {
+			return "", fmt.Errorf("failed to read transcript file '%s': %w", files[0], err)
+		}
+		fmt.Printf("Loaded transcript from %s\n", files[0])
+		return string(data), nil
+	}
+
+	var combined strings.Builder
+	for idx, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("failed to read transcript file '%s': %w", file, err)
+		}
+
+		fmt.Fprintf(&combined, "Transcript %d (%s):\n\n%s", idx+1, file, string(data))
+		if idx < len(files)-1 {
+			combined.WriteString("\n\n" + strings.Repeat("-", 70) + "\n\n")
+		}
+
+		fmt.Printf("Loaded transcript from %s\n", file)
+	}
+	return combined.String(), nil
+}
+
+// selectTranscriber builds the transcription backend from the config, or the -transcriber
+// flag when given
+func selectTranscriber(backend, apiKey string) (Transcriber, error) {
+	transcriberConfig := activeConfig.Transcriber
+	if backend != "" {
+		transcriberConfig.Backend = backend
+	}
+	transcriber, err := newTranscriber(transcriberConfig, apiKey)
+	if err != nil {
+		return nil, err
+	}
+	if transcriberConfig.Backend != "" && transcriberConfig.Backend != transcriberOpenAI {
+		fmt.Printf("Using %s transcription\n", transcriber.Name())
+	}
+	return transcriber, nil
+}
+
 func loadConfigActions(configPath string) (string, error) {
 	data, err := os.ReadFile(configPath)
 	if err != nil {
@@ -500,6 +839,8 @@ func loadConfigActions(configPath string) (string, error) {
 	}
 
 	// Load actions from config file
+	activeConfig = config
+	apiClient = newRetryingClient(config.HTTP)
 	postActions = config.PostActions
 	fmt.Printf("Loaded %d action(s) from config file\n", len(config.PostActions))
 
@@ -510,6 +851,12 @@ func validateConfig(config *Config) error {
 	if len(config.PostActions) == 0 {
 		return fmt.Errorf("no post-processing actions defined in config")
 	}
+	if err := validateModels(config.Models); err != nil {
+		return err
+	}
+	if config.Budget.MaxCost < 0 || config.Budget.MaxTokens < 0 || config.Budget.MonthlyMaxCost < 0 {
+		return fmt.Errorf("budget caps must not be negative")
+	}
 
 	// Track unique IDs
 	seenIDs := make(map[string]bool)
@@ -528,7 +875,7 @@ func validateConfig(config *Config) error {
 		if action.Prompt == "" {
 			return fmt.Errorf("action '%s' is missing 'prompt' field", action.ID)
 		}
-		if action.Model == "" {
+		if action.Model == "" && !(action.Type == actionTypeOllama && config.Ollama.Model != "") {
 			return fmt.Errorf("action '%s' is missing 'model' field", action.ID)
 		}
 
@@ -539,33 +886,52 @@ func validateConfig(config *Config) error {
 		seenIDs[action.ID] = true
 
 		// Validate type
-		validTypes := map[string]bool{
-			"openai": true,
+		validTypes := map[string]bool{}
+		for _, actionType := range validActionTypes {
+			validTypes[actionType] = true
 		}
 		if !validTypes[action.Type] {
-			return fmt.Errorf("action '%s' has invalid type '%s' (valid: openai)", action.ID, action.Type)
+			return fmt.Errorf("action '%s' has invalid type '%s' (valid: %s)", action.ID, action.Type, strings.Join(validActionTypes, ", "))
+		}
+
+		// Azure needs a resource endpoint, from the action or the azure section
+		if action.Type == actionTypeAzureOpenAI && action.Endpoint == "" && config.Azure.Endpoint == "" {
+			return fmt.Errorf("action '%s' has type %s but no endpoint (set endpoint or azure.endpoint)", action.ID, actionTypeAzureOpenAI)
 		}
 
 		// Validate temperature range
 		if action.Temperature < 0 || action.Temperature > 2 {
 			return fmt.Errorf("action '%s' has invalid temperature %.2f (must be between 0 and 2)", action.ID, action.Temperature)
 		}
+		if action.Type == actionTypeAnthropic && action.Temperature > 1 {
+			return fmt.Errorf("action '%s' has invalid temperature %.2f (anthropic models accept 0 to 1)", action.ID, action.Temperature)
+		}
 
 		// Validate max_tokens
 		if action.MaxTokens <= 0 {
 			return fmt.Errorf("action '%s' has invalid max_tokens %d (must be > 0)", action.ID, action.MaxTokens)
 		}
+		if err := checkContextRoom(config, &action); err != nil {
+			return err
+		}
 
-		// Validate model names (basic check for OpenAI models)
-		validModels := map[string]bool{
-			"gpt-3.5-turbo": true,
-			"gpt-4":         true,
-			"gpt-4-turbo":   true,
-			"gpt-4o":        true,
-			"gpt-4o-mini":   true,
+		// Structured output actions need a schema goscribe can request and validate
+		if action.Schema != nil {
+			schema, err := normalizeSchema(action.Schema)
+			if err != nil {
+				return fmt.Errorf("action '%s': %w", action.ID, err)
+			}
+			config.PostActions[i].Schema = schema
 		}
-		if action.Type == "openai" && !validModels[action.Model] {
-			fmt.Printf("Warning: action '%s' uses model '%s' which may not be valid\n", action.ID, action.Model)
+
+		// Check the model against the registry
+		if action.Type == actionTypeOpenAI || action.Type == actionTypeAnthropic {
+			info, known := lookupModel(config.Models, action.Model)
+			if !known {
+				fmt.Printf("Warning: action '%s' uses model '%s' which is not in the model registry (add it under models: in config)\n", action.ID, action.Model)
+			} else if info.MaxOutput > 0 && action.MaxTokens > info.MaxOutput {
+				fmt.Printf("Warning: action '%s' sets max_tokens %d but %s returns at most %d\n", action.ID, action.MaxTokens, action.Model, info.MaxOutput)
+			}
 		}
 	}
 
@@ -639,9 +1005,40 @@ func resetConfig() error {
 }
 
 func storeAPIKey(apiKey string) error {
+	configFile, err := updateConfigFile(func(config *Config) {
+		config.OpenAIAPIKey = apiKey
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("✓ API key stored successfully in: %s\n", configFile)
+	fmt.Println("\nYou can now use goscribe without the -k flag:")
+	fmt.Println("  goscribe audio.mp3")
+	fmt.Println("  goscribe -action openai-meeting-summary meeting.mp3")
+
+	return nil
+}
+
+// storeAnthropicAPIKey saves the key used by anthropic actions
+func storeAnthropicAPIKey(apiKey string) error {
+	configFile, err := updateConfigFile(func(config *Config) {
+		config.AnthropicAPIKey = apiKey
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("✓ Anthropic API key stored successfully in: %s\n", configFile)
+	return nil
+}
+
+// updateConfigFile applies update to the default config file, creating it first if
+// needed, and returns the file's path
+func updateConfigFile(update func(config *Config)) (string, error) {
 	homeDir, err := os.UserHomeDir()
 	if err != nil {
-		return fmt.Errorf("failed to get home directory: %w", err)
+		return "", fmt.Errorf("failed to get home directory: %w", err)
 	}
 
 	configDir := filepath.Join(homeDir, ".goscribe")
@@ -651,125 +1048,156 @@ func storeAPIKey(apiKey string) error {
 	if _, err := os.Stat(configFile); os.IsNotExist(err) {
 		fmt.Println("Config file not found. Creating default config...")
 		if err := createDefaultConfig(); err != nil {
-			return fmt.Errorf("failed to create default config: %w", err)
+			return "", fmt.Errorf("failed to create default config: %w", err)
 		}
 	}
 
 	// Read existing config
 	data, err := os.ReadFile(configFile)
 	if err != nil {
-		return fmt.Errorf("failed to read config file: %w", err)
+		return "", fmt.Errorf("failed to read config file: %w", err)
 	}
 
 	var config Config
 	err = yaml.Unmarshal(data, &config)
 	if err != nil {
-		return fmt.Errorf("failed to parse config file: %w", err)
+		return "", fmt.Errorf("failed to parse config file: %w", err)
 	}
 
-	// Update API key
-	config.OpenAIAPIKey = apiKey
+	update(&config)
 
 	// Marshal back to YAML
 	updatedData, err := yaml.Marshal(&config)
 	if err != nil {
-		return fmt.Errorf("failed to marshal config: %w", err)
+		return "", fmt.Errorf("failed to marshal config: %w", err)
 	}
 
 	// Write updated config
 	err = os.WriteFile(configFile, updatedData, 0644)
 	if err != nil {
-		return fmt.Errorf("failed to write config file: %w", err)
+		return "", fmt.Errorf("failed to write config file: %w", err)
 	}
 
-	fmt.Printf("✓ API key stored successfully in: %s\n", configFile)
-	fmt.Println("\nYou can now use goscribe without the -k flag:")
-	fmt.Println("  goscribe audio.mp3")
-	fmt.Println("  goscribe -action openai-meeting-summary meeting.mp3")
-
-	return nil
+	return configFile, nil
 }
 
-func processWithOpenAI(transcript string, action *PostAction, apiKey string) (string, error) {
+// buildActionPrompt returns the message sent to apply an action to a transcript
+func buildActionPrompt(action *PostAction, transcript string) string {
 	basePrompt := "You are a helpful assistant that processes transcribed text according to user instructions.\n\nTranscript:\n%s\n\nPlease process this transcript according to the instructions above."
 
-	fullPrompt := action.Prompt + "\n\n" + fmt.Sprintf(basePrompt, transcript)
+	return action.Prompt + "\n\n" + fmt.Sprintf(basePrompt, transcript)
+}
+
+func processWithOpenAI(transcript string, action *PostAction, apiKey string, out io.Writer) (string, error) {
+	if action.Schema != nil {
+		return processStructured(transcript, action, apiKey, out)
+	}
 
 	reqBody := ChatCompletionRequest{
 		Model: action.Model,
 		Messages: []Message{
 			{
 				Role:    "user",
-				Content: fullPrompt,
+				Content: buildActionPrompt(action, transcript),
 			},
 		},
 		Temperature: action.Temperature,
 		MaxTokens:   action.MaxTokens,
 	}
 
-	jsonData, err := json.Marshal(reqBody)
-	if err != nil {
-		return "", fmt.Errorf("failed to marshal request: %w", err)
-	}
+	return sendActionChatCached(action, apiKey, reqBody, out)
+}
 
-	req, err := http.NewRequest("POST", "https://api.openai.com/v1/chat/completions", bytes.NewBuffer(jsonData))
-	if err != nil {
-		return "", fmt.Errorf("failed to create request: %w", err)
-	}
+// processWithOpenAIChunked applies an action, splitting transcripts that exceed the
+// model's context. Progress is written to out, which must accept concurrent writes.
+// When a spending cap stops a chunked run, the chunk results so far are returned
+// along with the error.
+func processWithOpenAIChunked(transcript string, action *PostAction, apiKey string, out io.Writer) (string, error) {
+	// Get model-specific context limit
+	maxTokens := getActionContextLimit(action)
 
-	req.Header.Set("Authorization", "Bearer "+apiKey)
-	req.Header.Set("Content-Type", "application/json")
+	// Count transcript + prompt tokens with the model's tokenizer
+	promptTokens := countTokens(action.Prompt, action.Model)
+	transcriptTokens := countTokens(transcript, action.Model)
+	estimatedTokens := promptTokens + transcriptTokens
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", fmt.Errorf("failed to send request: %w", err)
+	// If transcript fits in context, process normally
+	if estimatedTokens <= maxTokens {
+		return processWithOpenAI(transcript, action, apiKey, out)
 	}
-	defer resp.Body.Close()
 
-	respBody, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", fmt.Errorf("failed to read response: %w", err)
-	}
+	// Transcript is too long, need to chunk
+	fmt.Fprintf(out, "  ⚠ Transcript is large (~%d tokens), processing in chunks...\n", estimatedTokens)
+
+	// Calculate chunk size (leaving room for prompt and overlap)
+	maxTranscriptTokensPerChunk := maxTokens - promptTokens - 500 // 500 token buffer
+	chunks := splitTranscriptIntoChunks(transcript, action.Model, maxTranscriptTokensPerChunk)
+
+	fmt.Fprintf(out, "  → Split into %d chunk(s) for processing\n", len(chunks))
 
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("API request failed with status %d: %s", resp.StatusCode, string(respBody))
+	// Process chunks in parallel; results keep chunk order for the merge. No more
+	// chunks are sent once one fails, since the action fails with it.
+	if chunkConcurrency > 1 && len(chunks) > 1 {
+		fmt.Fprintf(out, "  → Processing up to %d chunks in parallel\n", min(chunkConcurrency, len(chunks)))
 	}
+	results := make([]string, len(chunks))
+	errs := runUntilError(len(chunks), chunkConcurrency, func(i int) error {
+		fmt.Fprintf(out, "  → Processing chunk %d/%d...\n", i+1, len(chunks))
 
-	var chatResp ChatCompletionResponse
-	err = json.Unmarshal(respBody, &chatResp)
-	if err != nil {
-		return "", fmt.Errorf("failed to parse response: %w", err)
+		result, err := processWithOpenAI(chunks[i], action, apiKey, out)
+		if err != nil {
+			return fmt.Errorf("failed to process chunk %d: %w", i+1, err)
+		}
+		results[i] = result
+		return nil
+	})
+	if err := errors.Join(errs...); err != nil {
+		// A spending cap stops the action; the chunks already paid for are kept
+		if errors.Is(err, errBudgetExceeded) {
+			return joinChunkResults(results, action), err
+		}
+		return "", err
 	}
 
-	if len(chatResp.Choices) == 0 {
-		return "", fmt.Errorf("no response from API")
+	// Structured results are merged locally: arrays are combined, not rewritten by a model
+	if action.Schema != nil {
+		fmt.Fprintf(out, "  ✓ All chunks processed, merging structured results\n")
+		return mergeStructuredResults(results, action, out)
 	}
 
-	return chatResp.Choices[0].Message.Content, nil
+	// Intelligently merge chunk results using AI
+	fmt.Fprintf(out, "  ✓ All chunks processed, merging results intelligently\n")
+	merged, err := mergeChunkResults(results, action, apiKey, out)
+	if errors.Is(err, errBudgetExceeded) {
+		return joinChunkResults(results, action), err
+	}
+	if err != nil {
+		fmt.Fprintf(out, "  ⚠ Merge failed, falling back to simple concatenation: %v\n", err)
+		return joinChunkResults(results, action), nil
+	}
+	return merged, nil
 }
 
-func processWithOpenAIChunked(transcript string, action *PostAction, apiKey string) (string, error) {
-	// Get model-specific context limit
-	maxTokens := getModelContextLimit(action.Model)
-
-	// Estimate transcript + prompt tokens
-	promptTokens := len(action.Prompt) / avgCharsPerToken
-	transcriptTokens := len(transcript) / avgCharsPerToken
-	estimatedTokens := promptTokens + transcriptTokens
-
-	// If transcript fits in context, process normally
-	if estimatedTokens <= maxTokens {
-		return processWithOpenAI(transcript, action, apiKey)
+// joinChunkResults concatenates the chunk results that exist, when they can't be merged
+// by a model; structured results are still merged into one JSON object
+func joinChunkResults(results []string, action *PostAction) string {
+	var done []string
+	for _, result := range results {
+		if result != "" {
+			done = append(done, result)
+		}
 	}
+	if action.Schema != nil && len(done) > 0 {
+		if merged, err := mergeStructuredResults(done, action, io.Discard); err == nil {
+			return merged
+		}
+	}
+	return strings.Join(done, "\n\n---\n\n")
+}
 
-	// Transcript is too long, need to chunk
-	fmt.Printf("  ⚠ Transcript is large (~%d tokens), processing in chunks...\n", estimatedTokens)
-
-	// Calculate chunk size (leaving room for prompt and overlap)
-	maxTranscriptTokensPerChunk := maxTokens - promptTokens - 500 // 500 token buffer
-	maxCharsPerChunk := maxTranscriptTokensPerChunk * avgCharsPerToken
-
+// splitTranscriptIntoChunks splits a transcript on sentence boundaries into chunks of at
+// most maxChunkTokens, each starting with the last few sentences of the previous one
+func splitTranscriptIntoChunks(transcript, model string, maxChunkTokens int) []string {
 	// Split transcript into sentences for better chunking
 	sentences := splitIntoSentences(transcript)
 
@@ -778,10 +1206,10 @@ func processWithOpenAIChunked(transcript string, action *PostAction, apiKey stri
 	currentSize := 0
 
 	for i, sentence := range sentences {
-		sentenceLen := len(sentence)
+		sentenceTokens := countTokens(sentence+" ", model)
 
 		// If adding this sentence exceeds chunk size, start new chunk
-		if currentSize > 0 && currentSize+sentenceLen > maxCharsPerChunk {
+		if currentSize > 0 && currentSize+sentenceTokens > maxChunkTokens {
 			chunks = append(chunks, currentChunk.String())
 			currentChunk.Reset()
 
@@ -791,12 +1219,12 @@ func processWithOpenAIChunked(transcript string, action *PostAction, apiKey stri
 				currentChunk.WriteString(sentences[j])
 				currentChunk.WriteString(" ")
 			}
-			currentSize = currentChunk.Len()
+			currentSize = countTokens(currentChunk.String(), model)
 		}
 
 		currentChunk.WriteString(sentence)
 		currentChunk.WriteString(" ")
-		currentSize += sentenceLen + 1
+		currentSize += sentenceTokens
 	}
 
 	// Add final chunk
@@ -804,65 +1232,30 @@ func processWithOpenAIChunked(transcript string, action *PostAction, apiKey stri
 		chunks = append(chunks, currentChunk.String())
 	}
 
-	fmt.Printf("  → Split into %d chunk(s) for processing\n", len(chunks))
-
-	// Process each chunk
-	var results []string
-	for i, chunk := range chunks {
-		fmt.Printf("  → Processing chunk %d/%d...\n", i+1, len(chunks))
-
-		result, err := processWithOpenAI(chunk, action, apiKey)
-		if err != nil {
-			return "", fmt.Errorf("failed to process chunk %d: %w", i+1, err)
-		}
-		results = append(results, result)
-	}
-
-	// Intelligently merge chunk results using AI
-	fmt.Printf("  ✓ All chunks processed, merging results intelligently\n")
-	merged, err := mergeChunkResults(results, action, apiKey)
-	if err != nil {
-		fmt.Printf("  ⚠ Merge failed, falling back to simple concatenation: %v\n", err)
-		return strings.Join(results, "\n\n---\n\n"), nil
-	}
-	return merged, nil
+	return chunks
 }
 
-func mergeChunkResults(chunkResults []string, action *PostAction, apiKey string) (string, error) {
+func mergeChunkResults(chunkResults []string, action *PostAction, apiKey string, out io.Writer) (string, error) {
 	// If only 1 chunk, no merge needed
 	if len(chunkResults) == 1 {
 		return chunkResults[0], nil
 	}
 
 	// Combine all chunk results into a single text for merging
-	combinedChunks := strings.Join(chunkResults, "\n\n--- CHUNK BOUNDARY ---\n\n")
+	combinedChunks := strings.Join(chunkResults, chunkBoundary)
 
-	// Estimate tokens for merge prompt
-	estimatedTokens := len(combinedChunks) / avgCharsPerToken
-	maxTokens := getModelContextLimit(action.Model)
+	// Count tokens for merge prompt
+	estimatedTokens := countTokens(combinedChunks, action.Model)
+	maxTokens := getActionContextLimit(action)
 
 	// If merge would exceed limits, do hierarchical merge
 	if estimatedTokens > maxTokens/2 { // Leave room for prompt + response
-		fmt.Printf("  → Chunk results too large, using hierarchical merge\n")
-		return hierarchicalMerge(chunkResults, action, apiKey)
+		fmt.Fprintf(out, "  → Chunk results too large, using hierarchical merge\n")
+		return hierarchicalMerge(chunkResults, action, apiKey, out)
 	}
 
 	// Create a merge prompt that understands the original action's intent
-	mergePrompt := fmt.Sprintf(`You are merging multiple partial results from the same analysis that was split into chunks.
-
-Original task: %s
-
-Below are %d separate results from processing different parts of a transcript. Your job is to merge them into a single, coherent, comprehensive result that:
-1. Removes duplicate information
-2. Consolidates related points
-3. Maintains the structure and format requested in the original task
-4. Preserves all unique insights and details
-5. Creates a unified narrative without chunk boundaries
-
-Chunk results to merge:
-%s
-
-Provide the final merged result:`, action.Name, len(chunkResults), combinedChunks)
+	mergePrompt := buildMergePrompt(action, len(chunkResults), combinedChunks)
 
 	// Use same model as the action for consistency
 	reqBody := ChatCompletionRequest{
@@ -877,70 +1270,65 @@ Provide the final merged result:`, action.Name, len(chunkResults), combinedChunk
 		MaxTokens:   action.MaxTokens,
 	}
 
-	jsonData, err := json.Marshal(reqBody)
+	merged, err := sendActionChatCached(action, apiKey, reqBody, out)
 	if err != nil {
-		return "", fmt.Errorf("failed to marshal merge request: %w", err)
+		return "", fmt.Errorf("merge request failed: %w", err)
 	}
 
-	req, err := http.NewRequest("POST", "https://api.openai.com/v1/chat/completions", bytes.NewBuffer(jsonData))
-	if err != nil {
-		return "", fmt.Errorf("failed to create merge request: %w", err)
-	}
+	return merged, nil
+}
 
-	req.Header.Set("Authorization", "Bearer "+apiKey)
-	req.Header.Set("Content-Type", "application/json")
+// chunkBoundary separates chunk results in a merge prompt
+const chunkBoundary = "\n\n--- CHUNK BOUNDARY ---\n\n"
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", fmt.Errorf("failed to send merge request: %w", err)
-	}
-	defer resp.Body.Close()
+// buildMergePrompt asks the model to merge count chunk results, joined in combined,
+// into one result for the action
+func buildMergePrompt(action *PostAction, count int, combined string) string {
+	return fmt.Sprintf(`You are merging multiple partial results from the same analysis that was split into chunks.
 
-	respBody, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", fmt.Errorf("failed to read merge response: %w", err)
-	}
-
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("merge API request failed with status %d: %s", resp.StatusCode, string(respBody))
-	}
+Original task: %s
 
-	var chatResp ChatCompletionResponse
-	err = json.Unmarshal(respBody, &chatResp)
-	if err != nil {
-		return "", fmt.Errorf("failed to parse merge response: %w", err)
-	}
+Below are %d separate results from processing different parts of a transcript. Your job is to merge them into a single, coherent, comprehensive result that:
+1. Removes duplicate information
+2. Consolidates related points
+3. Maintains the structure and format requested in the original task
+4. Preserves all unique insights and details
+5. Creates a unified narrative without chunk boundaries
 
-	if len(chatResp.Choices) == 0 {
-		return "", fmt.Errorf("no merge response from API")
-	}
+Chunk results to merge:
+%s
 
-	return chatResp.Choices[0].Message.Content, nil
+Provide the final merged result:`, action.Name, count, combined)
 }
 
-func hierarchicalMerge(chunkResults []string, action *PostAction, apiKey string) (string, error) {
+func hierarchicalMerge(chunkResults []string, action *PostAction, apiKey string, out io.Writer) (string, error) {
 	// Merge in pairs until we have a single result
 	currentLevel := chunkResults
 
 	for len(currentLevel) > 1 {
-		var nextLevel []string
-		fmt.Printf("  → Hierarchical merge: processing %d results\n", len(currentLevel))
-
-		// Process in pairs
-		for i := 0; i < len(currentLevel); i += 2 {
-			if i+1 < len(currentLevel) {
-				// Merge pair
-				pair := []string{currentLevel[i], currentLevel[i+1]}
-				merged, err := mergeChunkResults(pair, action, apiKey)
-				if err != nil {
-					return "", fmt.Errorf("hierarchical merge failed at level: %w", err)
-				}
-				nextLevel = append(nextLevel, merged)
-			} else {
+		fmt.Fprintf(out, "  → Hierarchical merge: processing %d results\n", len(currentLevel))
+
+		// Merge the pairs of this level in parallel, keeping their order; one failed
+		// pair fails the merge, so no more pairs are sent after it
+		level := currentLevel
+		nextLevel := make([]string, (len(level)+1)/2)
+		errs := runUntilError(len(nextLevel), chunkConcurrency, func(j int) error {
+			i := j * 2
+			if i+1 >= len(level) {
 				// Odd one out, pass through
-				nextLevel = append(nextLevel, currentLevel[i])
+				nextLevel[j] = level[i]
+				return nil
+			}
+
+			merged, err := mergeChunkResults(level[i:i+2], action, apiKey, out)
+			if err != nil {
+				return fmt.Errorf("hierarchical merge failed at level: %w", err)
 			}
+			nextLevel[j] = merged
+			return nil
+		})
+		if err := errors.Join(errs...); err != nil {
+			return "", err
 		}
 
 		currentLevel = nextLevel
@@ -950,26 +1338,11 @@ func hierarchicalMerge(chunkResults []string, action *PostAction, apiKey string)
 }
 
 func selectBestActions(transcript string, apiKey string) ([]string, error) {
-	// Build list of available actions for AI to choose from
-	var actionDescriptions []string
-	for _, action := range postActions {
-		actionDescriptions = append(actionDescriptions, fmt.Sprintf("- %s: %s", action.ID, action.Description))
-	}
-
-	prompt := fmt.Sprintf(`Analyze the following transcript and select the 2-3 most appropriate post-processing actions from the list below.
-
-Available actions:
-%s
-
-Transcript preview (first 2000 chars):
-%s
-
-Based on the content, which actions would provide the most value? Reply ONLY with a comma-separated list of action IDs (e.g., "openai-meeting-summary,openai-action-items"). Do not include any explanation.`,
-		strings.Join(actionDescriptions, "\n"),
-		truncateString(transcript, 2000))
+	prompt := buildSelectionPrompt(transcript)
+	selectionAction, model := selectionModel()
 
 	reqBody := ChatCompletionRequest{
-		Model: "gpt-3.5-turbo",
+		Model: model,
 		Messages: []Message{
 			{
 				Role:    "user",
@@ -977,50 +1350,16 @@ Based on the content, which actions would provide the most value? Reply ONLY wit
 			},
 		},
 		Temperature: 0.3,
-		MaxTokens:   100,
-	}
-
-	jsonData, err := json.Marshal(reqBody)
-	if err != nil {
-		return nil, fmt.Errorf("failed to marshal request: %w", err)
-	}
-
-	req, err := http.NewRequest("POST", "https://api.openai.com/v1/chat/completions", bytes.NewBuffer(jsonData))
-	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %w", err)
-	}
-
-	req.Header.Set("Authorization", "Bearer "+apiKey)
-	req.Header.Set("Content-Type", "application/json")
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("failed to send request: %w", err)
-	}
-	defer resp.Body.Close()
-
-	respBody, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read response: %w", err)
-	}
-
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("API request failed with status %d: %s", resp.StatusCode, string(respBody))
+		MaxTokens:   selectionMaxTokens,
 	}
 
-	var chatResp ChatCompletionResponse
-	err = json.Unmarshal(respBody, &chatResp)
+	content, err := sendActionChat(selectionAction, apiKey, reqBody, os.Stdout)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse response: %w", err)
-	}
-
-	if len(chatResp.Choices) == 0 {
-		return nil, fmt.Errorf("no response from API")
+		return nil, err
 	}
 
 	// Parse the response (comma-separated action IDs)
-	response := strings.TrimSpace(chatResp.Choices[0].Message.Content)
+	response := strings.TrimSpace(content)
 	selectedIDs := strings.Split(response, ",")
 
 	// Trim and validate each ID
@@ -1040,6 +1379,39 @@ Based on the content, which actions would provide the most value? Reply ONLY wit
 	return validIDs, nil
 }
 
+// buildSelectionPrompt asks the model to pick actions for a transcript from its start
+func buildSelectionPrompt(transcript string) string {
+	// Build list of available actions for AI to choose from
+	var actionDescriptions []string
+	for _, action := range postActions {
+		actionDescriptions = append(actionDescriptions, fmt.Sprintf("- %s: %s", action.ID, action.Description))
+	}
+
+	return fmt.Sprintf(`Analyze the following transcript and select the 2-3 most appropriate post-processing actions from the list below.
+
+Available actions:
+%s
+
+Transcript preview (first 2000 chars):
+%s
+
+Based on the content, which actions would provide the most value? Reply ONLY with a comma-separated list of action IDs (e.g., "openai-meeting-summary,openai-action-items"). Do not include any explanation.`,
+		strings.Join(actionDescriptions, "\n"),
+		truncateString(transcript, 2000))
+}
+
+// selectionMaxTokens caps the --auto reply, which is only a list of action IDs
+const selectionMaxTokens = 100
+
+// selectionModel returns the action settings and model used by --auto; -provider/-model
+// move selection off the default model too
+func selectionModel() (*PostAction, string) {
+	if selectionOverride != nil {
+		return selectionOverride, selectionOverride.Model
+	}
+	return nil, "gpt-3.5-turbo"
+}
+
 func truncateString(s string, maxLen int) string {
 	if len(s) <= maxLen {
 		return s
@@ -1087,11 +1459,11 @@ func max(a, b int) int {
 	return b
 }
 
-func transcribeAudio(audioPath, apiKey string) (string, error) {
+func transcribeAudio(audioPath string, endpoint apiEndpoint, opts TranscriptionOptions) (*Transcript, error) {
 	// Open the audio file
 	file, err := os.Open(audioPath)
 	if err != nil {
-		return "", fmt.Errorf("failed to open audio file: %w", err)
+		return nil, fmt.Errorf("failed to open audio file: %w", err)
 	}
 	defer file.Close()
 
@@ -1102,62 +1474,76 @@ func transcribeAudio(audioPath, apiKey string) (string, error) {
 	// Add the file to the form
 	part, err := writer.CreateFormFile("file", filepath.Base(audioPath))
 	if err != nil {
-		return "", fmt.Errorf("failed to create form file: %w", err)
+		return nil, fmt.Errorf("failed to create form file: %w", err)
 	}
 	_, err = io.Copy(part, file)
 	if err != nil {
-		return "", fmt.Errorf("failed to copy file: %w", err)
+		return nil, fmt.Errorf("failed to copy file: %w", err)
 	}
 
 	// Add the model field
 	err = writer.WriteField("model", "whisper-1")
 	if err != nil {
-		return "", fmt.Errorf("failed to write model field: %w", err)
+		return nil, fmt.Errorf("failed to write model field: %w", err)
+	}
+
+	// Guide spelling and style with the glossary and preceding transcript
+	if opts.Prompt != "" {
+		err = writer.WriteField("prompt", opts.Prompt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to write prompt field: %w", err)
+		}
+	}
+
+	// Ask for segment-level timings when subtitles are wanted
+	if opts.Timestamps {
+		err = writer.WriteField("response_format", "verbose_json")
+		if err != nil {
+			return nil, fmt.Errorf("failed to write response_format field: %w", err)
+		}
+		err = writer.WriteField("timestamp_granularities[]", "segment")
+		if err != nil {
+			return nil, fmt.Errorf("failed to write timestamp_granularities field: %w", err)
+		}
 	}
 
 	// Close the writer
 	err = writer.Close()
 	if err != nil {
-		return "", fmt.Errorf("failed to close writer: %w", err)
+		return nil, fmt.Errorf("failed to close writer: %w", err)
 	}
 
 	// Create the HTTP request
-	req, err := http.NewRequest("POST", "https://api.openai.com/v1/audio/transcriptions", body)
+	req, err := endpoint.newRequest("POST", "/audio/transcriptions", body)
 	if err != nil {
-		return "", fmt.Errorf("failed to create request: %w", err)
+		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 
 	// Set headers
-	req.Header.Set("Authorization", "Bearer "+apiKey)
 	req.Header.Set("Content-Type", writer.FormDataContentType())
 
 	// Send the request
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", fmt.Errorf("failed to send request: %w", err)
-	}
-	defer resp.Body.Close()
-
-	// Read the response
-	respBody, err := io.ReadAll(resp.Body)
+	statusCode, respBody, err := apiClient.send(req, os.Stdout)
 	if err != nil {
-		return "", fmt.Errorf("failed to read response: %w", err)
+		return nil, fmt.Errorf("failed to send request: %w", err)
 	}
 
 	// Check for errors
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("API request failed with status %d: %s", resp.StatusCode, string(respBody))
+	if statusCode != http.StatusOK {
+		return nil, fmt.Errorf("API request failed with status %d: %s", statusCode, string(respBody))
 	}
 
 	// Parse the response
 	var transcriptionResp TranscriptionResponse
 	err = json.Unmarshal(respBody, &transcriptionResp)
 	if err != nil {
-		return "", fmt.Errorf("failed to parse response: %w", err)
+		return nil, fmt.Errorf("failed to parse response: %w", err)
 	}
 
-	return transcriptionResp.Text, nil
+	return &Transcript{
+		Text:     transcriptionResp.Text,
+		Segments: transcriptionResp.Segments,
+	}, nil
 }
 
 func getFileSize(filePath string) (int64, error) {
@@ -1168,11 +1554,29 @@ func getFileSize(filePath string) (int64, error) {
 	return info.Size(), nil
 }
 
-func splitAudioFile(audioPath string, chunkDurationSeconds int) ([]string, error) {
+// AudioChunk is a piece of a larger audio file and its position within the original
+type AudioChunk struct {
+	Path    string
+	Start   float64 // Offset of the chunk in the original audio, in seconds
+	End     float64
+	Overlap float64 // Seconds at the start of the chunk that repeat the end of the previous one
+}
+
+func splitAudioFile(audioPath string, chunkDurationSeconds int) ([]AudioChunk, error) {
+	segmentArgs := fmt.Sprintf("-segment_time %d", chunkDurationSeconds)
+	return segmentAudio(audioPath, segmentArgs, func(i int) (float64, float64) {
+		return float64(i * chunkDurationSeconds), float64((i + 1) * chunkDurationSeconds)
+	})
+}
+
+// segmentAudio runs the ffmpeg segment muxer with the given segmenting arguments and
+// returns the resulting chunks. bounds supplies a chunk's nominal start and end when
+// ffmpeg does not report the real offsets.
+func segmentAudio(audioPath, segmentArgs string, bounds func(i int) (float64, float64)) ([]AudioChunk, error) {
 	// Create temporary directory for chunks
-	tmpDir, err := os.MkdirTemp("", "goscribe-chunks-*")
+	tmpDir, err := createTempDir("goscribe-chunks-*")
 	if err != nil {
-		return nil, fmt.Errorf("failed to create temp directory: %w", err)
+		return nil, err
 	}
 
 	baseName := filepath.Base(audioPath)
@@ -1180,93 +1584,434 @@ func splitAudioFile(audioPath string, chunkDurationSeconds int) ([]string, error
 	nameWithoutExt := strings.TrimSuffix(baseName, ext)
 
 	outputPattern := filepath.Join(tmpDir, nameWithoutExt+"_chunk_%03d"+ext)
+	segmentList := filepath.Join(tmpDir, "segments.csv")
 
-	// Use ffmpeg to split the file
-	cmd := fmt.Sprintf("ffmpeg -i %s -f segment -segment_time %d -c copy -reset_timestamps 1 %s",
+	// Use ffmpeg to split the file, recording where each segment really starts
+	// (stream copy cuts on packet boundaries, not exactly on the requested time)
+	cmd := fmt.Sprintf("ffmpeg -i %s -f segment %s -segment_list %s -segment_list_type csv -c copy -reset_timestamps 1 %s %s",
 		shellescape(audioPath),
-		chunkDurationSeconds,
+		segmentArgs,
+		shellescape(segmentList),
+		ffmpegBitexactArgs,
 		shellescape(outputPattern))
 
 	output, err := exec.Command("bash", "-c", cmd).CombinedOutput()
 	if err != nil {
+		removeTempDir(tmpDir)
 		return nil, fmt.Errorf("ffmpeg failed: %w\nOutput: %s", err, string(output))
 	}
 
 	// Find all generated chunk files
-	chunks, err := filepath.Glob(filepath.Join(tmpDir, nameWithoutExt+"_chunk_*"+ext))
+	paths, err := filepath.Glob(filepath.Join(tmpDir, nameWithoutExt+"_chunk_*"+ext))
 	if err != nil {
+		removeTempDir(tmpDir)
 		return nil, fmt.Errorf("failed to find chunk files: %w", err)
 	}
 
-	if len(chunks) == 0 {
+	if len(paths) == 0 {
+		removeTempDir(tmpDir)
 		return nil, fmt.Errorf("no chunks were created")
 	}
 
+	// Prefer the offsets ffmpeg reported; fall back to the nominal chunk bounds
+	offsets := map[string][2]float64{}
+	if data, err := os.ReadFile(segmentList); err == nil {
+		offsets, err = parseSegmentList(string(data))
+		if err != nil {
+			fmt.Printf("⚠ Warning: could not read chunk offsets, using nominal chunk times: %v\n", err)
+		}
+	}
+
+	chunks := make([]AudioChunk, len(paths))
+	for i, path := range paths {
+		start, end := bounds(i)
+		chunks[i] = AudioChunk{Path: path, Start: start, End: end}
+		if times, ok := offsets[filepath.Base(path)]; ok {
+			chunks[i].Start = times[0]
+			chunks[i].End = times[1]
+		}
+	}
+
 	return chunks, nil
 }
 
+// parseSegmentList parses an ffmpeg csv segment list ("name,start,end" per line)
+// into a map of chunk file name to its start and end time
+func parseSegmentList(data string) (map[string][2]float64, error) {
+	records, err := csv.NewReader(strings.NewReader(data)).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse segment list: %w", err)
+	}
+
+	offsets := make(map[string][2]float64, len(records))
+	for _, record := range records {
+		if len(record) < 3 {
+			return nil, fmt.Errorf("malformed segment list entry: %v", record)
+		}
+		start, err := strconv.ParseFloat(record[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid start time %q: %w", record[1], err)
+		}
+		end, err := strconv.ParseFloat(record[2], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid end time %q: %w", record[2], err)
+		}
+		offsets[filepath.Base(record[0])] = [2]float64{start, end}
+	}
+
+	return offsets, nil
+}
+
 func shellescape(s string) string {
 	return "'" + strings.ReplaceAll(s, "'", "'\\''") + "'"
 }
 
-func transcribeAudioWithSplitting(audioPath, apiKey string) (string, error) {
+func transcribeAudioWithSplitting(audioPath string, transcriber Transcriber, opts TranscriptionOptions) (*Transcript, error) {
+	// Video containers (or a specific audio track) need the audio pulled out first
+	extracted, err := extractAudioInput(audioPath, opts.AudioStream)
+	if err != nil {
+		return nil, fmt.Errorf("failed to extract audio: %w", err)
+	}
+	if extracted != "" {
+		defer removeTempDir(filepath.Dir(extracted))
+
+		extractedSize, _ := getFileSize(extracted)
+		fmt.Printf("✓ Extracted audio (%.1f MB)\n", float64(extractedSize)/(1024*1024))
+		audioPath = extracted
+		opts.Transcode = false // Already speech-quality Opus
+	}
+
+	// Shrink the file to speech-quality Opus first so most recordings need no splitting
+	if opts.Transcode {
+		originalSize, _ := getFileSize(audioPath)
+		fmt.Println("Transcoding audio to mono 16 kHz Opus...")
+
+		transcoded, err := transcodeForSpeech(audioPath, -1)
+		if err != nil {
+			return nil, fmt.Errorf("failed to transcode audio: %w", err)
+		}
+		defer removeTempDir(filepath.Dir(transcoded))
+
+		transcodedSize, _ := getFileSize(transcoded)
+		fmt.Printf("✓ Transcoded %.1f MB → %.1f MB\n", float64(originalSize)/(1024*1024), float64(transcodedSize)/(1024*1024))
+		audioPath = transcoded
+	}
+
 	// Check file size
 	fileSize, err := getFileSize(audioPath)
 	if err != nil {
-		return "", fmt.Errorf("failed to get file size: %w", err)
+		return nil, fmt.Errorf("failed to get file size: %w", err)
 	}
 
 	fileSizeMB := float64(fileSize) / (1024 * 1024)
 
-	// If file is under the limit, transcribe normally
-	if fileSize <= maxFileSizeBytes {
-		return transcribeAudio(audioPath, apiKey)
+	// If file is under the limit (local backends have none), transcribe normally
+	if limit := transcriber.MaxFileSize(); limit <= 0 || fileSize <= limit {
+		opts.Prompt = buildWhisperPrompt(opts.Glossary, "")
+		transcript, cached, err := transcribeAudioCached(audioPath, transcriber, opts)
+		if cached {
+			fmt.Println("✓ Using cached transcription")
+		}
+		return transcript, err
 	}
 
 	// File is too large, need to split
 	fmt.Printf("⚠ File size (%.1f MB) exceeds OpenAI limit (25 MB)\n", fileSizeMB)
 	fmt.Println("Splitting audio file into chunks...")
 
-	// Split into 10-minute chunks (600 seconds)
-	// This ensures each chunk stays well under 25MB for most audio formats
-	chunkDurationSeconds := 600
+	// Size chunks from the file's bitrate so each one fits under the upload limit
+	chunkDurationSeconds := defaultChunkDurationSeconds
+	if info, err := probeAudio(audioPath); err == nil {
+		chunkDurationSeconds = chunkDurationForBitrate(info.BitRate, opts.Overlap)
+		fmt.Printf("Audio is %.0f minutes at %d kb/s, using chunks of up to %ds\n",
+			info.Duration/60, info.BitRate/1000, chunkDurationSeconds)
+	} else {
+		fmt.Printf("⚠ Could not probe audio (%v), using chunks of up to %ds\n", err, chunkDurationSeconds)
+	}
 
-	chunks, err := splitAudioFile(audioPath, chunkDurationSeconds)
+	chunks, err := splitAudio(audioPath, chunkDurationSeconds, opts.SplitMode)
 	if err != nil {
-		return "", fmt.Errorf("failed to split audio: %w", err)
+		return nil, fmt.Errorf("failed to split audio: %w", err)
 	}
+	chunkDir := filepath.Dir(chunks[0].Path)
 	defer func() {
-		// Clean up chunks
-		for _, chunk := range chunks {
-			os.Remove(chunk)
-		}
-		os.Remove(filepath.Dir(chunks[0]))
+		// Clean up chunks and the ffmpeg segment list
+		removeTempDir(chunkDir)
 	}()
 
+	if opts.Overlap > 0 && len(chunks) > 1 {
+		if err := addChunkOverlap(audioPath, chunks, opts.Overlap); err != nil {
+			return nil, fmt.Errorf("failed to overlap chunks: %w", err)
+		}
+		fmt.Printf("✓ Chunks overlap by %.1fs\n", opts.Overlap)
+	}
+
+	// Variable bitrate peaks can still push a chunk over the limit; split those again
+	chunks, err = resplitOversizedChunks(audioPath, chunks, maxFileSizeBytes)
+	if err != nil {
+		return nil, err
+	}
+
 	fmt.Printf("✓ Created %d chunks\n", len(chunks))
 
-	// Transcribe each chunk
-	var allTranscripts []string
-	for i, chunk := range chunks {
-		fmt.Printf("\n[%d/%d] Transcribing chunk %s...\n", i+1, len(chunks), filepath.Base(chunk))
+	concurrency := max(1, opts.Concurrency)
+	if concurrency > 1 {
+		fmt.Printf("Transcribing up to %d chunks in parallel\n", concurrency)
+		fmt.Println("Note: previous-chunk context is only passed to Whisper with -concurrency 1")
+	}
+
+	// Transcribe each chunk. When running one at a time, the end of the previous
+	// chunk's transcript is carried forward as context. After a failure no more chunks
+	// are uploaded; the ones already done are cached for the rerun.
+	transcripts := make([]*Transcript, len(chunks))
+	errs := runUntilError(len(chunks), concurrency, func(i int) error {
+		chunk := chunks[i]
+		fmt.Printf("\n[%d/%d] Transcribing chunk %s...\n", i+1, len(chunks), filepath.Base(chunk.Path))
 
-		// Check chunk size
-		chunkSize, _ := getFileSize(chunk)
-		if chunkSize > maxFileSizeBytes {
-			return "", fmt.Errorf("chunk %d is still too large (%.1f MB) - try a shorter chunk duration",
-				i+1, float64(chunkSize)/(1024*1024))
+		previousText := ""
+		if concurrency == 1 && i > 0 && transcripts[i-1] != nil {
+			previousText = transcripts[i-1].Text
 		}
 
-		transcript, err := transcribeAudio(chunk, apiKey)
+		chunkOpts := opts
+		chunkOpts.Prompt = buildWhisperPrompt(opts.Glossary, previousText)
+
+		transcript, cached, err := transcribeAudioCached(chunk.Path, transcriber, chunkOpts)
 		if err != nil {
-			return "", fmt.Errorf("failed to transcribe chunk %d: %w", i+1, err)
+			fmt.Printf("✗ Chunk %d/%d failed: %v\n", i+1, len(chunks), err)
+			return fmt.Errorf("failed to transcribe chunk %d: %w", i+1, err)
+		}
+
+		transcripts[i] = transcript
+		if cached {
+			fmt.Printf("✓ Chunk %d/%d loaded from cache\n", i+1, len(chunks))
+		} else {
+			fmt.Printf("✓ Chunk %d/%d complete\n", i+1, len(chunks))
 		}
+		return nil
+	})
 
-		allTranscripts = append(allTranscripts, transcript)
-		fmt.Printf("✓ Chunk %d/%d complete\n", i+1, len(chunks))
+	var failed []error
+	for _, err := range errs {
+		if err != nil {
+			failed = append(failed, err)
+		}
+	}
+	if len(failed) > 0 {
+		if !opts.NoCache {
+			fmt.Println("\nCompleted chunks are cached - rerun the same command to resume with only the missing chunks.")
+		}
+		err := fmt.Errorf("%d of %d chunks failed: %w", len(failed), len(chunks), errors.Join(failed...))
+
+		// A spending cap stops transcription; the leading chunks that were transcribed
+		// still make a usable partial transcript
+		if errors.Is(err, errBudgetExceeded) {
+			done := 0
+			for done < len(transcripts) && transcripts[done] != nil {
+				done++
+			}
+			if done > 0 {
+				return mergeChunkTranscripts(chunks[:done], transcripts[:done], opts.Timestamps), err
+			}
+		}
+		return nil, err
 	}
 
 	// Merge all transcripts
 	fmt.Println("\n✓ All chunks transcribed successfully")
-	return strings.Join(allTranscripts, " "), nil
+	return mergeChunkTranscripts(chunks, transcripts, opts.Timestamps), nil
+}
+
+// mergeChunkTranscripts stitches per-chunk transcripts back together. Text heard twice
+// in overlapping audio is reconciled by aligning the repeated words. With timestamps,
+// segment times are shifted by each chunk's real start offset and a marker is placed
+// in the text at every seam so time references stay meaningful.
+func mergeChunkTranscripts(chunks []AudioChunk, transcripts []*Transcript, timestamps bool) *Transcript {
+	merged := &Transcript{}
+	texts := make([]string, len(transcripts))
+
+	for i, transcript := range transcripts {
+		texts[i] = strings.TrimSpace(transcript.Text)
+		overlapping := i > 0 && chunks[i].Overlap > 0
+
+		if overlapping {
+			texts[i-1], texts[i] = reconcileSeam(texts[i-1], texts[i], seamWindowWords(chunks[i].Overlap))
+		}
+
+		if !timestamps {
+			continue
+		}
+
+		// The seam sits in the middle of the overlap; each chunk keeps the segments
+		// that start on its side of it
+		seam := chunks[i].Start + chunks[i].Overlap/2
+		if overlapping {
+			for len(merged.Segments) > 0 && merged.Segments[len(merged.Segments)-1].Start >= seam {
+				merged.Segments = merged.Segments[:len(merged.Segments)-1]
+			}
+		}
+		for _, seg := range transcript.Segments {
+			seg.Start += chunks[i].Start
+			seg.End += chunks[i].Start
+			if overlapping && seg.Start < seam {
+				continue
+			}
+			merged.Segments = append(merged.Segments, seg)
+		}
+	}
+
+	var text strings.Builder
+	for i, chunkText := range texts {
+		if timestamps {
+			if i > 0 {
+				fmt.Fprintf(&text, "\n\n%s\n\n", chunkSeamMarker(i+1, chunks[i].Start+chunks[i].Overlap))
+			}
+		} else if i > 0 && text.Len() > 0 && chunkText != "" {
+			text.WriteString(" ")
+		}
+		text.WriteString(chunkText)
+	}
+
+	merged.Text = text.String()
+	return merged
+}
+
+// chunkSeamMarker returns the marker inserted in the transcript where a new audio chunk begins
+func chunkSeamMarker(chunkNumber int, offset float64) string {
+	return fmt.Sprintf("[--- chunk %d starts at %s ---]", chunkNumber, formatSubtitleTimestamp(offset, "."))
+}
+
+// minSeamMatchWords is the shortest run of identical words accepted as the overlap
+// between two chunk transcripts
+const minSeamMatchWords = 3
+
+// seamWindowWords returns how many words at each side of a seam to search for the
+// repeated text, allowing for fast speech in the overlapping audio
+func seamWindowWords(overlapSeconds float64) int {
+	return max(20, int(overlapSeconds*8))
+}
+
+var wordPattern = regexp.MustCompile(`\S+`)
+
+// reconcileSeam removes the text repeated at the end of prev and the start of next.
+// The longest run of matching words within window words of the seam is used as the
+// anchor: prev is cut after it (dropping words garbled by the cut) and next resumes
+// after it. If no run of at least minSeamMatchWords is found the texts are unchanged.
+func reconcileSeam(prev, next string, window int) (string, string) {
+	prevSpans := wordPattern.FindAllStringIndex(prev, -1)
+	nextSpans := wordPattern.FindAllStringIndex(next, -1)
+
+	tailStart := max(0, len(prevSpans)-window)
+	headEnd := len(nextSpans)
+	if headEnd > window {
+		headEnd = window
+	}
+
+	tail := make([]string, 0, len(prevSpans)-tailStart)
+	for _, span := range prevSpans[tailStart:] {
+		tail = append(tail, normalizeSeamWord(prev[span[0]:span[1]]))
+	}
+	head := make([]string, 0, headEnd)
+	for _, span := range nextSpans[:headEnd] {
+		head = append(head, normalizeSeamWord(next[span[0]:span[1]]))
+	}
+
+	// Longest common run of words (dynamic programming over suffix matches)
+	bestLen, bestTailEnd, bestHeadEnd := 0, 0, 0
+	runs := make([][]int, len(tail)+1)
+	for i := range runs {
+		runs[i] = make([]int, len(head)+1)
+	}
+	for i := 1; i <= len(tail); i++ {
+		for j := 1; j <= len(head); j++ {
+			if tail[i-1] == "" || tail[i-1] != head[j-1] {
+				continue
+			}
+			runs[i][j] = runs[i-1][j-1] + 1
+			if runs[i][j] > bestLen {
+				bestLen, bestTailEnd, bestHeadEnd = runs[i][j], i, j
+			}
+		}
+	}
+
+	if bestLen < minSeamMatchWords {
+		return prev, next
+	}
+
+	prevCut := prevSpans[tailStart+bestTailEnd-1][1]
+	nextRest := ""
+	if bestHeadEnd < len(nextSpans) {
+		nextRest = next[nextSpans[bestHeadEnd][0]:]
+	}
+
+	return prev[:prevCut], strings.TrimSpace(nextRest)
+}
+
+// normalizeSeamWord lowercases a word and strips punctuation so that "Hello," and
+// "hello" align
+func normalizeSeamWord(word string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToLower(r)
+		}
+		return -1
+	}, word)
+}
+
+// Whisper only looks at the last 224 tokens of its prompt, so keep it to roughly that
+const (
+	maxWhisperPromptChars  = 800
+	maxGlossaryPromptChars = 300
+)
+
+// buildWhisperPrompt builds the prompt sent with a transcription request: the user
+// glossary (so names and acronyms are spelled consistently) followed by the tail of
+// the previous chunk's transcript (so style and context carry across seams)
+func buildWhisperPrompt(glossary []string, previous string) string {
+	var parts []string
+
+	// Keep as many glossary terms as fit, in the order given
+	glossaryText := ""
+	for _, term := range glossary {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+		candidate := term
+		if glossaryText != "" {
+			candidate = glossaryText + ", " + term
+		}
+		if len(candidate) > maxGlossaryPromptChars {
+			break
+		}
+		glossaryText = candidate
+	}
+	if glossaryText != "" {
+		parts = append(parts, "Glossary: "+glossaryText+".")
+	}
+
+	budget := maxWhisperPromptChars
+	for _, part := range parts {
+		budget -= len(part) + 2
+	}
+	if tail := tailWords(strings.TrimSpace(previous), budget); tail != "" {
+		parts = append(parts, tail)
+	}
+
+	return strings.Join(parts, "\n\n")
+}
+
+// tailWords returns the end of text, at most maxChars long, starting on a word boundary
+func tailWords(text string, maxChars int) string {
+	if maxChars <= 0 {
+		return ""
+	}
+	if len(text) <= maxChars {
+		return text
+	}
+	tail := text[len(text)-maxChars:]
+	if idx := strings.IndexAny(tail, " \n\t"); idx >= 0 {
+		tail = tail[idx+1:]
+	}
+	return strings.TrimSpace(tail)
 }
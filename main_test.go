@@ -1,12 +1,34 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
 )
 
+// TestMain turns off the response cache, so servers see every request
+func TestMain(m *testing.M) {
+	noResponseCache = true // Tests that cache responses turn it on with a temp HOME
+	os.Exit(m.Run())
+}
+
 // Test findAction function
 func TestFindAction(t *testing.T) {
 	// Setup test actions
@@ -79,6 +101,58 @@ func TestValidateConfig(t *testing.T) {
 			},
 			wantErr: false,
 		},
+		{
+			name: "Azure action with endpoint from azure section",
+			config: &Config{
+				Azure: AzureConfig{Endpoint: "https://contoso.openai.azure.com"},
+				PostActions: []PostAction{
+					{
+						ID:          "azure-summary",
+						Name:        "Azure Summary",
+						Type:        "azure-openai",
+						Prompt:      "Test prompt",
+						Model:       "gpt-4o",
+						Temperature: 0.5,
+						MaxTokens:   1000,
+					},
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "Anthropic temperature above 1",
+			config: &Config{
+				PostActions: []PostAction{
+					{
+						ID:          "claude-summary",
+						Name:        "Claude Summary",
+						Type:        "anthropic",
+						Prompt:      "Test prompt",
+						Model:       "claude-sonnet-4-5",
+						Temperature: 1.5,
+						MaxTokens:   1000,
+					},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "Azure action without endpoint",
+			config: &Config{
+				PostActions: []PostAction{
+					{
+						ID:          "azure-summary",
+						Name:        "Azure Summary",
+						Type:        "azure-openai",
+						Prompt:      "Test prompt",
+						Model:       "gpt-4o",
+						Temperature: 0.5,
+						MaxTokens:   1000,
+					},
+				},
+			},
+			wantErr: true,
+		},
 		{
 			name: "Empty config",
 			config: &Config{
@@ -260,6 +334,23 @@ func TestValidateConfig(t *testing.T) {
 			},
 			wantErr: true,
 		},
+		{
+			name: "Max tokens fill the context window",
+			config: &Config{
+				PostActions: []PostAction{
+					{
+						ID:          "test-action",
+						Name:        "Test Action",
+						Type:        "openai",
+						Prompt:      "Test prompt",
+						Model:       "gpt-4",
+						Temperature: 0.5,
+						MaxTokens:   8000,
+					},
+				},
+			},
+			wantErr: true,
+		},
 	}
 
 	for _, tt := range tests {
@@ -401,6 +492,18 @@ func TestStoreAPIKey(t *testing.T) {
 	if apiKey != testKey {
 		t.Errorf("Stored API key = %v, want %v", apiKey, testKey)
 	}
+
+	// Storing the Anthropic key keeps the OpenAI key
+	if err := storeAnthropicAPIKey("sk-ant-test"); err != nil {
+		t.Errorf("storeAnthropicAPIKey() error = %v, want nil", err)
+	}
+	apiKey, err = loadConfigActions(configPath)
+	if err != nil {
+		t.Errorf("Failed to load config after storing key: %v", err)
+	}
+	if apiKey != testKey || activeConfig.AnthropicAPIKey != "sk-ant-test" {
+		t.Errorf("Stored keys = %v, %v", apiKey, activeConfig.AnthropicAPIKey)
+	}
 }
 
 // Test createDefaultConfig function
@@ -638,6 +741,2513 @@ func TestShellescape(t *testing.T) {
 	}
 }
 
+// Test formatSubtitleTimestamp function
+func TestFormatSubtitleTimestamp(t *testing.T) {
+	tests := []struct {
+		name     string
+		seconds  float64
+		sep      string
+		expected string
+	}{
+		{"Zero", 0, ",", "00:00:00,000"},
+		{"Fractional seconds", 1.5, ",", "00:00:01,500"},
+		{"Minutes and hours", 3723.042, ".", "01:02:03.042"},
+		{"Rounds to nearest millisecond", 59.9996, ".", "00:01:00.000"},
+		{"Negative clamped to zero", -2, ",", "00:00:00,000"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := formatSubtitleTimestamp(tt.seconds, tt.sep)
+			if got != tt.expected {
+				t.Errorf("formatSubtitleTimestamp(%v, %q) = %q, want %q", tt.seconds, tt.sep, got, tt.expected)
+			}
+		})
+	}
+}
+
+// Test SRT and WebVTT rendering
+func TestFormatSubtitles(t *testing.T) {
+	segments := []TranscriptSegment{
+		{Start: 0, End: 2.5, Text: " Hello everyone."},
+		{Start: 2.5, End: 3, Text: "   "},
+		{Start: 3, End: 65.25, Text: "Welcome to the talk."},
+	}
+
+	wantSRT := "1\n00:00:00,000 --> 00:00:02,500\nHello everyone.\n\n" +
+		"2\n00:00:03,000 --> 00:01:05,250\nWelcome to the talk.\n\n"
+	if got := formatSRT(segments); got != wantSRT {
+		t.Errorf("formatSRT() = %q, want %q", got, wantSRT)
+	}
+
+	wantVTT := "WEBVTT\n\n00:00:00.000 --> 00:00:02.500\nHello everyone.\n\n" +
+		"00:00:03.000 --> 00:01:05.250\nWelcome to the talk.\n\n"
+	if got := formatVTT(segments); got != wantVTT {
+		t.Errorf("formatVTT() = %q, want %q", got, wantVTT)
+	}
+}
+
+// Test writeSubtitleFiles function
+func TestWriteSubtitleFiles(t *testing.T) {
+	tmpDir := t.TempDir()
+	transcriptPath := filepath.Join(tmpDir, "talk-transcript.txt")
+	segments := []TranscriptSegment{{Start: 0, End: 1, Text: "Hi."}}
+
+	files, err := writeSubtitleFiles(transcriptPath, segments)
+	if err != nil {
+		t.Fatalf("writeSubtitleFiles() error = %v", err)
+	}
+
+	expected := []string{
+		filepath.Join(tmpDir, "talk-transcript.srt"),
+		filepath.Join(tmpDir, "talk-transcript.vtt"),
+	}
+	if len(files) != len(expected) {
+		t.Fatalf("writeSubtitleFiles() wrote %d files, want %d", len(files), len(expected))
+	}
+	for i, f := range files {
+		if f != expected[i] {
+			t.Errorf("file[%d] = %s, want %s", i, f, expected[i])
+		}
+		if _, err := os.Stat(f); err != nil {
+			t.Errorf("expected %s to exist: %v", f, err)
+		}
+	}
+}
+
+// Test parseSegmentList function
+func TestParseSegmentList(t *testing.T) {
+	data := "talk_chunk_000.mp3,0.000000,600.024000\n" +
+		"talk_chunk_001.mp3,600.024000,1200.048000\n" +
+		"\"odd,name_chunk_002.mp3\",1200.048000,1250.500000\n"
+
+	offsets, err := parseSegmentList(data)
+	if err != nil {
+		t.Fatalf("parseSegmentList() error = %v", err)
+	}
+
+	expected := map[string][2]float64{
+		"talk_chunk_000.mp3":     {0, 600.024},
+		"talk_chunk_001.mp3":     {600.024, 1200.048},
+		"odd,name_chunk_002.mp3": {1200.048, 1250.5},
+	}
+	if len(offsets) != len(expected) {
+		t.Fatalf("parseSegmentList() returned %d entries, want %d", len(offsets), len(expected))
+	}
+	for name, want := range expected {
+		if got := offsets[name]; got != want {
+			t.Errorf("offsets[%s] = %v, want %v", name, got, want)
+		}
+	}
+
+	if _, err := parseSegmentList("chunk.mp3,abc,1\n"); err == nil {
+		t.Error("parseSegmentList() expected error for invalid start time, got nil")
+	}
+}
+
+// Test mergeChunkTranscripts function
+func TestMergeChunkTranscripts(t *testing.T) {
+	chunks := []AudioChunk{
+		{Path: "a.mp3", Start: 0, End: 600.5},
+		{Path: "b.mp3", Start: 600.5, End: 1200},
+	}
+	transcripts := []*Transcript{
+		{Text: " First part.", Segments: []TranscriptSegment{{Start: 0, End: 4, Text: "First part."}}},
+		{Text: "Second part. ", Segments: []TranscriptSegment{{Start: 1, End: 3.5, Text: "Second part."}}},
+	}
+
+	t.Run("Without timestamps", func(t *testing.T) {
+		merged := mergeChunkTranscripts(chunks, transcripts, false)
+		if merged.Text != "First part. Second part." {
+			t.Errorf("Text = %q, want %q", merged.Text, "First part. Second part.")
+		}
+		if len(merged.Segments) != 0 {
+			t.Errorf("got %d segments, want 0", len(merged.Segments))
+		}
+	})
+
+	t.Run("With timestamps", func(t *testing.T) {
+		merged := mergeChunkTranscripts(chunks, transcripts, true)
+
+		wantText := "First part.\n\n[--- chunk 2 starts at 00:10:00.500 ---]\n\nSecond part."
+		if merged.Text != wantText {
+			t.Errorf("Text = %q, want %q", merged.Text, wantText)
+		}
+
+		if len(merged.Segments) != 2 {
+			t.Fatalf("got %d segments, want 2", len(merged.Segments))
+		}
+		if merged.Segments[1].Start != 601.5 || merged.Segments[1].End != 604 {
+			t.Errorf("second segment = %v-%v, want 601.5-604", merged.Segments[1].Start, merged.Segments[1].End)
+		}
+
+		// The source transcripts must not be modified
+		if transcripts[1].Segments[0].Start != 1 {
+			t.Errorf("source segment was shifted in place")
+		}
+	})
+}
+
+// Test parseSilenceDetect function
+func TestParseSilenceDetect(t *testing.T) {
+	output := `Input #0, mp3, from 'talk.mp3':
+  Duration: 00:20:34.50, start: 0.025057, bitrate: 128 kb/s
+[silencedetect @ 0x55d5c8] silence_start: 12.345
+[silencedetect @ 0x55d5c8] silence_end: 13.9 | silence_duration: 1.555
+[silencedetect @ 0x55d5c8] silence_start: -0.01
+[silencedetect @ 0x55d5c8] silence_end: 0.8 | silence_duration: 0.81
+[silencedetect @ 0x55d5c8] silence_start: 1230.1
+`
+
+	silences, duration := parseSilenceDetect(output)
+
+	if duration != 1234.5 {
+		t.Errorf("duration = %v, want 1234.5", duration)
+	}
+
+	expected := []silenceInterval{
+		{Start: 12.345, End: 13.9},
+		{Start: 0, End: 0.8},
+		{Start: 1230.1, End: 1234.5},
+	}
+	if len(silences) != len(expected) {
+		t.Fatalf("got %d silences, want %d", len(silences), len(expected))
+	}
+	for i, want := range expected {
+		if silences[i] != want {
+			t.Errorf("silence[%d] = %v, want %v", i, silences[i], want)
+		}
+	}
+}
+
+// Test chooseCutPoints function
+func TestChooseCutPoints(t *testing.T) {
+	tests := []struct {
+		name     string
+		silences []silenceInterval
+		duration float64
+		expected []float64
+	}{
+		{
+			name:     "Shorter than target",
+			silences: []silenceInterval{{Start: 10, End: 11}},
+			duration: 500,
+			expected: nil,
+		},
+		{
+			name:     "Cuts in pause closest to target",
+			silences: []silenceInterval{{Start: 500, End: 502}, {Start: 580, End: 582}, {Start: 1150, End: 1160}},
+			duration: 1500,
+			expected: []float64{581, 1155},
+		},
+		{
+			name:     "Pause spanning target is cut at target",
+			silences: []silenceInterval{{Start: 590, End: 640}},
+			duration: 900,
+			expected: []float64{600},
+		},
+		{
+			name:     "No pause in window falls back to target",
+			silences: []silenceInterval{{Start: 100, End: 102}, {Start: 700, End: 701}},
+			duration: 1300,
+			expected: []float64{600, 1200},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := chooseCutPoints(tt.silences, tt.duration, 600, 120)
+			if len(got) != len(tt.expected) {
+				t.Fatalf("chooseCutPoints() = %v, want %v", got, tt.expected)
+			}
+			for i := range got {
+				if got[i] != tt.expected[i] {
+					t.Errorf("cut[%d] = %v, want %v", i, got[i], tt.expected[i])
+				}
+			}
+		})
+	}
+}
+
+// Test reconcileSeam function
+func TestReconcileSeam(t *testing.T) {
+	tests := []struct {
+		name     string
+		prev     string
+		next     string
+		wantPrev string
+		wantNext string
+	}{
+		{
+			name:     "Repeated words removed",
+			prev:     "We shipped the release on Monday and the rollout went smoo",
+			next:     "release on Monday and the rollout went smoothly. Next topic.",
+			wantPrev: "We shipped the release on Monday and the rollout went",
+			wantNext: "smoothly. Next topic.",
+		},
+		{
+			name:     "Punctuation and case ignored when aligning",
+			prev:     "Thanks everyone. Let's get started with",
+			next:     "let's get started, with the budget review.",
+			wantPrev: "Thanks everyone. Let's get started with",
+			wantNext: "the budget review.",
+		},
+		{
+			name:     "No overlap leaves texts unchanged",
+			prev:     "First chunk ends here.",
+			next:     "Completely different words begin.",
+			wantPrev: "First chunk ends here.",
+			wantNext: "Completely different words begin.",
+		},
+		{
+			name:     "Next chunk entirely repeated",
+			prev:     "and that is all for today",
+			next:     "that is all for today",
+			wantPrev: "and that is all for today",
+			wantNext: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotPrev, gotNext := reconcileSeam(tt.prev, tt.next, 20)
+			if gotPrev != tt.wantPrev {
+				t.Errorf("prev = %q, want %q", gotPrev, tt.wantPrev)
+			}
+			if gotNext != tt.wantNext {
+				t.Errorf("next = %q, want %q", gotNext, tt.wantNext)
+			}
+		})
+	}
+}
+
+// Test mergeChunkTranscripts with overlapping chunks
+func TestMergeChunkTranscriptsOverlap(t *testing.T) {
+	chunks := []AudioChunk{
+		{Path: "a.mp3", Start: 0, End: 600},
+		{Path: "b.mp3", Start: 595, End: 1200, Overlap: 5},
+	}
+	transcripts := []*Transcript{
+		{
+			Text: "Opening remarks. We will now review the quarterly numbers in",
+			Segments: []TranscriptSegment{
+				{Start: 0, End: 590, Text: "Opening remarks."},
+				{Start: 590, End: 596, Text: "We will now"},
+				{Start: 598, End: 600, Text: "review the quarterly numbers in"},
+			},
+		},
+		{
+			Text: "review the quarterly numbers in detail.",
+			Segments: []TranscriptSegment{
+				{Start: 0, End: 1, Text: "now"},
+				{Start: 3, End: 7, Text: "review the quarterly numbers"},
+				{Start: 7, End: 9, Text: "in detail."},
+			},
+		},
+	}
+
+	merged := mergeChunkTranscripts(chunks, transcripts, true)
+
+	wantText := "Opening remarks. We will now review the quarterly numbers in" +
+		"\n\n[--- chunk 2 starts at 00:10:00.000 ---]\n\n" +
+		"detail."
+	if merged.Text != wantText {
+		t.Errorf("Text = %q, want %q", merged.Text, wantText)
+	}
+
+	// The seam sits in the middle of the overlap (597.5s); each chunk keeps the
+	// segments starting on its side of it
+	var texts []string
+	for _, seg := range merged.Segments {
+		texts = append(texts, seg.Text)
+	}
+	wantSegments := []string{"Opening remarks.", "We will now", "review the quarterly numbers", "in detail."}
+	if strings.Join(texts, "|") != strings.Join(wantSegments, "|") {
+		t.Errorf("segments = %v, want %v", texts, wantSegments)
+	}
+}
+
+// Test buildWhisperPrompt function
+func TestBuildWhisperPrompt(t *testing.T) {
+	longPrevious := strings.Repeat("word ", 400) + "final words here."
+
+	tests := []struct {
+		name     string
+		glossary []string
+		previous string
+		check    func(t *testing.T, prompt string)
+	}{
+		{
+			name: "Empty",
+			check: func(t *testing.T, prompt string) {
+				if prompt != "" {
+					t.Errorf("prompt = %q, want empty", prompt)
+				}
+			},
+		},
+		{
+			name:     "Glossary only",
+			glossary: []string{"Kubernetes", " ", "Jane Doe", "ACME"},
+			check: func(t *testing.T, prompt string) {
+				if prompt != "Glossary: Kubernetes, Jane Doe, ACME." {
+					t.Errorf("prompt = %q", prompt)
+				}
+			},
+		},
+		{
+			name:     "Glossary and previous text",
+			glossary: []string{"ACME"},
+			previous: "  We talked about the roadmap. ",
+			check: func(t *testing.T, prompt string) {
+				if prompt != "Glossary: ACME.\n\nWe talked about the roadmap." {
+					t.Errorf("prompt = %q", prompt)
+				}
+			},
+		},
+		{
+			name:     "Long previous text keeps the tail",
+			glossary: []string{"ACME"},
+			previous: longPrevious,
+			check: func(t *testing.T, prompt string) {
+				if len(prompt) > maxWhisperPromptChars {
+					t.Errorf("prompt length = %d, want <= %d", len(prompt), maxWhisperPromptChars)
+				}
+				if !strings.HasPrefix(prompt, "Glossary: ACME.\n\nword ") {
+					t.Errorf("prompt should start with glossary and a whole word, got %q", prompt[:30])
+				}
+				if !strings.HasSuffix(prompt, "final words here.") {
+					t.Errorf("prompt should end with the end of the previous text")
+				}
+			},
+		},
+		{
+			name:     "Glossary is capped",
+			glossary: strings.Split(strings.Repeat("Term,", 200), ","),
+			check: func(t *testing.T, prompt string) {
+				if len(prompt) > maxGlossaryPromptChars+len("Glossary: .") {
+					t.Errorf("glossary prompt length = %d, want <= %d", len(prompt), maxGlossaryPromptChars)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.check(t, buildWhisperPrompt(tt.glossary, tt.previous))
+		})
+	}
+}
+
+// Test runConcurrently function
+func TestRunConcurrently(t *testing.T) {
+	t.Run("Respects limit and reports errors by index", func(t *testing.T) {
+		var mu sync.Mutex
+		inFlight, peak := 0, 0
+		results := make([]int, 10)
+
+		errs := runConcurrently(10, 3, func(i int) error {
+			mu.Lock()
+			inFlight++
+			if inFlight > peak {
+				peak = inFlight
+			}
+			mu.Unlock()
+
+			defer func() {
+				mu.Lock()
+				inFlight--
+				mu.Unlock()
+			}()
+
+			if i == 4 || i == 7 {
+				return fmt.Errorf("chunk %d failed", i+1)
+			}
+			results[i] = i * i
+			return nil
+		})
+
+		if peak > 3 {
+			t.Errorf("peak concurrency = %d, want <= 3", peak)
+		}
+		for i, err := range errs {
+			wantErr := i == 4 || i == 7
+			if (err != nil) != wantErr {
+				t.Errorf("errs[%d] = %v, wantErr %v", i, err, wantErr)
+			}
+			if !wantErr && results[i] != i*i {
+				t.Errorf("results[%d] = %d, want %d", i, results[i], i*i)
+			}
+		}
+	})
+
+	t.Run("Stops starting calls after an error", func(t *testing.T) {
+		var calls int32
+		errs := runUntilError(10, 1, func(i int) error {
+			atomic.AddInt32(&calls, 1)
+			if i == 2 {
+				return fmt.Errorf("chunk %d failed", i+1)
+			}
+			return nil
+		})
+		if calls != 3 {
+			t.Errorf("%d calls, want 3 (none after the failure)", calls)
+		}
+		if errs[2] == nil || errs[3] != nil {
+			t.Errorf("errs = %v, want only chunk 3 failed", errs)
+		}
+
+		calls = 0
+		runUntilError(10, 3, func(i int) error {
+			atomic.AddInt32(&calls, 1)
+			if i == 0 {
+				return fmt.Errorf("chunk 1 failed")
+			}
+			time.Sleep(10 * time.Millisecond)
+			return nil
+		})
+		if calls > 4 {
+			t.Errorf("%d calls, want at most the ones already in flight", calls)
+		}
+	})
+
+	t.Run("Limit of one runs in order", func(t *testing.T) {
+		var order []int
+		runConcurrently(5, 1, func(i int) error {
+			order = append(order, i)
+			return nil
+		})
+		for i, got := range order {
+			if got != i {
+				t.Fatalf("order = %v, want sequential", order)
+			}
+		}
+	})
+}
+
+// Test transcription cache keys and storage
+func TestTranscriptionCache(t *testing.T) {
+	originalHome := os.Getenv("HOME")
+	defer os.Setenv("HOME", originalHome)
+	tmpHome := t.TempDir()
+	os.Setenv("HOME", tmpHome)
+
+	audioPath := filepath.Join(tmpHome, "chunk.mp3")
+	if err := os.WriteFile(audioPath, []byte("fake audio data"), 0644); err != nil {
+		t.Fatalf("Failed to write test audio: %v", err)
+	}
+	otherPath := filepath.Join(tmpHome, "other.mp3")
+	if err := os.WriteFile(otherPath, []byte("different audio data"), 0644); err != nil {
+		t.Fatalf("Failed to write test audio: %v", err)
+	}
+
+	key, err := transcriptionCacheKey(audioPath, "whisper-1", TranscriptionOptions{})
+	if err != nil {
+		t.Fatalf("transcriptionCacheKey() error = %v", err)
+	}
+
+	// Same content and settings give the same key; anything else changes it
+	if again, _ := transcriptionCacheKey(audioPath, "whisper-1", TranscriptionOptions{Concurrency: 4}); again != key {
+		t.Error("key changed for a setting that does not affect the result")
+	}
+	for name, opts := range map[string]TranscriptionOptions{
+		"timestamps": {Timestamps: true},
+		"prompt":     {Prompt: "Glossary: ACME."},
+	} {
+		if other, _ := transcriptionCacheKey(audioPath, "whisper-1", opts); other == key {
+			t.Errorf("key did not change with %s", name)
+		}
+	}
+	if other, _ := transcriptionCacheKey(otherPath, "whisper-1", TranscriptionOptions{}); other == key {
+		t.Error("key did not change with audio content")
+	}
+	if other, _ := transcriptionCacheKey(audioPath, "whisper-cpp:ggml-base.bin:", TranscriptionOptions{}); other == key {
+		t.Error("key did not change with transcriber")
+	}
+
+	if _, ok := loadCachedTranscript(key); ok {
+		t.Fatal("loadCachedTranscript() found an entry in an empty cache")
+	}
+
+	want := &Transcript{Text: "Hello.", Segments: []TranscriptSegment{{Start: 1, End: 2, Text: "Hello."}}}
+	if err := storeCachedTranscript(key, want); err != nil {
+		t.Fatalf("storeCachedTranscript() error = %v", err)
+	}
+
+	got, ok := loadCachedTranscript(key)
+	if !ok {
+		t.Fatal("loadCachedTranscript() missed a stored entry")
+	}
+	if got.Text != want.Text || len(got.Segments) != 1 || got.Segments[0] != want.Segments[0] {
+		t.Errorf("loadCachedTranscript() = %+v, want %+v", got, want)
+	}
+
+	entryPath := filepath.Join(tmpHome, ".goscribe", "cache", "transcriptions", key+".json")
+	if _, err := os.Stat(entryPath); err != nil {
+		t.Errorf("cache entry not stored under ~/.goscribe/cache: %v", err)
+	}
+
+	// A hit counts as use, so pruning by age keeps entries that are still resumed
+	old := time.Now().Add(-40 * 24 * time.Hour)
+	os.Chtimes(entryPath, old, old)
+	if _, ok := loadCachedTranscript(key); !ok {
+		t.Fatal("loadCachedTranscript() missed a stored entry")
+	}
+	if err := runCacheCommand([]string{"prune", "-older-than", "30d", "-kind", "transcriptions"}, io.Discard); err != nil {
+		t.Fatalf("runCacheCommand() error = %v", err)
+	}
+	if _, err := os.Stat(entryPath); err != nil {
+		t.Errorf("prune removed an entry used just now: %v", err)
+	}
+}
+
+// Test parseProbeOutput function
+func TestParseProbeOutput(t *testing.T) {
+	tests := []struct {
+		name    string
+		output  string
+		want    audioInfo
+		wantErr bool
+	}{
+		{
+			name:   "Duration and bitrate",
+			output: `{"format": {"duration": "3600.500000", "bit_rate": "128000", "size": "57608000"}}`,
+			want:   audioInfo{Duration: 3600.5, BitRate: 128000},
+		},
+		{
+			name:   "Bitrate derived from size",
+			output: `{"format": {"duration": "100.000000", "bit_rate": "N/A", "size": "1000000"}}`,
+			want:   audioInfo{Duration: 100, BitRate: 80000},
+		},
+		{
+			name:    "Missing duration",
+			output:  `{"format": {"bit_rate": "128000"}}`,
+			wantErr: true,
+		},
+		{
+			name:    "Invalid JSON",
+			output:  `not json`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseProbeOutput([]byte(tt.output))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseProbeOutput() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseProbeOutput() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// Test chunkDurationForBitrate function
+func TestChunkDurationForBitrate(t *testing.T) {
+	tests := []struct {
+		name    string
+		bitRate int64
+		overlap float64
+		want    int
+	}{
+		{"Unknown bitrate uses default", 0, 0, defaultChunkDurationSeconds},
+		{"128 kb/s MP3", 128000, 0, 1474},
+		{"Overlap is subtracted", 128000, 5, 1469},
+		{"1411 kb/s WAV", 1411200, 0, 133},
+		{"Absurd bitrate is clamped", 100000000, 0, minChunkDurationSeconds},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := chunkDurationForBitrate(tt.bitRate, tt.overlap)
+			if got != tt.want {
+				t.Errorf("chunkDurationForBitrate(%d, %v) = %d, want %d", tt.bitRate, tt.overlap, got, tt.want)
+			}
+			if tt.bitRate > 0 && got > minChunkDurationSeconds {
+				size := float64(tt.bitRate) / 8 * (float64(got) + tt.overlap)
+				if size > maxFileSizeBytes {
+					t.Errorf("chunk of %ds would be %.0f bytes, over the limit", got, size)
+				}
+			}
+		})
+	}
+}
+
+// Test parseStreams and the video/audio stream helpers
+func TestMediaStreams(t *testing.T) {
+	tests := []struct {
+		name      string
+		output    string
+		wantVideo bool
+		wantAudio []string
+		wantErr   bool
+	}{
+		{
+			name: "Video with two audio tracks",
+			output: `{"streams": [
+				{"index": 0, "codec_name": "h264", "codec_type": "video", "disposition": {"attached_pic": 0}},
+				{"index": 1, "codec_name": "aac", "codec_type": "audio", "disposition": {"attached_pic": 0}, "tags": {"language": "eng"}},
+				{"index": 2, "codec_name": "opus", "codec_type": "audio", "disposition": {"attached_pic": 0}, "tags": {"language": "fra", "title": "Interpretation"}}
+			]}`,
+			wantVideo: true,
+			wantAudio: []string{"0: aac (eng)", "1: opus (fra) Interpretation"},
+		},
+		{
+			name: "Audio with cover art",
+			output: `{"streams": [
+				{"index": 0, "codec_name": "mp3", "codec_type": "audio", "disposition": {"attached_pic": 0}},
+				{"index": 1, "codec_name": "mjpeg", "codec_type": "video", "disposition": {"attached_pic": 1}}
+			]}`,
+			wantVideo: false,
+			wantAudio: []string{"0: mp3"},
+		},
+		{
+			name:      "Video without audio",
+			output:    `{"streams": [{"index": 0, "codec_name": "vp9", "codec_type": "video"}]}`,
+			wantVideo: true,
+		},
+		{
+			name:    "Invalid JSON",
+			output:  `not json`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			streams, err := parseStreams([]byte(tt.output))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseStreams() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			if got := hasVideoStream(streams); got != tt.wantVideo {
+				t.Errorf("hasVideoStream() = %v, want %v", got, tt.wantVideo)
+			}
+
+			audio := audioStreams(streams)
+			if len(audio) != len(tt.wantAudio) {
+				t.Fatalf("audioStreams() returned %d streams, want %d", len(audio), len(tt.wantAudio))
+			}
+			for n, stream := range audio {
+				if got := describeStream(n, stream); got != tt.wantAudio[n] {
+					t.Errorf("describeStream(%d) = %q, want %q", n, got, tt.wantAudio[n])
+				}
+			}
+		})
+	}
+
+	for path, want := range map[string]bool{"talk.mp4": true, "talk.MKV": true, "talk.webm": true, "talk.mp3": false, "talk.m4a": false, "talk": false} {
+		if got := mayContainVideo(path); got != want {
+			t.Errorf("mayContainVideo(%q) = %v, want %v", path, got, want)
+		}
+	}
+
+	// Audio files are uploaded as they are without running ffprobe, so a missing
+	// ffprobe doesn't matter; a fake ffprobe on PATH records whether it was run
+	binDir := t.TempDir()
+	marker := filepath.Join(binDir, "probed")
+	script := "#!/bin/sh\ntouch " + shellescape(marker) + "\nexit 1\n"
+	if err := os.WriteFile(filepath.Join(binDir, "ffprobe"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	for _, tt := range []struct {
+		path        string
+		audioStream int
+		wantProbe   bool
+	}{
+		{"talk.mp3", -1, false},
+		{"talk.mp3", 1, true},
+		{"talk.mp4", -1, true},
+	} {
+		os.Remove(marker)
+		extractAudioInput(filepath.Join(binDir, tt.path), tt.audioStream)
+		if _, err := os.Stat(marker); (err == nil) != tt.wantProbe {
+			t.Errorf("extractAudioInput(%s, %d) ran ffprobe = %v, want %v", tt.path, tt.audioStream, err == nil, tt.wantProbe)
+		}
+	}
+}
+
+// Test temp directory tracking
+func TestTempDirTracking(t *testing.T) {
+	dir, err := createTempDir("goscribe-test-*")
+	if err != nil {
+		t.Fatalf("createTempDir() error = %v", err)
+	}
+
+	tempDirsMu.Lock()
+	tracked := tempDirs[dir]
+	tempDirsMu.Unlock()
+	if !tracked {
+		t.Errorf("createTempDir() did not track %s", dir)
+	}
+
+	removeTempDir(dir)
+
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("removeTempDir() left %s behind", dir)
+	}
+	tempDirsMu.Lock()
+	tracked = tempDirs[dir]
+	tempDirsMu.Unlock()
+	if tracked {
+		t.Errorf("removeTempDir() did not untrack %s", dir)
+	}
+}
+
+// Test parsing of local whisper.cpp and faster-whisper JSON output
+func TestParseLocalWhisperOutput(t *testing.T) {
+	wantSegments := []TranscriptSegment{
+		{Start: 0, End: 2.5, Text: "Hello everyone."},
+		{Start: 2.5, End: 5.04, Text: "Let's begin."},
+	}
+
+	whisperCpp := `{
+		"result": {"language": "en"},
+		"transcription": [
+			{"timestamps": {"from": "00:00:00,000", "to": "00:00:02,500"}, "offsets": {"from": 0, "to": 2500}, "text": " Hello everyone."},
+			{"timestamps": {"from": "00:00:02,500", "to": "00:00:05,040"}, "offsets": {"from": 2500, "to": 5040}, "text": " Let's begin."},
+			{"timestamps": {"from": "00:00:05,040", "to": "00:00:06,000"}, "offsets": {"from": 5040, "to": 6000}, "text": " "}
+		]
+	}`
+	fasterWhisper := `{
+		"text": " Hello everyone. Let's begin.",
+		"segments": [
+			{"id": 0, "start": 0.0, "end": 2.5, "text": " Hello everyone.", "avg_logprob": -0.2},
+			{"id": 1, "start": 2.5, "end": 5.04, "text": " Let's begin.", "avg_logprob": -0.3}
+		],
+		"language": "en"
+	}`
+
+	tests := []struct {
+		name   string
+		parse  func([]byte) (*Transcript, error)
+		output string
+	}{
+		{"whisper.cpp", parseWhisperCppJSON, whisperCpp},
+		{"faster-whisper", parseWhisperJSON, fasterWhisper},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.parse([]byte(tt.output))
+			if err != nil {
+				t.Fatalf("parse error = %v", err)
+			}
+			if got.Text != "Hello everyone. Let's begin." {
+				t.Errorf("Text = %q", got.Text)
+			}
+			if len(got.Segments) != len(wantSegments) {
+				t.Fatalf("got %d segments, want %d", len(got.Segments), len(wantSegments))
+			}
+			for i, seg := range got.Segments {
+				if seg != wantSegments[i] {
+					t.Errorf("segment %d = %+v, want %+v", i, seg, wantSegments[i])
+				}
+			}
+		})
+	}
+
+	if _, err := parseWhisperCppJSON([]byte("not json")); err == nil {
+		t.Error("parseWhisperCppJSON() accepted invalid JSON")
+	}
+}
+
+// Test transcriber backend selection
+func TestNewTranscriber(t *testing.T) {
+	modelPath := filepath.Join(t.TempDir(), "ggml-base.en.bin")
+	if err := os.WriteFile(modelPath, []byte("model"), 0644); err != nil {
+		t.Fatalf("Failed to write test model: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		cfg     TranscriberConfig
+		want    string
+		wantErr bool
+	}{
+		{"Default is OpenAI", TranscriberConfig{}, "OpenAI Whisper", false},
+		{"whisper.cpp", TranscriberConfig{Backend: "whisper-cpp", ModelPath: modelPath}, "whisper.cpp (local)", false},
+		{"whisper.cpp missing model path", TranscriberConfig{Backend: "whisper-cpp"}, "", true},
+		{"whisper.cpp model not found", TranscriberConfig{Backend: "whisper-cpp", ModelPath: modelPath + ".missing"}, "", true},
+		{"faster-whisper by name", TranscriberConfig{Backend: "faster-whisper", Model: "large-v3"}, "faster-whisper (local)", false},
+		{"Unknown backend", TranscriberConfig{Backend: "dictaphone"}, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := newTranscriber(tt.cfg, "test-key")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newTranscriber() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && got.Name() != tt.want {
+				t.Errorf("newTranscriber() = %s, want %s", got.Name(), tt.want)
+			}
+		})
+	}
+}
+
+// Test base URL and header resolution for OpenAI-compatible servers
+func TestResolveEndpoint(t *testing.T) {
+	originalConfig := activeConfig
+	defer func() { activeConfig = originalConfig }()
+
+	activeConfig = Config{
+		BaseURL:         "http://gateway.internal/v1/",
+		Headers:         map[string]string{"X-Team": "audio", "X-Env": "prod"},
+		AnthropicAPIKey: "anthropic-key",
+	}
+
+	global, _ := resolveEndpoint(nil, "key")
+	if got := global.url("/chat/completions"); got != "http://gateway.internal/v1/chat/completions" {
+		t.Errorf("global url = %s", got)
+	}
+
+	action := &PostAction{
+		BaseURL: "http://localhost:8080/v1",
+		Headers: map[string]string{"X-Env": "dev"},
+	}
+	endpoint, _ := resolveEndpoint(action, "key")
+	if got := endpoint.url("/chat/completions"); got != "http://localhost:8080/v1/chat/completions" {
+		t.Errorf("action url = %s", got)
+	}
+	// Global headers go to the global base URL only; the action's own server gets its headers
+	if _, leaked := endpoint.Headers["X-Team"]; leaked || endpoint.Headers["X-Env"] != "dev" {
+		t.Errorf("action headers = %v, want only the action's own", endpoint.Headers)
+	}
+	onGlobal, _ := resolveEndpoint(&PostAction{Headers: map[string]string{"X-Env": "dev"}}, "key")
+	if onGlobal.Headers["X-Team"] != "audio" || onGlobal.Headers["X-Env"] != "dev" {
+		t.Errorf("headers on the global base URL = %v, want global headers with action override", onGlobal.Headers)
+	}
+	anthropic, err := resolveAnthropicEndpoint(&PostAction{Type: actionTypeAnthropic})
+	if _, leaked := anthropic.Headers["X-Team"]; err != nil || leaked {
+		t.Errorf("anthropic headers = %v, want no global headers", anthropic.Headers)
+	}
+	if global.Headers["X-Env"] != "prod" {
+		t.Error("action headers leaked into the global config")
+	}
+
+	// The OpenAI key goes to the global base URL only
+	if global.APIKey != "key" || endpoint.APIKey != "" {
+		t.Errorf("keys = %q (global), %q (action), want the OpenAI key on the global URL only", global.APIKey, endpoint.APIKey)
+	}
+	os.Setenv("GOSCRIBE_TEST_LOCAL_KEY", "local-key")
+	defer os.Unsetenv("GOSCRIBE_TEST_LOCAL_KEY")
+	keyed, _ := resolveEndpoint(&PostAction{BaseURL: "http://localhost:8080/v1", APIKey: "${GOSCRIBE_TEST_LOCAL_KEY}"}, "key")
+	if keyed.APIKey != "local-key" {
+		t.Errorf("action api_key = %q, want local-key", keyed.APIKey)
+	}
+	same, _ := resolveEndpoint(&PostAction{BaseURL: "http://gateway.internal/v1/"}, "key")
+	if same.APIKey != "key" {
+		t.Errorf("action on the global base URL got key %q, want the OpenAI key", same.APIKey)
+	}
+
+	// Transcripts from different servers are cached separately
+	gateway := &openAITranscriber{Endpoint: global, Model: "whisper-1"}
+	openAI := &openAITranscriber{Endpoint: apiEndpoint{BaseURL: defaultOpenAIBaseURL}, Model: "whisper-1"}
+	if openAI.CacheID() != "whisper-1" || gateway.CacheID() != "whisper-1@http://gateway.internal/v1" {
+		t.Errorf("cache IDs = %q, %q", openAI.CacheID(), gateway.CacheID())
+	}
+
+	activeConfig = Config{}
+	if got := openAIEndpoint("key").url("/audio/transcriptions"); got != "https://api.openai.com/v1/audio/transcriptions" {
+		t.Errorf("default url = %s", got)
+	}
+}
+
+// Test Azure OpenAI endpoint resolution
+func TestResolveAzureEndpoint(t *testing.T) {
+	originalConfig := activeConfig
+	defer func() { activeConfig = originalConfig }()
+	os.Unsetenv("AZURE_OPENAI_API_KEY")
+
+	activeConfig = Config{
+		Azure: AzureConfig{Endpoint: "https://contoso.openai.azure.com/", APIKey: "azure-key"},
+	}
+
+	action := &PostAction{Type: actionTypeAzureOpenAI, Model: "gpt-4o", APIVersion: "2024-10-21"}
+	endpoint, err := resolveEndpoint(action, "openai-key")
+	if err != nil {
+		t.Fatalf("resolveEndpoint() error = %v", err)
+	}
+	want := "https://contoso.openai.azure.com/openai/deployments/gpt-4o/chat/completions?api-version=2024-10-21"
+	if got := endpoint.url("/chat/completions"); got != want {
+		t.Errorf("url = %s, want %s", got, want)
+	}
+
+	req, err := endpoint.newRequest("POST", "/chat/completions", nil)
+	if err != nil {
+		t.Fatalf("newRequest() error = %v", err)
+	}
+	if req.Header.Get("api-key") != "azure-key" || req.Header.Get("Authorization") != "" {
+		t.Errorf("headers = %v, want api-key only", req.Header)
+	}
+
+	// The action's model wins over the default deployment; without a model, the
+	// default is used
+	activeConfig.Azure.Deployment = "gpt-4o-mini"
+	for model, deployment := range map[string]string{"gpt-4o": "gpt-4o", "": "gpt-4o-mini"} {
+		endpoint, _ = resolveEndpoint(&PostAction{Type: actionTypeAzureOpenAI, Model: model}, "")
+		if want := "https://contoso.openai.azure.com/openai/deployments/" + deployment; endpoint.BaseURL != want {
+			t.Errorf("model %q: base URL = %s, want %s", model, endpoint.BaseURL, want)
+		}
+	}
+
+	// Per-action endpoint and deployment win over the config section
+	action = &PostAction{Type: actionTypeAzureOpenAI, Model: "gpt-4o", Endpoint: "https://other.openai.azure.com", Deployment: "summaries"}
+	endpoint, _ = resolveEndpoint(action, "")
+	want = "https://other.openai.azure.com/openai/deployments/summaries/chat/completions?api-version=" + azureDefaultAPIVersion
+	if got := endpoint.url("/chat/completions"); got != want {
+		t.Errorf("url = %s, want %s", got, want)
+	}
+
+	// Azure transcription uses its own deployment
+	transcriber, err := newTranscriber(TranscriberConfig{Backend: transcriberAzureOpenAI, Deployment: "whisper-prod"}, "")
+	if err != nil {
+		t.Fatalf("newTranscriber() error = %v", err)
+	}
+	want = "https://contoso.openai.azure.com/openai/deployments/whisper-prod/audio/transcriptions?api-version=" + azureDefaultAPIVersion
+	if got := transcriber.(*openAITranscriber).Endpoint.url("/audio/transcriptions"); got != want {
+		t.Errorf("transcription url = %s, want %s", got, want)
+	}
+
+	activeConfig.Azure.APIKey = ""
+	if _, err := resolveEndpoint(action, ""); err == nil {
+		t.Error("resolveEndpoint() accepted an Azure action without an API key")
+	}
+}
+
+// Test chat completion requests against an OpenAI-compatible server
+func TestSendChatCompletion(t *testing.T) {
+	os.Setenv("GOSCRIBE_TEST_TOKEN", "secret")
+	defer os.Unsetenv("GOSCRIBE_TEST_TOKEN")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/chat/completions" {
+			t.Errorf("path = %s", r.URL.Path)
+		}
+		if got := r.Header.Get("Authorization"); got != "Bearer test-key" {
+			t.Errorf("Authorization = %q", got)
+		}
+		if got := r.Header.Get("X-Gateway-Token"); got != "secret" {
+			t.Errorf("X-Gateway-Token = %q, want expanded env var", got)
+		}
+
+		var req ChatCompletionRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Model != "local-model" {
+			t.Errorf("request = %+v, err = %v", req, err)
+		}
+
+		w.Write([]byte(`{"choices": [{"message": {"role": "assistant", "content": "Summary."}}], "usage": {"prompt_tokens": 12, "completion_tokens": 3}}`))
+	}))
+	defer server.Close()
+
+	endpoint := apiEndpoint{
+		BaseURL: server.URL + "/v1",
+		APIKey:  "test-key",
+		Headers: map[string]string{"X-Gateway-Token": "${GOSCRIBE_TEST_TOKEN}"},
+	}
+	got, usage, err := sendChatCompletion(endpoint, ChatCompletionRequest{Model: "local-model"}, io.Discard)
+	if err != nil {
+		t.Fatalf("sendChatCompletion() error = %v", err)
+	}
+	if got != "Summary." {
+		t.Errorf("sendChatCompletion() = %q, want %q", got, "Summary.")
+	}
+	if usage.InputTokens != 12 || usage.OutputTokens != 3 {
+		t.Errorf("sendChatCompletion() usage = %+v, want 12 in / 3 out", usage)
+	}
+}
+
+// Test anthropic actions through the Messages API
+func TestSendActionChatAnthropic(t *testing.T) {
+	originalConfig := activeConfig
+	defer func() { activeConfig = originalConfig }()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/messages" {
+			t.Errorf("path = %s", r.URL.Path)
+		}
+		if r.Header.Get("x-api-key") != "sk-ant-test" || r.Header.Get("anthropic-version") != anthropicAPIVersion {
+			t.Errorf("headers = %v", r.Header)
+		}
+		if r.Header.Get("Authorization") != "" {
+			t.Error("OpenAI key sent to Anthropic")
+		}
+
+		var req AnthropicMessagesRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("failed to decode request: %v", err)
+		}
+		if req.Model != "claude-sonnet-4-5" || req.MaxTokens != 1500 || req.Temperature != 0.3 {
+			t.Errorf("request = %+v", req)
+		}
+		if req.System != "Be brief." || len(req.Messages) != 1 || req.Messages[0].Role != "user" {
+			t.Errorf("system/messages = %q, %+v", req.System, req.Messages)
+		}
+
+		w.Write([]byte(`{"content": [{"type": "text", "text": "Part one. "}, {"type": "text", "text": "Part two."}], "stop_reason": "end_turn"}`))
+	}))
+	defer server.Close()
+
+	activeConfig = Config{AnthropicAPIKey: "sk-ant-test"}
+	action := &PostAction{Type: actionTypeAnthropic, Model: "claude-sonnet-4-5", BaseURL: server.URL + "/v1"}
+	got, err := sendActionChat(action, "sk-openai", ChatCompletionRequest{
+		Model: action.Model,
+		Messages: []Message{
+			{Role: "system", Content: "Be brief."},
+			{Role: "user", Content: "Summarize."},
+		},
+		Temperature: 0.3,
+		MaxTokens:   1500,
+	}, io.Discard)
+	if err != nil {
+		t.Fatalf("sendActionChat() error = %v", err)
+	}
+	if got != "Part one. Part two." {
+		t.Errorf("sendActionChat() = %q", got)
+	}
+
+	activeConfig = Config{}
+	os.Unsetenv("ANTHROPIC_API_KEY")
+	if _, err := sendActionChat(action, "sk-openai", ChatCompletionRequest{}, io.Discard); err == nil {
+		t.Error("sendActionChat() accepted an anthropic action without a key")
+	}
+}
+
+// Test ollama actions against a local server
+func TestSendActionChatOllama(t *testing.T) {
+	originalConfig := activeConfig
+	defer func() { activeConfig = originalConfig }()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/chat" {
+			t.Errorf("path = %s", r.URL.Path)
+		}
+		if r.Header.Get("Authorization") != "" {
+			t.Error("OpenAI key sent to Ollama")
+		}
+
+		var req OllamaChatRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("failed to decode request: %v", err)
+		}
+		if req.Model != "llama3.1" || req.Stream || req.Options.NumPredict != 800 || req.Options.NumCtx != 16384 {
+			t.Errorf("request = %+v", req)
+		}
+
+		w.Write([]byte(`{"model": "llama3.1", "message": {"role": "assistant", "content": "Local summary."}, "done": true}`))
+	}))
+	defer server.Close()
+
+	activeConfig = Config{Ollama: OllamaConfig{Host: server.URL, Model: "llama3.1", ContextWindow: 16384}}
+	action := &PostAction{Type: actionTypeOllama}
+	got, err := sendActionChat(action, "sk-openai", ChatCompletionRequest{
+		Messages:  []Message{{Role: "user", Content: "Summarize."}},
+		MaxTokens: 800,
+	}, io.Discard)
+	if err != nil {
+		t.Fatalf("sendActionChat() error = %v", err)
+	}
+	if got != "Local summary." {
+		t.Errorf("sendActionChat() = %q", got)
+	}
+
+	// Chunks are sized for the configured window, not the model name
+	if limit := getActionContextLimit(&PostAction{Type: actionTypeOllama, MaxTokens: 2000}); limit != 14384 {
+		t.Errorf("getActionContextLimit() = %d, want 14384", limit)
+	}
+}
+
+// Test -provider/-model overrides
+func TestApplyProviderOverride(t *testing.T) {
+	originalConfig := activeConfig
+	defer func() {
+		activeConfig = originalConfig
+		selectionOverride = nil
+	}()
+	activeConfig = Config{Ollama: OllamaConfig{Model: "llama3.1"}}
+
+	newActions := func() []PostAction {
+		return []PostAction{
+			{ID: "openai-hr-meeting", Type: "openai", Model: "gpt-4o", BaseURL: "https://gateway.example.com/v1", Temperature: 0.3},
+			{ID: "creative", Type: "openai", Model: "gpt-4o", Temperature: 1.5},
+		}
+	}
+
+	actions := newActions()
+	if err := applyProviderOverride(actions, "ollama", ""); err != nil {
+		t.Fatalf("applyProviderOverride() error = %v", err)
+	}
+	if actions[0].Type != "ollama" || actions[0].Model != "llama3.1" || actions[0].BaseURL != "" {
+		t.Errorf("action = %+v, want ollama llama3.1 without the old base_url", actions[0])
+	}
+	if selectionOverride == nil || selectionOverride.Type != "ollama" || selectionOverride.Model != "llama3.1" {
+		t.Errorf("selectionOverride = %+v", selectionOverride)
+	}
+
+	actions = newActions()
+	if err := applyProviderOverride(actions, "anthropic", "claude-sonnet-4-5"); err != nil {
+		t.Fatalf("applyProviderOverride() error = %v", err)
+	}
+	if actions[1].Temperature != 1 {
+		t.Errorf("temperature = %v, want clamped to 1 for anthropic", actions[1].Temperature)
+	}
+
+	if err := applyProviderOverride(newActions(), "anthropic", ""); err == nil {
+		t.Error("applyProviderOverride() accepted anthropic without a model")
+	}
+	if err := applyProviderOverride(newActions(), "carrier-pigeon", "x"); err == nil {
+		t.Error("applyProviderOverride() accepted an unknown provider")
+	}
+
+	// max_tokens sized for gpt-4o doesn't fit Ollama's smaller window
+	long := []PostAction{{ID: "long", Type: "openai", Model: "gpt-4o", MaxTokens: 7000}}
+	if err := applyProviderOverride(long, "ollama", ""); err == nil {
+		t.Error("applyProviderOverride() accepted max_tokens that fills the Ollama context window")
+	}
+}
+
+// Test retries, backoff and Retry-After handling in the shared API client
+func TestRetryingClient(t *testing.T) {
+	tests := []struct {
+		name        string
+		statuses    []int
+		retryAfter  string
+		maxAttempts int
+		wantStatus  int
+		wantCalls   int
+		wantSleeps  int
+	}{
+		{"Success first try", []int{200}, "", 4, 200, 1, 0},
+		{"Rate limited then success", []int{429, 200}, "3", 4, 200, 2, 1},
+		{"Server errors then success", []int{502, 503, 200}, "", 4, 200, 3, 2},
+		{"Client error is not retried", []int{400, 200}, "", 4, 400, 1, 0},
+		{"Gives up after max attempts", []int{500, 500, 500, 500}, "", 3, 500, 3, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				if string(body) != "payload" {
+					t.Errorf("attempt %d body = %q, want replayed payload", calls+1, body)
+				}
+				status := tt.statuses[calls]
+				calls++
+				if tt.retryAfter != "" {
+					w.Header().Set("Retry-After", tt.retryAfter)
+				}
+				w.WriteHeader(status)
+				fmt.Fprintf(w, "response %d", calls)
+			}))
+			defer server.Close()
+
+			var sleeps []time.Duration
+			client := newRetryingClient(HTTPConfig{MaxAttempts: tt.maxAttempts})
+			client.sleep = func(d time.Duration) { sleeps = append(sleeps, d) }
+
+			req, _ := http.NewRequest("POST", server.URL, bytes.NewBufferString("payload"))
+			status, body, err := client.send(req, io.Discard)
+			if err != nil {
+				t.Fatalf("send() error = %v", err)
+			}
+			if status != tt.wantStatus || calls != tt.wantCalls || len(sleeps) != tt.wantSleeps {
+				t.Errorf("status = %d, calls = %d, sleeps = %d; want %d, %d, %d",
+					status, calls, len(sleeps), tt.wantStatus, tt.wantCalls, tt.wantSleeps)
+			}
+			if string(body) != fmt.Sprintf("response %d", calls) {
+				t.Errorf("body = %q, want the last response", body)
+			}
+			if tt.retryAfter == "3" && len(sleeps) > 0 && sleeps[0] != 3*time.Second {
+				t.Errorf("slept %v, want Retry-After of 3s", sleeps[0])
+			}
+		})
+	}
+}
+
+// Test Retry-After parsing and backoff bounds
+func TestRetryDelays(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{"", 0},
+		{"10", 10 * time.Second},
+		{"Wed, 01 May 2024 12:00:30 GMT", 30 * time.Second},
+		{"Wed, 01 May 2024 11:59:00 GMT", 0},
+		{"86400", 0},
+		{"soon", 0},
+	}
+	for _, tt := range tests {
+		if got := parseRetryAfter(tt.value, now); got != tt.want {
+			t.Errorf("parseRetryAfter(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+
+	for attempt := 1; attempt <= 10; attempt++ {
+		full := retryBaseDelay << (attempt - 1)
+		if full > retryMaxDelay {
+			full = retryMaxDelay
+		}
+		if got := backoffDelay(attempt); got < full/2 || got > full {
+			t.Errorf("backoffDelay(%d) = %v, want between %v and %v", attempt, got, full/2, full)
+		}
+	}
+}
+
+// fakeChunkServer answers chunk requests with the first sentence of the chunk and merge
+// requests by joining the results in the order they were given, tracking peak concurrency
+func fakeChunkServer(t *testing.T, peak *int32) *httptest.Server {
+	var inFlight int32
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			old := atomic.LoadInt32(peak)
+			if current <= old || atomic.CompareAndSwapInt32(peak, old, current) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+
+		var req ChatCompletionRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("failed to decode request: %v", err)
+		}
+		prompt := req.Messages[0].Content
+
+		var reply string
+		if strings.Contains(prompt, "Chunk results to merge:\n") {
+			parts := strings.SplitN(prompt, "Chunk results to merge:\n", 2)
+			results := strings.SplitN(parts[1], "\n\nProvide the final merged result:", 2)[0]
+			reply = strings.Join(strings.Split(results, "\n\n--- CHUNK BOUNDARY ---\n\n"), "+")
+		} else {
+			transcript := strings.SplitN(prompt, "Transcript:\n", 2)[1]
+			reply = strings.Fields(transcript)[1] // "Sentence 0042 ..." -> "0042"
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"choices": []map[string]interface{}{{"message": map[string]string{"role": "assistant", "content": reply}}},
+		})
+	}))
+}
+
+// Test parallel chunk processing and hierarchical merging keep chunk order
+func TestParallelChunkProcessing(t *testing.T) {
+	originalConfig, originalConcurrency := activeConfig, chunkConcurrency
+	defer func() { activeConfig, chunkConcurrency = originalConfig, originalConcurrency }()
+
+	var peak int32
+	server := fakeChunkServer(t, &peak)
+	defer server.Close()
+	activeConfig = Config{BaseURL: server.URL}
+	chunkConcurrency = 3
+
+	action := &PostAction{Name: "Test", Type: "openai", Prompt: "Summarize.", Model: "gpt-4", MaxTokens: 500}
+
+	var sb strings.Builder
+	for i := 0; i < 3000; i++ {
+		fmt.Fprintf(&sb, "Sentence %04d is about the topic. ", i)
+	}
+
+	got, err := processWithOpenAIChunked(sb.String(), action, "test-key", io.Discard)
+	if err != nil {
+		t.Fatalf("processWithOpenAIChunked() error = %v", err)
+	}
+	parts := strings.Split(got, "+")
+	if len(parts) < 3 || parts[0] != "0000" {
+		t.Fatalf("merged result = %q, want chunk results joined in order", got)
+	}
+	for i := 1; i < len(parts); i++ {
+		if parts[i] <= parts[i-1] {
+			t.Errorf("merged result = %q, chunks out of order", got)
+		}
+	}
+	if peak < 2 || peak > 3 {
+		t.Errorf("peak concurrency = %d, want 2-3", peak)
+	}
+
+	// Each level of a hierarchical merge runs in parallel and keeps order
+	peak = 0
+	got, err = hierarchicalMerge([]string{"a", "b", "c", "d", "e"}, action, "test-key", io.Discard)
+	if err != nil {
+		t.Fatalf("hierarchicalMerge() error = %v", err)
+	}
+	if got != "a+b+c+d+e" {
+		t.Errorf("hierarchicalMerge() = %q, want %q", got, "a+b+c+d+e")
+	}
+	if peak != 2 {
+		t.Errorf("peak concurrency = %d, want 2 pairs merged at once", peak)
+	}
+}
+
+// Test chunked processing stops sending chunks after one fails
+func TestChunkProcessingStopsOnError(t *testing.T) {
+	originalConfig, originalConcurrency := activeConfig, chunkConcurrency
+	defer func() { activeConfig, chunkConcurrency = originalConfig, originalConcurrency }()
+
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error": "bad request"}`))
+	}))
+	defer server.Close()
+	activeConfig = Config{BaseURL: server.URL}
+	chunkConcurrency = 1
+
+	action := &PostAction{Name: "Test", Type: "openai", Prompt: "Summarize.", Model: "gpt-4", MaxTokens: 500}
+
+	var sb strings.Builder
+	for i := 0; i < 3000; i++ {
+		fmt.Fprintf(&sb, "Sentence %04d is about the topic. ", i)
+	}
+
+	if _, err := processWithOpenAIChunked(sb.String(), action, "test-key", io.Discard); err == nil {
+		t.Fatal("processWithOpenAIChunked() succeeded, want an error")
+	}
+	if requests != 1 {
+		t.Errorf("%d chunk requests, want 1 (none after the failure)", requests)
+	}
+
+	requests = 0
+	if _, err := hierarchicalMerge([]string{"a", "b", "c", "d", "e", "f"}, action, "test-key", io.Discard); err == nil {
+		t.Fatal("hierarchicalMerge() succeeded, want an error")
+	}
+	if requests != 1 {
+		t.Errorf("%d merge requests, want 1 (none after the failure)", requests)
+	}
+}
+
+// Test concurrent actions: ordered output, independent failures and timings
+func TestRunActions(t *testing.T) {
+	originalConfig := activeConfig
+	defer func() { activeConfig = originalConfig }()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req ChatCompletionRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		switch req.Model {
+		case "slow":
+			time.Sleep(50 * time.Millisecond)
+		case "broken":
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error": "bad model"}`))
+			return
+		}
+		fmt.Fprintf(w, `{"choices": [{"message": {"role": "assistant", "content": "output of %s"}}]}`, req.Model)
+	}))
+	defer server.Close()
+	activeConfig = Config{BaseURL: server.URL}
+
+	actions := []*PostAction{
+		{ID: "first", Name: "First", Type: "openai", Model: "slow", Prompt: "p", MaxTokens: 100},
+		{ID: "second", Name: "Second", Type: "openai", Model: "broken", Prompt: "p", MaxTokens: 100},
+		{ID: "third", Name: "Third", Type: "openai", Model: "fast", Prompt: "p", MaxTokens: 100},
+	}
+	dir := t.TempDir()
+	outputFile := func(action *PostAction) string { return filepath.Join(dir, action.ID+".txt") }
+
+	var out bytes.Buffer
+	results := runActions(actions, "transcript", "test-key", 3, outputFile, &out)
+
+	if len(results) != 3 {
+		t.Fatalf("got %d results, want 3", len(results))
+	}
+	for i, result := range results {
+		if result.Action != actions[i] {
+			t.Errorf("result %d is for %s, want %s", i, result.Action.ID, actions[i].ID)
+		}
+		if result.Duration <= 0 {
+			t.Errorf("result %d has no duration", i)
+		}
+	}
+	if results[0].Err != nil || results[2].Err != nil {
+		t.Errorf("successful actions failed: %v, %v", results[0].Err, results[2].Err)
+	}
+	if results[1].Err == nil || results[1].File != "" {
+		t.Errorf("broken action result = %+v, want an error", results[1])
+	}
+	if data, err := os.ReadFile(results[2].File); err != nil || string(data) != "output of fast" {
+		t.Errorf("third output = %q, %v", data, err)
+	}
+
+	// The slow first action finishes last but its output still comes first
+	console := out.String()
+	first := strings.Index(console, "[1/3] Applying post-processing: First")
+	second := strings.Index(console, "[2/3] Applying post-processing: Second")
+	third := strings.Index(console, "[3/3] Applying post-processing: Third")
+	if first < 0 || second < first || third < second {
+		t.Errorf("console output out of order:\n%s", console)
+	}
+	if !strings.Contains(console[second:third], "Post-processing failed") {
+		t.Errorf("failure not reported under its own action:\n%s", console)
+	}
+}
+
+// Test the pre-tokenizers against splits produced by the reference regexes
+func TestSplitPreTokenizers(t *testing.T) {
+	tests := []struct {
+		name  string
+		split func(string) []string
+		input string
+		want  []string
+	}{
+		{"cl100k words", splitCl100k, "Hello, world!", []string{"Hello", ",", " world", "!"}},
+		{"cl100k contraction", splitCl100k, "I'm here, don't", []string{"I", "'m", " here", ",", " don", "'t"}},
+		{"cl100k spaces", splitCl100k, "  two  spaces", []string{" ", " two", " ", " spaces"}},
+		{"cl100k trailing spaces", splitCl100k, "end   ", []string{"end", "   "}},
+		{"cl100k numbers", splitCl100k, "line12345", []string{"line", "123", "45"}},
+		{"cl100k newlines", splitCl100k, "a  \n\n b", []string{"a", "  \n\n", " b"}},
+		{"cl100k punctuation", splitCl100k, "wait... (ok)\n", []string{"wait", "...", " (", "ok", ")\n"}},
+		{"cl100k unicode", splitCl100k, "café ça", []string{"café", " ça"}},
+		{"o200k case split", splitO200k, "HelloWorld", []string{"Hello", "World"}},
+		{"o200k upper run", splitO200k, "HELLO world", []string{"HELLO", " world"}},
+		{"o200k acronym", splitO200k, "getHTTPServer", []string{"get", "HTTPServer"}},
+		{"o200k contraction", splitO200k, "don't You'll", []string{"don't", " You'll"}},
+		{"o200k slashes", splitO200k, "path/to //\n", []string{"path", "/to", " //\n"}},
+		{"o200k numbers", splitO200k, "v1234", []string{"v", "123", "4"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.split(tt.input)
+			if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+				t.Errorf("split(%q) = %q, want %q", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+// tiktokenFile builds a rank file holding every single byte plus the given merges
+func tiktokenFile(merges ...string) []byte {
+	var sb strings.Builder
+	rank := 0
+	for b := 0; b < 256; b++ {
+		fmt.Fprintf(&sb, "%s %d\n", base64.StdEncoding.EncodeToString([]byte{byte(b)}), rank)
+		rank++
+	}
+	for _, merge := range merges {
+		fmt.Fprintf(&sb, "%s %d\n", base64.StdEncoding.EncodeToString([]byte(merge)), rank)
+		rank++
+	}
+	return []byte(sb.String())
+}
+
+// resetEncodings forgets loaded tokenizers and fallback warnings
+func resetEncodings() {
+	encodingsMu.Lock()
+	encodings = map[string]*loadedEncoding{}
+	encodingsMu.Unlock()
+	tokenizerFallbacks.Range(func(key, _ any) bool {
+		tokenizerFallbacks.Delete(key)
+		return true
+	})
+}
+
+// Test byte pair merging, model selection and loading rank files
+func TestCountTokens(t *testing.T) {
+	ranks, err := parseRanks(tiktokenFile("ab", "abc", "bc"))
+	if err != nil {
+		t.Fatalf("parseRanks() error = %v", err)
+	}
+	encoding := &bpeEncoding{ranks: ranks, split: splitCl100k}
+	for piece, want := range map[string]int{"abc": 1, "abcd": 2, "bcab": 2, " abc": 2, "xyz": 3} {
+		if got := encoding.countPieceTokens(piece); got != want {
+			t.Errorf("countPieceTokens(%q) = %d, want %d", piece, got, want)
+		}
+	}
+	if _, err := parseRanks([]byte("not-a-rank-line\n")); err == nil {
+		t.Error("parseRanks() accepted an invalid line")
+	}
+
+	for model, want := range map[string]string{
+		"gpt-4o-mini": encodingO200k, "gpt-4.1": encodingO200k, "o3-mini": encodingO200k,
+		"gpt-4": encodingCl100k, "gpt-3.5-turbo": encodingCl100k, "claude-sonnet-4-5": encodingCl100k, "": encodingCl100k,
+	} {
+		if got := encodingForModel(model); got != want {
+			t.Errorf("encodingForModel(%q) = %q, want %q", model, got, want)
+		}
+	}
+
+	// The embedded vocabularies are the published ones and count like tiktoken
+	for name, want := range map[string]string{
+		encodingCl100k: "223921b76ee99bde995b7ff738513eef100fb51d18c93597a113bcffe865b2a7",
+		encodingO200k:  "446a9538cb6c348e3516120d7c08b09f57c36495e2acfffe59a5bf8b0cfb1a2d",
+	} {
+		data, err := tokenizerFiles.ReadFile("tokenizers/" + name + ".tiktoken")
+		if err != nil {
+			t.Fatalf("%s not embedded: %v", name, err)
+		}
+		if sum := sha256.Sum256(data); hex.EncodeToString(sum[:]) != want {
+			t.Errorf("%s does not match its published SHA-256", name)
+		}
+	}
+
+	cl100k, err := getEncoding(encodingCl100k)
+	if err != nil {
+		t.Fatalf("getEncoding() error = %v", err)
+	}
+	if cl100k.ranks["hello"] != 15339 || cl100k.ranks[" world"] != 1917 {
+		t.Errorf("cl100k_base ranks = %d, %d, want 15339, 1917", cl100k.ranks["hello"], cl100k.ranks[" world"])
+	}
+	tests := []struct {
+		text  string
+		model string
+		want  int
+	}{
+		{"hello world", "gpt-4", 2},
+		{"tiktoken is great!", "gpt-4", 6},
+		{"antidisestablishmentarianism", "gpt-4", 6},
+		{"hello world", "gpt-4o", 2},
+	}
+	for _, tt := range tests {
+		if got := countTokens(tt.text, tt.model); got != tt.want {
+			t.Errorf("countTokens(%q, %s) = %d, want %d", tt.text, tt.model, got, tt.want)
+		}
+	}
+	if _, err := getEncoding("p50k_base"); err == nil {
+		t.Error("getEncoding() loaded an encoding that isn't embedded")
+	}
+}
+
+// Test model registry lookups, config overrides and context limits
+func TestModelRegistry(t *testing.T) {
+	originalConfig := activeConfig
+	defer func() { activeConfig = originalConfig }()
+
+	activeConfig = Config{}
+	if err := yaml.Unmarshal([]byte(`models:
+  gpt-4o:
+    input_price: 5
+  gpt-4.1:
+    input_price: 0
+  my-finetune:
+    context_window: 32000
+    max_output: 4000
+    encoding: o200k_base
+`), &activeConfig); err != nil {
+		t.Fatalf("yaml.Unmarshal() error = %v", err)
+	}
+
+	tests := []struct {
+		model   string
+		known   bool
+		window  int
+		enc     string
+		inPrice float64
+	}{
+		{"gpt-4", true, 8192, encodingCl100k, 30},
+		{"gpt-4-0613", true, 8192, encodingCl100k, 30},
+		{"gpt-4-turbo-2024-04-09", true, 128000, encodingCl100k, 10},
+		{"gpt-4o", true, 128000, encodingO200k, 5},                    // Config overrides one field
+		{"gpt-4o-2024-08-06", true, 128000, encodingO200k, 5},         // Dated variant of the override
+		{"gpt-4o-mini-2024-07-18", true, 128000, encodingO200k, 0.15}, // Longer built-in key wins
+		{"gpt-4.1", true, 1047576, encodingO200k, 0},                  // An explicit 0 applies
+		{"ft:gpt-4o-mini:acme::abc123", true, 128000, encodingO200k, 0.15},
+		{"claude-sonnet-4-5-20250929", true, 200000, encodingCl100k, 3},
+		{"claude-3-opus-20240229", true, 200000, encodingCl100k, 0},
+		{"my-finetune", true, 32000, encodingO200k, 0},
+		{"gpt-4oops", false, defaultModelContextWindow, encodingCl100k, 0},
+		{"llama3.1", false, defaultModelContextWindow, encodingCl100k, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.model, func(t *testing.T) {
+			if _, known := lookupModel(activeConfig.Models, tt.model); known != tt.known {
+				t.Errorf("lookupModel() known = %v, want %v", known, tt.known)
+			}
+			info := modelInfo(tt.model)
+			if info.ContextWindow != tt.window || info.Encoding != tt.enc || info.InputPrice != tt.inPrice {
+				t.Errorf("modelInfo() = %+v, want window %d, encoding %s, input price %v", info, tt.window, tt.enc, tt.inPrice)
+			}
+		})
+	}
+
+	// The response's max_tokens is reserved; together they never exceed the window
+	if limit := getActionContextLimit(&PostAction{Model: "gpt-4", MaxTokens: 1500}); limit != 6692 {
+		t.Errorf("getActionContextLimit() = %d, want 6692", limit)
+	}
+	if limit := getActionContextLimit(&PostAction{Model: "gpt-4", MaxTokens: 6000}); limit != 2192 {
+		t.Errorf("getActionContextLimit() = %d, want 2192", limit)
+	}
+	if err := checkContextRoom(&activeConfig, &PostAction{ID: "long", Model: "gpt-4", MaxTokens: 7000}); err == nil {
+		t.Error("checkContextRoom() accepted max_tokens that leaves 1192 tokens for input")
+	}
+	if err := checkContextRoom(&activeConfig, &PostAction{ID: "long", Model: "gpt-4o", MaxTokens: 7000}); err != nil {
+		t.Errorf("checkContextRoom() error = %v", err)
+	}
+
+	negative, small, large, huge, price := -1, 1000, 2000, 10000, -0.5
+	invalid := []map[string]ModelOverride{
+		{"bad": {ContextWindow: &negative}},
+		{"bad": {ContextWindow: &small, MaxOutput: &large}},
+		{"gpt-4": {MaxOutput: &huge}}, // Larger than the built-in context window
+		{"bad": {Encoding: "p50k_base"}},
+		{"bad": {InputPrice: &price}},
+	}
+	for _, models := range invalid {
+		if err := validateModels(models); err == nil {
+			t.Errorf("validateModels(%+v) accepted an invalid entry", models)
+		}
+	}
+	if err := validateModels(activeConfig.Models); err != nil {
+		t.Errorf("validateModels() error = %v", err)
+	}
+}
+
+// Test dry-run estimates match the requests a real run sends
+func TestEstimateAction(t *testing.T) {
+	originalConfig := activeConfig
+	defer func() { activeConfig = originalConfig }()
+
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"choices": []map[string]interface{}{{"message": map[string]string{"role": "assistant", "content": "ok"}}},
+		})
+	}))
+	defer server.Close()
+	activeConfig = Config{BaseURL: server.URL}
+
+	action := &PostAction{ID: "summary", Type: "openai", Prompt: "Summarize.", Model: "gpt-4", MaxTokens: 100}
+	var sb strings.Builder
+	for i := 0; i < 3000; i++ {
+		fmt.Fprintf(&sb, "Sentence %04d is about the topic. ", i)
+	}
+
+	est := estimateAction(action, sb.String(), 0)
+	if _, err := processWithOpenAIChunked(sb.String(), action, "test-key", io.Discard); err != nil {
+		t.Fatalf("processWithOpenAIChunked() error = %v", err)
+	}
+	if est.Calls < 3 || est.Calls != int(requests) {
+		t.Errorf("estimated %d calls, run sent %d", est.Calls, requests)
+	}
+	if !est.Priced || est.OutputTokens != est.Calls*100 {
+		t.Errorf("estimate = %+v, want priced with max_tokens per call", est)
+	}
+	if want := float64(est.InputTokens)*30/1e6 + float64(est.OutputTokens)*60/1e6; est.Cost != want {
+		t.Errorf("cost = %v, want %v", est.Cost, want)
+	}
+
+	if est := estimateAction(action, "A short meeting.", 0); est.Calls != 1 || est.Note != "" {
+		t.Errorf("short transcript estimate = %+v, want a single call", est)
+	}
+
+	// Before transcription the token count is estimated; long results merge in pairs
+	long := &PostAction{ID: "report", Type: "openai", Prompt: "Write a report.", Model: "gpt-4", MaxTokens: 3000}
+	if est := estimateAction(long, "", 20000); est.Calls != 9 || est.Note != "5 chunks + 4 hierarchical merges" {
+		t.Errorf("estimate = %+v, want 5 chunks and 4 merges", est)
+	}
+	long.Schema = map[string]interface{}{"type": "object"}
+	if est := estimateAction(long, "", 20000); est.Calls != 5 || est.Note != "5 chunks, merged locally" {
+		t.Errorf("structured estimate = %+v, want 5 chunks and no merges", est)
+	}
+
+	local := &PostAction{ID: "local", Type: actionTypeOllama, Prompt: "Summarize.", Model: "llama3.1", MaxTokens: 500}
+	if est := estimateAction(local, "A short meeting.", 0); !est.Local {
+		t.Errorf("ollama estimate = %+v, want local", est)
+	}
+}
+
+// Test transcription pricing and the estimate table
+func TestCostEstimates(t *testing.T) {
+	originalConfig := activeConfig
+	defer func() { activeConfig = originalConfig }()
+	activeConfig = Config{}
+
+	plan := transcriptionPlan{Duration: 3600, Chunks: 3, ChunkSeconds: 1500}
+	est := estimateTranscription(plan, &openAITranscriber{Model: "whisper-1"}, 6)
+	if est.Calls != 3 || est.AudioMinutes != 60.2 || !est.Priced {
+		t.Errorf("estimate = %+v, want 3 calls over 60.2 minutes", est)
+	}
+	if want := 60.2 * 0.006; est.Cost < want-1e-9 || est.Cost > want+1e-9 {
+		t.Errorf("cost = %v, want %v", est.Cost, want)
+	}
+	if local := estimateTranscription(plan, &whisperCppTranscriber{}, 0); !local.Local || local.Priced {
+		t.Errorf("local estimate = %+v, want local", local)
+	}
+
+	var out bytes.Buffer
+	printCostEstimates([]costEstimate{
+		est,
+		{Step: "summary", Model: "gpt-4o", Calls: 1, InputTokens: 1000, OutputTokens: 500, Cost: 0.0075, Priced: true},
+		{Step: "custom", Model: "my-model", Calls: 2, InputTokens: 10, OutputTokens: 10},
+	}, &out)
+	for _, want := range []string{"transcription", "60.2 min", "$0.36", "$0.01", "no price", "Total", "6", "1 step(s) have no price"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("table missing %q:\n%s", want, out.String())
+		}
+	}
+}
+
+// Test usage recording from chat calls and transcriptions
+func TestUsageTracking(t *testing.T) {
+	originalConfig, originalUsage := activeConfig, runUsage
+	defer func() { activeConfig, runUsage = originalConfig, originalUsage }()
+	activeConfig = Config{}
+	runUsage = &usageTracker{}
+
+	// Concurrent chunk calls add up into one record per step and model
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runUsage.addChat("summary", "gpt-4o", tokenUsage{InputTokens: 1000, OutputTokens: 100}, false)
+		}()
+	}
+	wg.Wait()
+	runUsage.addChat("summary", "my-model", tokenUsage{InputTokens: 10, OutputTokens: 10}, false)
+	runUsage.addAudio("whisper-1", 600, false)
+	runUsage.addAudio("whisper.cpp", 60, true)
+
+	summary, ok := runUsage.step("summary")
+	if !ok || summary.Calls != 21 || summary.InputTokens != 20010 || summary.OutputTokens != 2010 {
+		t.Errorf("summary usage = %+v", summary)
+	}
+	if want := 20000*2.5/1e6 + 2000*10/1e6; summary.Cost < want-1e-9 || summary.Cost > want+1e-9 || !summary.Unpriced {
+		t.Errorf("summary cost = %v (unpriced %v), want %v and unpriced", summary.Cost, summary.Unpriced, want)
+	}
+	transcription, _ := runUsage.step(usageStepTranscription)
+	if transcription.AudioSeconds != 660 || transcription.Calls != 2 || transcription.Unpriced {
+		t.Errorf("transcription usage = %+v", transcription)
+	}
+	if want := 10 * 0.006; transcription.Cost < want-1e-9 || transcription.Cost > want+1e-9 {
+		t.Errorf("transcription cost = %v, want %v", transcription.Cost, want)
+	}
+	if got := formatUsage(transcription); got != "11.0 min audio, $0.06" {
+		t.Errorf("formatUsage() = %q", got)
+	}
+
+	// Reported usage is recorded as is; without it, tokens are counted locally
+	reportUsage := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if reportUsage {
+			w.Write([]byte(`{"choices": [{"message": {"content": "Done."}}], "usage": {"prompt_tokens": 50, "completion_tokens": 5}}`))
+		} else {
+			w.Write([]byte(`{"choices": [{"message": {"content": "Done."}}]}`))
+		}
+	}))
+	defer server.Close()
+
+	runUsage = &usageTracker{}
+	action := &PostAction{ID: "notes", Type: "openai", Model: "gpt-4o-mini", BaseURL: server.URL}
+	req := ChatCompletionRequest{Model: "gpt-4o-mini", Messages: []Message{{Role: "user", Content: "Summarize these notes."}}}
+	if _, err := sendActionChat(action, "sk-test", req, io.Discard); err != nil {
+		t.Fatalf("sendActionChat() error = %v", err)
+	}
+	if notes, _ := runUsage.step("notes"); notes.InputTokens != 50 || notes.OutputTokens != 5 || notes.Estimated {
+		t.Errorf("reported usage = %+v, want 50 in / 5 out", notes)
+	}
+
+	reportUsage = false
+	if _, err := sendActionChat(&PostAction{Type: "openai", Model: "gpt-4o-mini", BaseURL: server.URL}, "sk-test", req, io.Discard); err != nil {
+		t.Fatalf("sendActionChat() error = %v", err)
+	}
+	selection, ok := runUsage.step(usageStepAutoSelect)
+	// Counted with gpt-4o-mini's o200k_base vocabulary
+	if !ok || !selection.Estimated || selection.InputTokens != 6 || selection.OutputTokens != 2 {
+		t.Errorf("counted usage = %+v", selection)
+	}
+}
+
+// Test the usage ledger and the usage report
+func TestUsageLedger(t *testing.T) {
+	tempDir := t.TempDir()
+	originalHome := os.Getenv("HOME")
+	defer os.Setenv("HOME", originalHome)
+	os.Setenv("HOME", tempDir)
+
+	runs := []ledgerEntry{
+		{Time: time.Date(2025, 1, 30, 10, 0, 0, 0, time.Local), Inputs: []string{"a.mp3"}, Steps: []usageRecord{
+			{Step: "transcription", Model: "whisper-1", Calls: 1, AudioSeconds: 600, Cost: 0.06},
+			{Step: "summary", Model: "gpt-4o", Calls: 2, InputTokens: 1000, OutputTokens: 200, Cost: 0.0045},
+		}},
+		{Time: time.Date(2025, 1, 31, 10, 0, 0, 0, time.Local), Inputs: []string{"b.txt"}, Steps: []usageRecord{
+			{Step: "summary", Model: "gpt-4o", Calls: 1, InputTokens: 500, OutputTokens: 100, Cost: 0.00225},
+		}},
+		{Time: time.Date(2025, 2, 1, 10, 0, 0, 0, time.Local), Inputs: []string{"c.txt"}, Steps: []usageRecord{
+			{Step: "notes", Model: "my-model", Calls: 1, InputTokens: 10, OutputTokens: 10, Unpriced: true},
+		}},
+	}
+	for _, run := range runs {
+		if err := appendUsageLedger(run); err != nil {
+			t.Fatalf("appendUsageLedger() error = %v", err)
+		}
+	}
+
+	path, _ := usageLedgerPath()
+	entries, err := readUsageLedger(path)
+	if err != nil || len(entries) != 3 {
+		t.Fatalf("readUsageLedger() = %d entries, err = %v", len(entries), err)
+	}
+	if entries[0].Cost < 0.0645-1e-9 || entries[0].Cost > 0.0645+1e-9 {
+		t.Errorf("entry cost = %v, want 0.0645", entries[0].Cost)
+	}
+
+	tests := []struct {
+		name    string
+		args    []string
+		want    []string
+		notWant []string
+		wantErr bool
+	}{
+		{name: "by day", args: nil, want: []string{"2025-01-30", "2025-01-31", "2025-02-01", "Total", "$0.07", "no price"}},
+		{name: "by month", args: []string{"-by", "month"}, want: []string{"2025-01  ", "2025-02", "10.0"}, notWant: []string{"2025-01-30"}},
+		{name: "since", args: []string{"-since", "2025-01-31"}, want: []string{"2025-01-31", "$0.00"}, notWant: []string{"2025-01-30"}},
+		{name: "by model", args: []string{"-by", "month", "-models"}, want: []string{"whisper-1", "gpt-4o", "my-model"}},
+		{name: "invalid period", args: []string{"-by", "week"}, wantErr: true},
+		{name: "invalid since", args: []string{"-since", "January"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			err := runUsageCommand(tt.args, &out)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("runUsageCommand() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(out.String(), want) {
+					t.Errorf("report missing %q:\n%s", want, out.String())
+				}
+			}
+			for _, notWant := range tt.notWant {
+				if strings.Contains(out.String(), notWant) {
+					t.Errorf("report contains %q:\n%s", notWant, out.String())
+				}
+			}
+		})
+	}
+}
+
+// Test spending caps: setup from config, flags and the ledger, and stopping with partial output
+func TestSpendingBudget(t *testing.T) {
+	tempDir := t.TempDir()
+	originalHome := os.Getenv("HOME")
+	originalConfig, originalUsage, originalBudget, originalConcurrency := activeConfig, runUsage, runBudget, chunkConcurrency
+	defer func() {
+		os.Setenv("HOME", originalHome)
+		activeConfig, runUsage, runBudget, chunkConcurrency = originalConfig, originalUsage, originalBudget, originalConcurrency
+	}()
+	os.Setenv("HOME", tempDir)
+
+	now := time.Date(2025, 3, 15, 12, 0, 0, 0, time.Local)
+	for _, entry := range []ledgerEntry{
+		{Time: now.AddDate(0, 0, -5), Profile: "/work.yml", Steps: []usageRecord{{Cost: 6}}},
+		{Time: now.AddDate(0, -1, 0), Profile: "/work.yml", Steps: []usageRecord{{Cost: 50}}}, // Last month
+		{Time: now.AddDate(0, 0, -1), Profile: "/home.yml", Steps: []usageRecord{{Cost: 50}}}, // Other profile
+	} {
+		if err := appendUsageLedger(entry); err != nil {
+			t.Fatalf("appendUsageLedger() error = %v", err)
+		}
+	}
+
+	tests := []struct {
+		name      string
+		config    BudgetConfig
+		maxCost   float64
+		maxTokens int
+		wantCost  float64
+		wantNil   bool
+		wantErr   bool
+	}{
+		{name: "no caps", wantNil: true},
+		{name: "config", config: BudgetConfig{MaxCost: 2, MaxTokens: 1000}, wantCost: 2},
+		{name: "flag overrides config", config: BudgetConfig{MaxCost: 2}, maxCost: 5, wantCost: 5},
+		{name: "monthly remainder", config: BudgetConfig{MaxCost: 5, MonthlyMaxCost: 10}, wantCost: 4},
+		{name: "monthly above run cap", config: BudgetConfig{MaxCost: 1, MonthlyMaxCost: 10}, wantCost: 1},
+		{name: "monthly used up", config: BudgetConfig{MonthlyMaxCost: 6}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			budget, err := newSpendingBudget(tt.config, tt.maxCost, tt.maxTokens, "/work.yml", now)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newSpendingBudget() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				if !errors.Is(err, errBudgetExceeded) {
+					t.Errorf("error = %v, want errBudgetExceeded", err)
+				}
+				return
+			}
+			if (budget == nil) != tt.wantNil {
+				t.Fatalf("newSpendingBudget() = %+v, wantNil %v", budget, tt.wantNil)
+			}
+			if budget != nil && (budget.maxCost < tt.wantCost-1e-9 || budget.maxCost > tt.wantCost+1e-9) {
+				t.Errorf("maxCost = %v, want %v", budget.maxCost, tt.wantCost)
+			}
+		})
+	}
+
+	var peak int32
+	server := fakeChunkServer(t, &peak)
+	defer server.Close()
+	activeConfig = Config{BaseURL: server.URL}
+	chunkConcurrency = 1
+
+	var sb strings.Builder
+	for i := 0; i < 3000; i++ {
+		fmt.Fprintf(&sb, "Sentence %04d is about the topic. ", i)
+	}
+	action := &PostAction{ID: "notes", Name: "Notes", Type: "openai", Prompt: "Summarize.", Model: "gpt-4", MaxTokens: 500}
+
+	// A token cap stops a chunked action part way; the chunks done are saved as .partial
+	runUsage = &usageTracker{}
+	runBudget = &spendingBudget{maxTokens: 17000}
+	filename := filepath.Join(tempDir, "meeting-notes.txt")
+	result := runAction(action, 0, 1, sb.String(), "test-key", filename, io.Discard)
+	if !errors.Is(result.Err, errBudgetExceeded) {
+		t.Fatalf("runAction() error = %v, want errBudgetExceeded", result.Err)
+	}
+	if want := filepath.Join(tempDir, "meeting-notes.partial.txt"); result.File != want {
+		t.Fatalf("runAction() file = %q, want %q", result.File, want)
+	}
+	partial, _ := os.ReadFile(result.File)
+	if !strings.HasPrefix(string(partial), "0000") || strings.Contains(string(partial), "+") {
+		t.Errorf("partial output = %q, want the first chunk results unmerged", partial)
+	}
+	if usage, _ := runUsage.step("notes"); usage.Calls != 2 || usage.InputTokens+usage.OutputTokens > 17000 {
+		t.Errorf("usage = %+v, want 2 calls within 17000 tokens", usage)
+	}
+	if !budgetReached() {
+		t.Error("budgetReached() = false after stopping")
+	}
+
+	// A cost cap can't be enforced for a model without a price, so nothing is sent
+	runUsage = &usageTracker{}
+	runBudget = &spendingBudget{maxCost: 1}
+	unpriced := &PostAction{ID: "custom", Type: "openai", Model: "my-model", BaseURL: server.URL, MaxTokens: 100}
+	if _, err := processWithOpenAI("Short transcript.", unpriced, "test-key", io.Discard); !errors.Is(err, errBudgetExceeded) {
+		t.Errorf("processWithOpenAI() error = %v, want errBudgetExceeded", err)
+	}
+	if len(runUsage.snapshot()) != 0 {
+		t.Errorf("usage = %+v, want no calls", runUsage.snapshot())
+	}
+
+	// Configured with a zero price, the same model runs under both caps
+	free := 0.0
+	activeConfig.Models = map[string]ModelOverride{"my-model": {InputPrice: &free, OutputPrice: &free}}
+	runBudget = &spendingBudget{maxCost: 1}
+	if _, err := processWithOpenAI("Short transcript.", unpriced, "test-key", io.Discard); err != nil {
+		t.Errorf("processWithOpenAI() for a free model error = %v", err)
+	}
+	if usage, _ := runUsage.step("custom"); usage.Calls != 1 || usage.Cost != 0 || usage.Unpriced {
+		t.Errorf("usage = %+v, want 1 priced call costing $0", usage)
+	}
+	activeConfig.Models = nil
+
+	// Local models are free and ignore the caps
+	runBudget = &spendingBudget{maxCost: 0.01, maxTokens: 1}
+	release, err := reserveChat("llama3.1", ChatCompletionRequest{MaxTokens: 1000}, true)
+	if err != nil {
+		t.Errorf("reserveChat() for a local model error = %v", err)
+	} else {
+		release()
+	}
+
+	if got := partialFilename("dir/talk-transcript.txt"); got != "dir/talk-transcript.partial.txt" {
+		t.Errorf("partialFilename() = %q", got)
+	}
+}
+
+// Test the response cache: hits skip the request, any request change misses, and prune
+func TestResponseCache(t *testing.T) {
+	tempDir := t.TempDir()
+	originalHome := os.Getenv("HOME")
+	originalConfig, originalUsage, originalNoCache := activeConfig, runUsage, noResponseCache
+	defer func() {
+		os.Setenv("HOME", originalHome)
+		activeConfig, runUsage, noResponseCache = originalConfig, originalUsage, originalNoCache
+	}()
+	os.Setenv("HOME", tempDir)
+	activeConfig = Config{}
+	runUsage = &usageTracker{}
+	noResponseCache = false
+
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&requests, 1)
+		fmt.Fprintf(w, `{"choices": [{"message": {"content": "Reply %d"}}]}`, n)
+	}))
+	defer server.Close()
+
+	action := &PostAction{ID: "summary", Type: "openai", Model: "gpt-4o", BaseURL: server.URL, Prompt: "Summarize.", Temperature: 0.5, MaxTokens: 500}
+	first, err := processWithOpenAI("The transcript.", action, "test-key", io.Discard)
+	if err != nil {
+		t.Fatalf("processWithOpenAI() error = %v", err)
+	}
+
+	var out bytes.Buffer
+	second, err := processWithOpenAI("The transcript.", action, "test-key", &out)
+	if err != nil || second != first || requests != 1 {
+		t.Errorf("repeat = %q, %v after %d requests, want %q from the cache", second, err, requests, first)
+	}
+	if !strings.Contains(out.String(), "Using cached response") {
+		t.Errorf("output = %q, want cache hit reported", out.String())
+	}
+	if usage, _ := runUsage.step("summary"); usage.Calls != 1 {
+		t.Errorf("usage calls = %d, want cache hits not recorded", usage.Calls)
+	}
+
+	// Anything that shapes the reply is part of the key
+	changes := []func(a *PostAction){
+		func(a *PostAction) { a.Model = "gpt-4o-mini" },
+		func(a *PostAction) { a.Prompt = "List decisions." },
+		func(a *PostAction) { a.Temperature = 0.7 },
+		func(a *PostAction) { a.MaxTokens = 800 },
+	}
+	for i, change := range changes {
+		changed := *action
+		change(&changed)
+		if _, err := processWithOpenAI("The transcript.", &changed, "test-key", io.Discard); err != nil {
+			t.Fatalf("processWithOpenAI() error = %v", err)
+		}
+		if want := int32(i + 2); requests != want {
+			t.Errorf("change %d: %d requests, want %d (cache miss)", i, requests, want)
+		}
+	}
+	if _, err := processWithOpenAI("Another transcript.", action, "test-key", io.Discard); err != nil || requests != 6 {
+		t.Errorf("new input: %d requests, err = %v, want a cache miss", requests, err)
+	}
+
+	// Merges are cached too
+	for i := 0; i < 2; i++ {
+		if _, err := mergeChunkResults([]string{"a", "b"}, action, "test-key", io.Discard); err != nil {
+			t.Fatalf("mergeChunkResults() error = %v", err)
+		}
+	}
+	if requests != 7 {
+		t.Errorf("%d requests after merging twice, want 7", requests)
+	}
+
+	// -no-cache always sends
+	noResponseCache = true
+	if _, err := processWithOpenAI("The transcript.", action, "test-key", io.Discard); err != nil || requests != 8 {
+		t.Errorf("-no-cache: %d requests, err = %v, want 8", requests, err)
+	}
+
+	// Prune removes entries by last use
+	dir, _ := getCacheDir("responses")
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 7 {
+		t.Fatalf("%d cache entries, want 7", len(entries))
+	}
+	old := time.Now().Add(-40 * 24 * time.Hour)
+	for _, entry := range entries[:3] {
+		os.Chtimes(filepath.Join(dir, entry.Name()), old, old)
+	}
+
+	out.Reset()
+	if err := runCacheCommand([]string{"prune", "-older-than", "30d"}, &out); err != nil {
+		t.Fatalf("runCacheCommand() error = %v", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 4 || !strings.Contains(out.String(), "Removed 3 cache entries") {
+		t.Errorf("after prune: %d entries, output %q, want 4 left", len(entries), out.String())
+	}
+	if err := runCacheCommand([]string{"prune", "-all", "-kind", "responses"}, io.Discard); err != nil {
+		t.Fatalf("runCacheCommand() error = %v", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("after prune -all: %d entries, want 0", len(entries))
+	}
+
+	for _, args := range [][]string{nil, {"clear"}, {"prune", "-older-than", "soon"}, {"prune", "-kind", "models"}} {
+		if err := runCacheCommand(args, io.Discard); err == nil {
+			t.Errorf("runCacheCommand(%q) succeeded, want error", args)
+		}
+	}
+
+	// The key follows the resolved endpoint: Azure deployments, api-versions and
+	// request headers each get their own entries
+	noResponseCache = false
+	activeConfig.Azure = AzureConfig{Endpoint: server.URL, APIKey: "azure-key"}
+	azure := &PostAction{ID: "summary", Type: actionTypeAzureOpenAI, Model: "gpt-4o", Deployment: "notes-east", Prompt: "Summarize.", MaxTokens: 500}
+	endpointChanges := []func(a *PostAction){
+		func(a *PostAction) {},
+		func(a *PostAction) { a.Deployment = "notes-west" },
+		func(a *PostAction) { a.APIVersion = "2025-01-01-preview" },
+		func(a *PostAction) { a.Headers = map[string]string{"X-Route": "eu"} },
+	}
+	before := requests
+	for i, change := range endpointChanges {
+		changed := *azure
+		change(&changed)
+		for repeat := 0; repeat < 2; repeat++ {
+			if _, err := processWithOpenAI("The transcript.", &changed, "test-key", io.Discard); err != nil {
+				t.Fatalf("processWithOpenAI() error = %v", err)
+			}
+		}
+		if want := before + int32(i+1); requests != want {
+			t.Errorf("endpoint change %d: %d requests, want %d (one miss, then a hit)", i, requests, want)
+		}
+	}
+}
+
+// Test JSON Schema validation of structured replies
+func TestValidateSchemaValue(t *testing.T) {
+	schema, err := normalizeSchema(map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"items": map[string]interface{}{
+				"type":     "array",
+				"maxItems": 2,
+				"items": map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"task":     map[string]interface{}{"type": "string", "minLength": 1},
+						"owner":    map[string]interface{}{"type": []interface{}{"string", "null"}},
+						"priority": map[string]interface{}{"enum": []interface{}{"high", "low"}},
+						"points":   map[string]interface{}{"type": "integer", "minimum": 0},
+					},
+					"required":             []interface{}{"task"},
+					"additionalProperties": false,
+				},
+			},
+			"date": map[string]interface{}{"type": "string", "pattern": `^\d{4}-\d{2}-\d{2}$`},
+		},
+		"required": []interface{}{"items"},
+	})
+	if err != nil {
+		t.Fatalf("normalizeSchema() error = %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		reply string
+		want  []string // Substrings of the problems, in order
+	}{
+		{name: "valid", reply: `{"items": [{"task": "Ship", "owner": null, "priority": "high", "points": 3}], "date": "2025-01-31"}`},
+		{name: "code fence", reply: "```json\n{\"items\": []}\n```"},
+		{name: "not json", reply: "Here are the items:", want: []string{"not valid JSON"}},
+		{name: "trailing text", reply: `{"items": []} Hope this helps!`, want: []string{"not valid JSON"}},
+		{name: "missing required", reply: `{"date": "2025-01-31"}`, want: []string{"$: missing required property 'items'"}},
+		{name: "wrong type", reply: `{"items": "none"}`, want: []string{"$.items: expected array, got string"}},
+		{name: "nested problems", reply: `{"items": [{"task": "", "owner": 5, "priority": "urgent", "points": 1.5, "extra": true}]}`, want: []string{
+			"$.items[0]: unexpected property 'extra'",
+			"$.items[0].owner: expected string or null, got integer",
+			"$.items[0].points: expected integer, got number",
+			"$.items[0].priority: must be one of",
+			"$.items[0].task: must be at least 1 characters",
+		}},
+		{name: "limits", reply: `{"items": [{"task": "a"}, {"task": "b"}, {"task": "c", "points": -1}], "date": "Jan 31"}`, want: []string{
+			"$.date: must match pattern",
+			"$.items: must have at most 2 items",
+			"$.items[2].points: must be at least 0",
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, problems := parseStructuredReply(tt.reply, schema)
+			if len(problems) != len(tt.want) {
+				t.Fatalf("problems = %q, want %d", problems, len(tt.want))
+			}
+			for i, want := range tt.want {
+				if !strings.Contains(problems[i], want) {
+					t.Errorf("problem %d = %q, want %q", i, problems[i], want)
+				}
+			}
+		})
+	}
+
+	for _, bad := range []map[string]interface{}{
+		{"type": "array"},
+		{"type": "object", "properties": map[string]interface{}{"a": map[string]interface{}{"type": "text"}}},
+		{"type": "object", "properties": map[string]interface{}{"a": map[string]interface{}{"pattern": "("}}},
+	} {
+		if _, err := normalizeSchema(bad); err == nil {
+			t.Errorf("normalizeSchema(%v) accepted an invalid schema", bad)
+		}
+	}
+}
+
+// Test structured output actions: schema requested, replies validated and retried,
+// chunk results merged without a merge request
+func TestStructuredAction(t *testing.T) {
+	originalConfig, originalConcurrency := activeConfig, chunkConcurrency
+	defer func() { activeConfig, chunkConcurrency = originalConfig, originalConcurrency }()
+
+	schema, err := normalizeSchema(map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"title": map[string]interface{}{"type": "string"},
+			"items": map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}},
+		},
+		"required": []interface{}{"title", "items"},
+	})
+	if err != nil {
+		t.Fatalf("normalizeSchema() error = %v", err)
+	}
+
+	var requests []ChatCompletionRequest
+	var mu sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req ChatCompletionRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		mu.Lock()
+		requests = append(requests, req)
+		mu.Unlock()
+
+		last := req.Messages[len(req.Messages)-1].Content
+		var reply string
+		switch {
+		case strings.Contains(last, "Reply again"):
+			reply = `{"title": "Fixed", "items": ["a"]}`
+		case strings.Contains(last, "first try"):
+			reply = `{"items": ["a"]}` // Missing title
+		default:
+			// One item per chunk, plus one shared by every chunk
+			transcript := strings.SplitN(last, "Transcript:\n", 2)[1]
+			reply = fmt.Sprintf(`{"title": "", "items": ["%s", "shared"]}`, strings.Fields(transcript)[1])
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"choices": []map[string]interface{}{{"message": map[string]string{"content": reply}}},
+		})
+	}))
+	defer server.Close()
+	activeConfig = Config{BaseURL: server.URL}
+
+	action := &PostAction{ID: "items.json", Name: "Items", Type: "openai", Prompt: "List items.", Model: "gpt-4", MaxTokens: 500, Schema: schema}
+
+	// An invalid reply is sent back with the problems
+	got, err := processWithOpenAI("The first try transcript.", action, "test-key", io.Discard)
+	if err != nil {
+		t.Fatalf("processWithOpenAI() error = %v", err)
+	}
+	if got != "{\n  \"items\": [\n    \"a\"\n  ],\n  \"title\": \"Fixed\"\n}\n" {
+		t.Errorf("processWithOpenAI() = %q", got)
+	}
+	if len(requests) != 2 {
+		t.Fatalf("%d requests, want the reply retried once", len(requests))
+	}
+	format := requests[0].ResponseFormat
+	if format == nil || format.Type != "json_schema" || format.JSONSchema.Name != "items_json" || format.JSONSchema.Schema["type"] != "object" {
+		t.Errorf("response_format = %+v", format)
+	}
+	retry := requests[1].Messages
+	if len(retry) != 3 || retry[1].Role != "assistant" || !strings.Contains(retry[2].Content, "missing required property 'title'") {
+		t.Errorf("retry messages = %+v", retry)
+	}
+
+	// Long transcripts: chunk arrays are concatenated without duplicates, no merge request
+	requests = nil
+	chunkConcurrency = 2
+	var sb strings.Builder
+	for i := 0; i < 3000; i++ {
+		fmt.Fprintf(&sb, "Sentence %04d is about the topic. ", i)
+	}
+	got, err = processWithOpenAIChunked(sb.String(), action, "test-key", io.Discard)
+	if err != nil {
+		t.Fatalf("processWithOpenAIChunked() error = %v", err)
+	}
+	var merged struct {
+		Title string   `json:"title"`
+		Items []string `json:"items"`
+	}
+	if err := json.Unmarshal([]byte(got), &merged); err != nil {
+		t.Fatalf("merged result is not JSON: %v\n%s", err, got)
+	}
+	if len(merged.Items) != len(requests)+1 || merged.Items[0] != "0000" || merged.Items[1] != "shared" {
+		t.Errorf("merged items = %v after %d chunk requests", merged.Items, len(requests))
+	}
+	for _, req := range requests {
+		if strings.Contains(req.Messages[0].Content, "Chunk results to merge") {
+			t.Error("structured chunks were merged by a model")
+		}
+	}
+
+	// A reply that never matches fails the action
+	stubborn := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"choices": [{"message": {"content": "No JSON here."}}]}`))
+	}))
+	defer stubborn.Close()
+	activeConfig = Config{BaseURL: stubborn.URL}
+	if _, err := processWithOpenAI("Transcript.", action, "test-key", io.Discard); err == nil || !strings.Contains(err.Error(), "after 3 attempts") {
+		t.Errorf("processWithOpenAI() error = %v, want failure after 3 attempts", err)
+	}
+}
+
+// Test only valid structured replies are cached, so a re-run asks the model again
+func TestStructuredActionCache(t *testing.T) {
+	tempDir := t.TempDir()
+	originalHome := os.Getenv("HOME")
+	originalConfig, originalNoCache := activeConfig, noResponseCache
+	defer func() {
+		os.Setenv("HOME", originalHome)
+		activeConfig, noResponseCache = originalConfig, originalNoCache
+	}()
+	os.Setenv("HOME", tempDir)
+	noResponseCache = false
+
+	schema, err := normalizeSchema(map[string]interface{}{
+		"type":       "object",
+		"properties": map[string]interface{}{"title": map[string]interface{}{"type": "string"}},
+		"required":   []interface{}{"title"},
+	})
+	if err != nil {
+		t.Fatalf("normalizeSchema() error = %v", err)
+	}
+
+	var requests int32
+	reply := "No JSON here."
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"choices": []map[string]interface{}{{"message": map[string]string{"content": reply}}},
+		})
+	}))
+	defer server.Close()
+	activeConfig = Config{BaseURL: server.URL}
+
+	action := &PostAction{ID: "title", Name: "Title", Type: "openai", Prompt: "Title this.", Model: "gpt-4", MaxTokens: 500, Schema: schema}
+
+	// First run: every reply is invalid and none is cached
+	if _, err := processWithOpenAI("Transcript.", action, "test-key", io.Discard); err == nil {
+		t.Fatal("processWithOpenAI() succeeded with invalid replies")
+	}
+	if requests != 3 {
+		t.Fatalf("%d requests on the first run, want 3", requests)
+	}
+
+	// Second run: the model is asked again and its valid reply is cached
+	reply = `{"title": "Weekly sync"}`
+	got, err := processWithOpenAI("Transcript.", action, "test-key", io.Discard)
+	if err != nil {
+		t.Fatalf("processWithOpenAI() error = %v", err)
+	}
+	if got != "{\n  \"title\": \"Weekly sync\"\n}\n" || requests != 4 {
+		t.Errorf("second run = %q after %d requests, want the valid reply after 4", got, requests)
+	}
+
+	// Third run: answered from the cache
+	reply = "No JSON here."
+	if again, err := processWithOpenAI("Transcript.", action, "test-key", io.Discard); err != nil || again != got || requests != 4 {
+		t.Errorf("third run = %q, %v after %d requests, want the cached reply", again, err, requests)
+	}
+}
+
+// Test structured output through Anthropic's forced tool call
+func TestStructuredAnthropic(t *testing.T) {
+	originalConfig := activeConfig
+	defer func() { activeConfig = originalConfig }()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req AnthropicMessagesRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		if len(req.Tools) != 1 || req.Tools[0].Name != "decisions" || req.Tools[0].InputSchema["type"] != "object" {
+			t.Errorf("tools = %+v", req.Tools)
+		}
+		if req.ToolChoice == nil || req.ToolChoice.Type != "tool" || req.ToolChoice.Name != "decisions" {
+			t.Errorf("tool_choice = %+v", req.ToolChoice)
+		}
+		w.Write([]byte(`{"content": [{"type": "text", "text": "Recording."}, {"type": "tool_use", "name": "decisions", "input": {"decisions": ["Ship it"]}}]}`))
+	}))
+	defer server.Close()
+	activeConfig = Config{AnthropicAPIKey: "sk-ant-test"}
+
+	action := &PostAction{ID: "decisions", Type: actionTypeAnthropic, Model: "claude-sonnet-4-5", BaseURL: server.URL, MaxTokens: 500,
+		Schema: map[string]interface{}{"type": "object", "required": []interface{}{"decisions"}}}
+	got, err := processWithOpenAI("Transcript.", action, "test-key", io.Discard)
+	if err != nil {
+		t.Fatalf("processWithOpenAI() error = %v", err)
+	}
+	if !strings.Contains(got, `"Ship it"`) {
+		t.Errorf("processWithOpenAI() = %q", got)
+	}
+}
+
+// fakeTranscriber records the files it is asked to transcribe
+type fakeTranscriber struct {
+	limit int64
+	mu    sync.Mutex
+	paths []string
+}
+
+func (f *fakeTranscriber) Name() string       { return "fake" }
+func (f *fakeTranscriber) CacheID() string    { return "fake" }
+func (f *fakeTranscriber) MaxFileSize() int64 { return f.limit }
+func (f *fakeTranscriber) Transcribe(audioPath string, opts TranscriptionOptions) (*Transcript, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.paths = append(f.paths, audioPath)
+	return &Transcript{Text: "tone"}, nil
+}
+
+// Test -transcode with a real ffmpeg: repeatable output and the split fallback
+func TestTranscodeForSpeech(t *testing.T) {
+	for _, tool := range []string{"ffmpeg", "ffprobe"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s not installed", tool)
+		}
+	}
+
+	originalHome := os.Getenv("HOME")
+	defer os.Setenv("HOME", originalHome)
+	tmpDir := t.TempDir()
+	os.Setenv("HOME", tmpDir)
+
+	source := filepath.Join(tmpDir, "tone.wav")
+	cmd := exec.Command("ffmpeg", "-y", "-f", "lavfi", "-i", "sine=frequency=440:duration=20", "-ac", "2", "-ar", "44100", source)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("failed to generate audio: %v\n%s", err, output)
+	}
+
+	// Two transcodes of the same file are byte-identical, so cache keys match on resume
+	var keys []string
+	for i := 0; i < 2; i++ {
+		transcoded, err := transcodeForSpeech(source, -1)
+		if err != nil {
+			t.Fatalf("transcodeForSpeech() error = %v", err)
+		}
+		defer removeTempDir(filepath.Dir(transcoded))
+
+		key, err := transcriptionCacheKey(transcoded, "fake", TranscriptionOptions{})
+		if err != nil {
+			t.Fatalf("transcriptionCacheKey() error = %v", err)
+		}
+		keys = append(keys, key)
+
+		sourceSize, _ := getFileSize(source)
+		if size, _ := getFileSize(transcoded); size <= 0 || size >= sourceSize {
+			t.Errorf("transcoded size = %d, want smaller than %d", size, sourceSize)
+		}
+	}
+	if keys[0] != keys[1] {
+		t.Error("transcoding the same file twice gave different cache keys")
+	}
+
+	// Small enough after transcoding: uploaded in one piece
+	opts := TranscriptionOptions{Transcode: true, AudioStream: -1, SplitMode: splitModeFixed, NoCache: true}
+	fits := &fakeTranscriber{limit: maxFileSizeBytes}
+	if _, err := transcribeAudioWithSplitting(source, fits, opts); err != nil {
+		t.Fatalf("transcribeAudioWithSplitting() error = %v", err)
+	}
+	if len(fits.paths) != 1 || filepath.Ext(fits.paths[0]) != ".ogg" {
+		t.Errorf("transcribed %v, want the transcoded .ogg once", fits.paths)
+	}
+
+	// Still over the limit after transcoding: the transcoded file is split
+	tooBig := &fakeTranscriber{limit: 1}
+	if _, err := transcribeAudioWithSplitting(source, tooBig, opts); err != nil {
+		t.Fatalf("transcribeAudioWithSplitting() error = %v", err)
+	}
+	if len(tooBig.paths) == 0 || !strings.Contains(filepath.Base(tooBig.paths[0]), "_chunk_") {
+		t.Errorf("transcribed %v, want chunks of the transcoded file", tooBig.paths)
+	}
+}
+
 // Helper function
 func contains(s, substr string) bool {
 	return len(s) >= len(substr) && (s == substr || len(s) > len(substr) && containsSubstring(s, substr))
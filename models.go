@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// defaultModelContextWindow is assumed for models missing from the registry
+const defaultModelContextWindow = 8192
+
+// ModelInfo describes a model's limits, tokenizer and pricing
+type ModelInfo struct {
+	ContextWindow int     // Total tokens: prompt, transcript and response
+	MaxOutput     int     // Largest max_tokens the model accepts
+	Encoding      string  // cl100k_base or o200k_base (default cl100k_base)
+	InputPrice    float64 // USD per 1M input tokens
+	OutputPrice   float64 // USD per 1M output tokens
+	AudioPrice    float64 // USD per minute of transcribed audio
+	TokensPriced  bool    // InputPrice and OutputPrice are known; a configured 0 counts
+	AudioPriced   bool    // AudioPrice is known; a configured 0 counts
+}
+
+// ModelOverride is an entry in the config's models section. It overrides the built-in
+// entry of the same name field by field; a field left out keeps the built-in value, and
+// an explicit 0 (e.g. input_price: 0 for a self-hosted model) replaces it.
+type ModelOverride struct {
+	ContextWindow *int     `yaml:"context_window,omitempty"`
+	MaxOutput     *int     `yaml:"max_output,omitempty"`
+	Encoding      string   `yaml:"encoding,omitempty"`
+	InputPrice    *float64 `yaml:"input_price,omitempty"`
+	OutputPrice   *float64 `yaml:"output_price,omitempty"`
+	AudioPrice    *float64 `yaml:"audio_price,omitempty"`
+}
+
+// builtinModels is the default registry. A key also matches dated or suffixed variants,
+// so "gpt-4o" covers "gpt-4o-2024-08-06"; the longest matching key wins.
+var builtinModels = map[string]ModelInfo{
+	// OpenAI chat models
+	"gpt-5":              {ContextWindow: 400000, MaxOutput: 128000, Encoding: encodingO200k, InputPrice: 1.25, OutputPrice: 10},
+	"gpt-5-mini":         {ContextWindow: 400000, MaxOutput: 128000, Encoding: encodingO200k, InputPrice: 0.25, OutputPrice: 2},
+	"gpt-5-nano":         {ContextWindow: 400000, MaxOutput: 128000, Encoding: encodingO200k, InputPrice: 0.05, OutputPrice: 0.40},
+	"gpt-4.1":            {ContextWindow: 1047576, MaxOutput: 32768, Encoding: encodingO200k, InputPrice: 2, OutputPrice: 8},
+	"gpt-4.1-mini":       {ContextWindow: 1047576, MaxOutput: 32768, Encoding: encodingO200k, InputPrice: 0.40, OutputPrice: 1.60},
+	"gpt-4.1-nano":       {ContextWindow: 1047576, MaxOutput: 32768, Encoding: encodingO200k, InputPrice: 0.10, OutputPrice: 0.40},
+	"gpt-4o":             {ContextWindow: 128000, MaxOutput: 16384, Encoding: encodingO200k, InputPrice: 2.50, OutputPrice: 10},
+	"gpt-4o-mini":        {ContextWindow: 128000, MaxOutput: 16384, Encoding: encodingO200k, InputPrice: 0.15, OutputPrice: 0.60},
+	"o1":                 {ContextWindow: 200000, MaxOutput: 100000, Encoding: encodingO200k, InputPrice: 15, OutputPrice: 60},
+	"o1-mini":            {ContextWindow: 128000, MaxOutput: 65536, Encoding: encodingO200k, InputPrice: 1.10, OutputPrice: 4.40},
+	"o3":                 {ContextWindow: 200000, MaxOutput: 100000, Encoding: encodingO200k, InputPrice: 2, OutputPrice: 8},
+	"o3-mini":            {ContextWindow: 200000, MaxOutput: 100000, Encoding: encodingO200k, InputPrice: 1.10, OutputPrice: 4.40},
+	"o4-mini":            {ContextWindow: 200000, MaxOutput: 100000, Encoding: encodingO200k, InputPrice: 1.10, OutputPrice: 4.40},
+	"gpt-4-turbo":        {ContextWindow: 128000, MaxOutput: 4096, Encoding: encodingCl100k, InputPrice: 10, OutputPrice: 30},
+	"gpt-4-1106-preview": {ContextWindow: 128000, MaxOutput: 4096, Encoding: encodingCl100k, InputPrice: 10, OutputPrice: 30},
+	"gpt-4-0125-preview": {ContextWindow: 128000, MaxOutput: 4096, Encoding: encodingCl100k, InputPrice: 10, OutputPrice: 30},
+	"gpt-4":              {ContextWindow: 8192, MaxOutput: 8192, Encoding: encodingCl100k, InputPrice: 30, OutputPrice: 60},
+	"gpt-4-32k":          {ContextWindow: 32768, MaxOutput: 8192, Encoding: encodingCl100k, InputPrice: 60, OutputPrice: 120},
+	"gpt-3.5-turbo":      {ContextWindow: 16385, MaxOutput: 4096, Encoding: encodingCl100k, InputPrice: 0.50, OutputPrice: 1.50},
+
+	// Anthropic models; cl100k_base approximates Claude's tokenizer
+	"claude":            {ContextWindow: 200000, MaxOutput: 8192, Encoding: encodingCl100k},
+	"claude-opus-4":     {ContextWindow: 200000, MaxOutput: 32000, Encoding: encodingCl100k, InputPrice: 15, OutputPrice: 75},
+	"claude-opus-4-1":   {ContextWindow: 200000, MaxOutput: 32000, Encoding: encodingCl100k, InputPrice: 15, OutputPrice: 75},
+	"claude-sonnet-4":   {ContextWindow: 200000, MaxOutput: 64000, Encoding: encodingCl100k, InputPrice: 3, OutputPrice: 15},
+	"claude-sonnet-4-5": {ContextWindow: 200000, MaxOutput: 64000, Encoding: encodingCl100k, InputPrice: 3, OutputPrice: 15},
+	"claude-haiku-4-5":  {ContextWindow: 200000, MaxOutput: 64000, Encoding: encodingCl100k, InputPrice: 1, OutputPrice: 5},
+	"claude-3-7-sonnet": {ContextWindow: 200000, MaxOutput: 64000, Encoding: encodingCl100k, InputPrice: 3, OutputPrice: 15},
+	"claude-3-5-sonnet": {ContextWindow: 200000, MaxOutput: 8192, Encoding: encodingCl100k, InputPrice: 3, OutputPrice: 15},
+	"claude-3-5-haiku":  {ContextWindow: 200000, MaxOutput: 8192, Encoding: encodingCl100k, InputPrice: 0.80, OutputPrice: 4},
+
+	// Transcription models
+	"whisper-1":              {AudioPrice: 0.006},
+	"gpt-4o-transcribe":      {AudioPrice: 0.006},
+	"gpt-4o-mini-transcribe": {AudioPrice: 0.003},
+}
+
+// matchModelKey returns the longest key in models that names model or one of its
+// variants ("gpt-4o" for "gpt-4o-2024-08-06"). Fine-tuned models
+// ("ft:gpt-4o-mini:org::id") match their base model.
+func matchModelKey[T any](models map[string]T, model string) string {
+	if strings.HasPrefix(model, "ft:") {
+		model = strings.SplitN(strings.TrimPrefix(model, "ft:"), ":", 2)[0]
+	}
+
+	best := ""
+	for key := range models {
+		if (model == key || strings.HasPrefix(model, key+"-")) && len(key) > len(best) {
+			best = key
+		}
+	}
+	return best
+}
+
+// lookupModel finds a model in the registry formed by the built-in table and the
+// config's models section
+func lookupModel(models map[string]ModelOverride, model string) (ModelInfo, bool) {
+	key := matchModelKey(builtinModels, model)
+	if custom := matchModelKey(models, model); len(custom) >= len(key) && custom != "" {
+		key = custom
+	}
+	if key == "" {
+		return ModelInfo{}, false
+	}
+
+	info := builtinModels[key]
+	info.TokensPriced = info.InputPrice > 0 || info.OutputPrice > 0
+	info.AudioPriced = info.AudioPrice > 0
+	if custom, ok := models[key]; ok {
+		if custom.ContextWindow != nil {
+			info.ContextWindow = *custom.ContextWindow
+		}
+		if custom.MaxOutput != nil {
+			info.MaxOutput = *custom.MaxOutput
+		}
+		if custom.Encoding != "" {
+			info.Encoding = custom.Encoding
+		}
+		if custom.InputPrice != nil {
+			info.InputPrice = *custom.InputPrice
+			info.TokensPriced = true
+		}
+		if custom.OutputPrice != nil {
+			info.OutputPrice = *custom.OutputPrice
+			info.TokensPriced = true
+		}
+		if custom.AudioPrice != nil {
+			info.AudioPrice = *custom.AudioPrice
+			info.AudioPriced = true
+		}
+	}
+	return info, true
+}
+
+// modelInfo returns the active registry's entry for model, with defaults for anything
+// the registry doesn't say
+func modelInfo(model string) ModelInfo {
+	info, _ := lookupModel(activeConfig.Models, model)
+	if info.ContextWindow <= 0 {
+		info.ContextWindow = defaultModelContextWindow
+	}
+	if info.Encoding == "" {
+		info.Encoding = encodingCl100k
+	}
+	return info
+}
+
+// validateModels checks the config's models section
+func validateModels(models map[string]ModelOverride) error {
+	for name := range models {
+		info, _ := lookupModel(models, name)
+		if info.ContextWindow < 0 || info.MaxOutput < 0 {
+			return fmt.Errorf("model '%s' has a negative context_window or max_output", name)
+		}
+		if info.ContextWindow > 0 && info.MaxOutput > info.ContextWindow {
+			return fmt.Errorf("model '%s' has max_output %d larger than its context_window %d", name, info.MaxOutput, info.ContextWindow)
+		}
+		if info.Encoding != "" && info.Encoding != encodingCl100k && info.Encoding != encodingO200k {
+			return fmt.Errorf("model '%s' has invalid encoding '%s' (valid: %s, %s)", name, info.Encoding, encodingCl100k, encodingO200k)
+		}
+		if info.InputPrice < 0 || info.OutputPrice < 0 || info.AudioPrice < 0 {
+			return fmt.Errorf("model '%s' has a negative price", name)
+		}
+	}
+	return nil
+}
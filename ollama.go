@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const (
+	defaultOllamaHost = "http://localhost:11434"
+	// defaultOllamaContextWindow is sent as num_ctx when ollama.context_window is unset,
+	// so transcript chunks are sized for the window Ollama actually uses
+	defaultOllamaContextWindow = 8192
+)
+
+// OllamaConfig configures the local Ollama server used by ollama actions
+type OllamaConfig struct {
+	Host          string `yaml:"host,omitempty"`           // Default: $OLLAMA_HOST, then http://localhost:11434
+	Model         string `yaml:"model,omitempty"`          // Default model for ollama actions and -provider ollama
+	ContextWindow int    `yaml:"context_window,omitempty"` // num_ctx sent to Ollama; also sizes transcript chunks
+}
+
+// OllamaChatRequest is the body of an /api/chat call
+type OllamaChatRequest struct {
+	Model    string                 `json:"model"`
+	Messages []Message              `json:"messages"`
+	Stream   bool                   `json:"stream"`
+	Format   map[string]interface{} `json:"format,omitempty"` // JSON Schema the reply must match
+	Options  OllamaOptions          `json:"options"`
+}
+
+// OllamaOptions are the model parameters goscribe sets
+type OllamaOptions struct {
+	Temperature float64 `json:"temperature"`
+	NumPredict  int     `json:"num_predict,omitempty"`
+	NumCtx      int     `json:"num_ctx,omitempty"`
+}
+
+// OllamaChatResponse is the subset of a non-streaming /api/chat response goscribe uses
+type OllamaChatResponse struct {
+	Message         Message `json:"message"`
+	Error           string  `json:"error"`
+	PromptEvalCount int     `json:"prompt_eval_count"`
+	EvalCount       int     `json:"eval_count"`
+}
+
+// resolveOllamaEndpoint returns the server for an ollama action; the action's base_url
+// wins over the ollama section and $OLLAMA_HOST
+func resolveOllamaEndpoint(action *PostAction) apiEndpoint {
+	host := activeConfig.Ollama.Host
+	if host == "" {
+		host = os.Getenv("OLLAMA_HOST")
+	}
+	if action != nil && action.BaseURL != "" {
+		host = action.BaseURL
+	}
+	if host == "" {
+		host = defaultOllamaHost
+	}
+	if !strings.Contains(host, "://") {
+		host = "http://" + host // OLLAMA_HOST is often just host:port
+	}
+
+	return apiEndpoint{BaseURL: host, Headers: mergeHeaders(action, false)}
+}
+
+// ollamaModel returns the model to run, falling back to ollama.model in the config
+func ollamaModel(model string) string {
+	if model == "" {
+		return activeConfig.Ollama.Model
+	}
+	return model
+}
+
+// ollamaContextWindow returns the num_ctx used for every Ollama request
+func ollamaContextWindow(config OllamaConfig) int {
+	if config.ContextWindow > 0 {
+		return config.ContextWindow
+	}
+	return defaultOllamaContextWindow
+}
+
+// sendOllamaChat sends a chat request to a local Ollama server and waits for the full reply
+func sendOllamaChat(endpoint apiEndpoint, chatReq ChatCompletionRequest, out io.Writer) (string, tokenUsage, error) {
+	reqBody := OllamaChatRequest{
+		Model:    ollamaModel(chatReq.Model),
+		Messages: chatReq.Messages,
+		Stream:   false,
+		Options: OllamaOptions{
+			Temperature: chatReq.Temperature,
+			NumPredict:  chatReq.MaxTokens,
+			NumCtx:      ollamaContextWindow(activeConfig.Ollama),
+		},
+	}
+	if chatReq.ResponseFormat != nil && chatReq.ResponseFormat.JSONSchema != nil {
+		reqBody.Format = chatReq.ResponseFormat.JSONSchema.Schema
+	}
+	if reqBody.Model == "" {
+		return "", tokenUsage{}, fmt.Errorf("no ollama model set (set the action's model or ollama.model in config)")
+	}
+
+	jsonData, err := json.Marshal(reqBody)
+	if err != nil {
+		return "", tokenUsage{}, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	req, err := endpoint.newRequest("POST", "/api/chat", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return "", tokenUsage{}, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	statusCode, respBody, err := apiClient.send(req, out)
+	if err != nil {
+		return "", tokenUsage{}, fmt.Errorf("failed to reach Ollama at %s (is `ollama serve` running?): %w", endpoint.BaseURL, err)
+	}
+
+	var chatResp OllamaChatResponse
+	jsonErr := json.Unmarshal(respBody, &chatResp)
+
+	if statusCode != http.StatusOK {
+		if jsonErr == nil && chatResp.Error != "" {
+			return "", tokenUsage{}, fmt.Errorf("ollama request failed with status %d: %s", statusCode, chatResp.Error)
+		}
+		return "", tokenUsage{}, fmt.Errorf("ollama request failed with status %d: %s", statusCode, string(respBody))
+	}
+	if jsonErr != nil {
+		return "", tokenUsage{}, fmt.Errorf("failed to parse response: %w", jsonErr)
+	}
+
+	if chatResp.Message.Content == "" {
+		return "", tokenUsage{}, fmt.Errorf("no response from Ollama")
+	}
+
+	usage := tokenUsage{InputTokens: chatResp.PromptEvalCount, OutputTokens: chatResp.EvalCount}
+	return chatResp.Message.Content, usage, nil
+}
@@ -0,0 +1,543 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxSchemaRetries is how many times a reply that doesn't match the schema is sent back
+// with the validation errors before the action fails
+const maxSchemaRetries = 2
+
+// maxReportedSchemaProblems caps the validation errors quoted in a retry prompt
+const maxReportedSchemaProblems = 10
+
+// ResponseFormat asks an OpenAI-compatible server for JSON matching a schema
+type ResponseFormat struct {
+	Type       string      `json:"type"` // "json_schema"
+	JSONSchema *JSONSchema `json:"json_schema,omitempty"`
+}
+
+// JSONSchema names the schema a structured reply must match
+type JSONSchema struct {
+	Name   string                 `json:"name"`
+	Schema map[string]interface{} `json:"schema"`
+	Strict bool                   `json:"strict"`
+}
+
+// schemaTypes are the JSON Schema types validateSchemaValue understands
+var schemaTypes = map[string]bool{"object": true, "array": true, "string": true, "number": true, "integer": true, "boolean": true, "null": true}
+
+// schemaName turns an action ID into a name providers accept for a schema or tool
+// (letters, digits, _ and -, at most 64 characters)
+func schemaName(id string) string {
+	name := regexp.MustCompile(`[^a-zA-Z0-9_-]`).ReplaceAllString(id, "_")
+	if name == "" {
+		name = "result"
+	}
+	if len(name) > 64 {
+		name = name[:64]
+	}
+	return name
+}
+
+// structuredResponseFormat returns the response_format requesting an action's schema
+func structuredResponseFormat(action *PostAction) *ResponseFormat {
+	return &ResponseFormat{
+		Type:       "json_schema",
+		JSONSchema: &JSONSchema{Name: schemaName(action.ID), Schema: action.Schema},
+	}
+}
+
+// normalizeSchema converts a schema decoded from YAML into plain JSON values and checks
+// that goscribe can request and validate it
+func normalizeSchema(schema map[string]interface{}) (map[string]interface{}, error) {
+	data, err := json.Marshal(schema)
+	if err != nil {
+		return nil, fmt.Errorf("schema is not valid JSON: %w", err)
+	}
+	var normalized map[string]interface{}
+	if err := json.Unmarshal(data, &normalized); err != nil {
+		return nil, fmt.Errorf("schema is not valid JSON: %w", err)
+	}
+
+	if normalized["type"] != "object" {
+		return nil, fmt.Errorf("schema must have type: object at the top level (put lists in its properties)")
+	}
+	if err := checkSchema(normalized, "schema"); err != nil {
+		return nil, err
+	}
+	return normalized, nil
+}
+
+// checkSchema validates the keywords validateSchemaValue relies on, recursively
+func checkSchema(schema map[string]interface{}, path string) error {
+	switch t := schema["type"].(type) {
+	case nil:
+	case string:
+		if !schemaTypes[t] {
+			return fmt.Errorf("%s has unknown type '%s'", path, t)
+		}
+	case []interface{}:
+		for _, item := range t {
+			if name, ok := item.(string); !ok || !schemaTypes[name] {
+				return fmt.Errorf("%s has unknown type %v", path, item)
+			}
+		}
+	default:
+		return fmt.Errorf("%s has an invalid type", path)
+	}
+
+	if pattern, ok := schema["pattern"].(string); ok {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("%s has an invalid pattern: %w", path, err)
+		}
+	}
+	if props, ok := schema["properties"].(map[string]interface{}); ok {
+		for name, prop := range props {
+			sub, ok := prop.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("%s.properties.%s must be a schema", path, name)
+			}
+			if err := checkSchema(sub, path+".properties."+name); err != nil {
+				return err
+			}
+		}
+	}
+	if items, ok := schema["items"].(map[string]interface{}); ok {
+		if err := checkSchema(items, path+".items"); err != nil {
+			return err
+		}
+	}
+	if extra, ok := schema["additionalProperties"].(map[string]interface{}); ok {
+		if err := checkSchema(extra, path+".additionalProperties"); err != nil {
+			return err
+		}
+	}
+	if anyOf, ok := schema["anyOf"].([]interface{}); ok {
+		for i, option := range anyOf {
+			sub, ok := option.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("%s.anyOf[%d] must be a schema", path, i)
+			}
+			if err := checkSchema(sub, fmt.Sprintf("%s.anyOf[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// buildStructuredPrompt asks for the action's result as JSON matching its schema. The
+// schema is spelled out in the prompt too, for servers without structured output.
+func buildStructuredPrompt(action *PostAction, transcript string) string {
+	schema, _ := json.MarshalIndent(action.Schema, "", "  ")
+	return buildActionPrompt(action, transcript) + "\n\nReply with only a JSON object, no other text, that matches this JSON Schema:\n" + string(schema)
+}
+
+// buildSchemaRetryPrompt sends the validation errors of a reply back to the model
+func buildSchemaRetryPrompt(problems []string) string {
+	if len(problems) > maxReportedSchemaProblems {
+		problems = append(problems[:maxReportedSchemaProblems:maxReportedSchemaProblems], fmt.Sprintf("... and %d more", len(problems)-maxReportedSchemaProblems))
+	}
+	return "Your reply does not match the JSON Schema:\n- " + strings.Join(problems, "\n- ") +
+		"\n\nReply again with only the corrected JSON object."
+}
+
+// processStructured applies an action with a schema to a transcript. Replies that aren't
+// valid JSON or don't match the schema are sent back with the errors, up to
+// maxSchemaRetries times. It returns the result as indented JSON.
+//
+// Only a valid reply is cached, under the first attempt's request: caching every reply
+// would make a re-run replay the same invalid ones without asking the model again.
+func processStructured(transcript string, action *PostAction, apiKey string, out io.Writer) (string, error) {
+	messages := []Message{{Role: "user", Content: buildStructuredPrompt(action, transcript)}}
+	request := func() ChatCompletionRequest {
+		return ChatCompletionRequest{
+			Model:          action.Model,
+			Messages:       messages,
+			Temperature:    action.Temperature,
+			MaxTokens:      action.MaxTokens,
+			ResponseFormat: structuredResponseFormat(action),
+		}
+	}
+
+	var cacheKey string
+	if !noResponseCache {
+		key, err := responseCacheKey(action, apiKey, request())
+		if err != nil {
+			fmt.Fprintf(out, "  ⚠ Warning: response cache unavailable: %v\n", err)
+		} else if cached, ok := loadCachedResponse(key); ok {
+			if value, problems := parseStructuredReply(cached, action.Schema); len(problems) == 0 {
+				fmt.Fprintf(out, "  ✓ Using cached response\n")
+				return formatJSON(value)
+			}
+		}
+		if err == nil {
+			cacheKey = key
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		reply, err := sendActionChat(action, apiKey, request(), out)
+		if err != nil {
+			return "", err
+		}
+
+		value, problems := parseStructuredReply(reply, action.Schema)
+		if len(problems) == 0 {
+			if cacheKey != "" {
+				if err := storeCachedResponse(cacheKey, action.Model, reply); err != nil {
+					fmt.Fprintf(out, "  ⚠ Warning: failed to cache response: %v\n", err)
+				}
+			}
+			return formatJSON(value)
+		}
+		if attempt == maxSchemaRetries {
+			return "", fmt.Errorf("reply does not match the schema after %d attempts: %s", attempt+1, strings.Join(problems, "; "))
+		}
+
+		fmt.Fprintf(out, "  ⚠ Reply does not match the schema (%d problem(s)), asking again\n", len(problems))
+		messages = append(messages,
+			Message{Role: "assistant", Content: reply},
+			Message{Role: "user", Content: buildSchemaRetryPrompt(problems)},
+		)
+	}
+}
+
+// parseStructuredReply decodes a reply, tolerating a surrounding Markdown code fence,
+// and validates it against the schema
+func parseStructuredReply(reply string, schema map[string]interface{}) (interface{}, []string) {
+	text := strings.TrimSpace(reply)
+	if strings.HasPrefix(text, "```") {
+		text = strings.TrimPrefix(text, "```json")
+		text = strings.TrimPrefix(text, "```")
+		text = strings.TrimSuffix(strings.TrimSpace(text), "```")
+	}
+
+	value, err := decodeJSON(text)
+	if err != nil {
+		return nil, []string{fmt.Sprintf("reply is not valid JSON: %v", err)}
+	}
+	return value, validateSchemaValue(value, schema, "$")
+}
+
+// decodeJSON parses a single JSON value, keeping numbers exact
+func decodeJSON(text string) (interface{}, error) {
+	decoder := json.NewDecoder(strings.NewReader(text))
+	decoder.UseNumber()
+
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	if decoder.More() {
+		return nil, fmt.Errorf("unexpected text after the JSON value")
+	}
+	return value, nil
+}
+
+// formatJSON renders a value as indented JSON for the output file
+func formatJSON(value interface{}) (string, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(value); err != nil {
+		return "", fmt.Errorf("failed to encode JSON: %w", err)
+	}
+	return buf.String(), nil
+}
+
+// validateSchemaValue checks value against a JSON Schema and describes every mismatch
+// with its path. It supports type, enum, const, properties, required,
+// additionalProperties, items, minItems, maxItems, minLength, maxLength, minimum,
+// maximum, pattern and anyOf; other keywords are ignored.
+func validateSchemaValue(value interface{}, schema map[string]interface{}, path string) []string {
+	if options, ok := schema["anyOf"].([]interface{}); ok {
+		matched := false
+		for _, option := range options {
+			if sub, ok := option.(map[string]interface{}); ok && len(validateSchemaValue(value, sub, path)) == 0 {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return []string{fmt.Sprintf("%s: does not match any of the allowed schemas", path)}
+		}
+	}
+
+	if !matchesSchemaType(value, schema["type"]) {
+		return []string{fmt.Sprintf("%s: expected %s, got %s", path, describeSchemaType(schema["type"]), jsonTypeName(value))}
+	}
+
+	var problems []string
+	if allowed, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, option := range allowed {
+			if jsonEqual(value, option) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			problems = append(problems, fmt.Sprintf("%s: must be one of %s", path, compactJSON(allowed)))
+		}
+	}
+	if expected, ok := schema["const"]; ok && !jsonEqual(value, expected) {
+		problems = append(problems, fmt.Sprintf("%s: must be %s", path, compactJSON(expected)))
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		problems = append(problems, validateSchemaObject(v, schema, path)...)
+	case []interface{}:
+		if min, ok := schemaNumber(schema, "minItems"); ok && float64(len(v)) < min {
+			problems = append(problems, fmt.Sprintf("%s: must have at least %g items", path, min))
+		}
+		if max, ok := schemaNumber(schema, "maxItems"); ok && float64(len(v)) > max {
+			problems = append(problems, fmt.Sprintf("%s: must have at most %g items", path, max))
+		}
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			for i, item := range v {
+				problems = append(problems, validateSchemaValue(item, items, fmt.Sprintf("%s[%d]", path, i))...)
+			}
+		}
+	case string:
+		length := float64(utf8.RuneCountInString(v))
+		if min, ok := schemaNumber(schema, "minLength"); ok && length < min {
+			problems = append(problems, fmt.Sprintf("%s: must be at least %g characters", path, min))
+		}
+		if max, ok := schemaNumber(schema, "maxLength"); ok && length > max {
+			problems = append(problems, fmt.Sprintf("%s: must be at most %g characters", path, max))
+		}
+		if pattern, ok := schema["pattern"].(string); ok {
+			if re, err := regexp.Compile(pattern); err == nil && !re.MatchString(v) {
+				problems = append(problems, fmt.Sprintf("%s: must match pattern %s", path, pattern))
+			}
+		}
+	case json.Number:
+		n, _ := v.Float64()
+		if min, ok := schemaNumber(schema, "minimum"); ok && n < min {
+			problems = append(problems, fmt.Sprintf("%s: must be at least %g", path, min))
+		}
+		if max, ok := schemaNumber(schema, "maximum"); ok && n > max {
+			problems = append(problems, fmt.Sprintf("%s: must be at most %g", path, max))
+		}
+	}
+	return problems
+}
+
+// validateSchemaObject checks an object's required, properties and additionalProperties
+func validateSchemaObject(obj map[string]interface{}, schema map[string]interface{}, path string) []string {
+	var problems []string
+	if required, ok := schema["required"].([]interface{}); ok {
+		for _, name := range required {
+			if key, ok := name.(string); ok {
+				if _, present := obj[key]; !present {
+					problems = append(problems, fmt.Sprintf("%s: missing required property '%s'", path, key))
+				}
+			}
+		}
+	}
+
+	props, _ := schema["properties"].(map[string]interface{})
+	keys := make([]string, 0, len(obj))
+	for key := range obj {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if prop, ok := props[key].(map[string]interface{}); ok {
+			problems = append(problems, validateSchemaValue(obj[key], prop, path+"."+key)...)
+			continue
+		}
+		switch extra := schema["additionalProperties"].(type) {
+		case bool:
+			if !extra {
+				problems = append(problems, fmt.Sprintf("%s: unexpected property '%s'", path, key))
+			}
+		case map[string]interface{}:
+			problems = append(problems, validateSchemaValue(obj[key], extra, path+"."+key)...)
+		}
+	}
+	return problems
+}
+
+// matchesSchemaType reports whether value has the schema's type (a name or a list)
+func matchesSchemaType(value interface{}, schemaType interface{}) bool {
+	switch t := schemaType.(type) {
+	case nil:
+		return true
+	case string:
+		return matchesTypeName(value, t)
+	case []interface{}:
+		for _, name := range t {
+			if s, ok := name.(string); ok && matchesTypeName(value, s) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchesTypeName reports whether value is of the named JSON Schema type
+func matchesTypeName(value interface{}, name string) bool {
+	actual := jsonTypeName(value)
+	switch name {
+	case "number":
+		return actual == "number" || actual == "integer"
+	default:
+		return actual == name
+	}
+}
+
+// jsonTypeName names the JSON Schema type of a decoded value; whole numbers are integers
+func jsonTypeName(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case json.Number:
+		if f, err := v.Float64(); err == nil && f == math.Trunc(f) {
+			return "integer"
+		}
+		return "number"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
+		}
+		return "number"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+// describeSchemaType renders a schema type for an error message
+func describeSchemaType(schemaType interface{}) string {
+	if names, ok := schemaType.([]interface{}); ok {
+		var parts []string
+		for _, name := range names {
+			parts = append(parts, fmt.Sprint(name))
+		}
+		return strings.Join(parts, " or ")
+	}
+	return fmt.Sprint(schemaType)
+}
+
+// schemaNumber reads a numeric keyword such as minItems
+func schemaNumber(schema map[string]interface{}, keyword string) (float64, bool) {
+	n, ok := schema[keyword].(float64)
+	return n, ok
+}
+
+// compactJSON renders a value on one line, for messages and comparisons
+func compactJSON(value interface{}) string {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(data)
+}
+
+// jsonEqual compares two decoded values by content; numbers compare by value
+func jsonEqual(a, b interface{}) bool {
+	if an, ok := jsonNumber(a); ok {
+		bn, ok := jsonNumber(b)
+		return ok && an == bn
+	}
+	return compactJSON(a) == compactJSON(b)
+}
+
+// jsonNumber returns a decoded number as float64
+func jsonNumber(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+// mergeStructuredResults combines the JSON results of transcript chunks without another
+// request. Arrays are concatenated in chunk order, dropping items already present (chunks
+// overlap by a few sentences); objects are merged property by property; for other values
+// the first non-empty one wins. A merged result that breaks the schema, e.g. maxItems,
+// is kept with a warning.
+func mergeStructuredResults(results []string, action *PostAction, out io.Writer) (string, error) {
+	var merged interface{}
+	for i, result := range results {
+		value, err := decodeJSON(result)
+		if err != nil {
+			return "", fmt.Errorf("failed to parse chunk %d result: %w", i+1, err)
+		}
+		if i == 0 {
+			merged = value
+		} else {
+			merged = mergeJSONValues(merged, value)
+		}
+	}
+
+	if problems := validateSchemaValue(merged, action.Schema, "$"); len(problems) > 0 {
+		fmt.Fprintf(out, "  ⚠ Merged result does not match the schema: %s\n", strings.Join(problems, "; "))
+	}
+	return formatJSON(merged)
+}
+
+// mergeJSONValues merges b into a
+func mergeJSONValues(a, b interface{}) interface{} {
+	switch av := a.(type) {
+	case map[string]interface{}:
+		bv, ok := b.(map[string]interface{})
+		if !ok {
+			return a
+		}
+		for key, value := range bv {
+			if existing, present := av[key]; present {
+				av[key] = mergeJSONValues(existing, value)
+			} else {
+				av[key] = value
+			}
+		}
+		return av
+	case []interface{}:
+		bv, ok := b.([]interface{})
+		if !ok {
+			return a
+		}
+		seen := map[string]bool{}
+		for _, item := range av {
+			seen[compactJSON(item)] = true
+		}
+		for _, item := range bv {
+			if key := compactJSON(item); !seen[key] {
+				seen[key] = true
+				av = append(av, item)
+			}
+		}
+		return av
+	case nil:
+		return b
+	case string:
+		if av == "" {
+			return b
+		}
+	}
+	return a
+}
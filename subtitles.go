@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// formatSubtitleTimestamp formats seconds as HH:MM:SS<sep>mmm (SRT uses ",", WebVTT uses ".")
+func formatSubtitleTimestamp(seconds float64, sep string) string {
+	if seconds < 0 {
+		seconds = 0
+	}
+	totalMillis := int64(seconds*1000 + 0.5)
+	hours := totalMillis / 3600000
+	minutes := (totalMillis % 3600000) / 60000
+	secs := (totalMillis % 60000) / 1000
+	millis := totalMillis % 1000
+	return fmt.Sprintf("%02d:%02d:%02d%s%03d", hours, minutes, secs, sep, millis)
+}
+
+// formatSRT renders segments as a SubRip subtitle file
+func formatSRT(segments []TranscriptSegment) string {
+	var sb strings.Builder
+	cue := 0
+	for _, seg := range segments {
+		text := strings.TrimSpace(seg.Text)
+		if text == "" {
+			continue
+		}
+		cue++
+		fmt.Fprintf(&sb, "%d\n", cue)
+		fmt.Fprintf(&sb, "%s --> %s\n", formatSubtitleTimestamp(seg.Start, ","), formatSubtitleTimestamp(seg.End, ","))
+		fmt.Fprintf(&sb, "%s\n\n", text)
+	}
+	return sb.String()
+}
+
+// formatVTT renders segments as a WebVTT subtitle file
+func formatVTT(segments []TranscriptSegment) string {
+	var sb strings.Builder
+	sb.WriteString("WEBVTT\n\n")
+	for _, seg := range segments {
+		text := strings.TrimSpace(seg.Text)
+		if text == "" {
+			continue
+		}
+		fmt.Fprintf(&sb, "%s --> %s\n", formatSubtitleTimestamp(seg.Start, "."), formatSubtitleTimestamp(seg.End, "."))
+		fmt.Fprintf(&sb, "%s\n\n", text)
+	}
+	return sb.String()
+}
+
+// writeSubtitleFiles writes .srt and .vtt files next to the transcript file and returns their paths
+func writeSubtitleFiles(transcriptPath string, segments []TranscriptSegment) ([]string, error) {
+	baseName := strings.TrimSuffix(transcriptPath, filepath.Ext(transcriptPath))
+
+	outputs := []struct {
+		path    string
+		content string
+	}{
+		{baseName + ".srt", formatSRT(segments)},
+		{baseName + ".vtt", formatVTT(segments)},
+	}
+
+	var written []string
+	for _, out := range outputs {
+		if err := os.WriteFile(out.path, []byte(out.content), 0644); err != nil {
+			return written, fmt.Errorf("failed to write %s: %w", out.path, err)
+		}
+		written = append(written, out.path)
+	}
+
+	return written, nil
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"embed"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// BPE encodings used by OpenAI chat models
+const (
+	encodingCl100k = "cl100k_base"
+	encodingO200k  = "o200k_base"
+)
+
+// tokenizerFiles holds the published cl100k_base and o200k_base rank files, so token
+// counts never need the network
+//
+//go:embed tokenizers/*.tiktoken
+var tokenizerFiles embed.FS
+
+// bpeEncoding is a byte-level BPE tokenizer: text is split into pieces by a
+// pre-tokenizer, then each piece's bytes are merged by rank
+type bpeEncoding struct {
+	name   string
+	ranks  map[string]int
+	split  func(text string) []string
+	counts sync.Map // piece -> token count, since transcripts repeat words a lot
+}
+
+// loadedEncoding is an encoding loaded at most once per run
+type loadedEncoding struct {
+	once     sync.Once
+	encoding *bpeEncoding
+	err      error
+}
+
+var (
+	encodingsMu        sync.Mutex
+	encodings          = map[string]*loadedEncoding{}
+	tokenizerFallbacks sync.Map // encoding name -> warned
+)
+
+// encodingForModel returns the encoding the model registry lists for a model. Models
+// with other tokenizers (Claude, Llama, ...) use cl100k_base, which is far closer for
+// them than a character ratio, especially for non-English text and code.
+func encodingForModel(model string) string {
+	return modelInfo(model).Encoding
+}
+
+// countTokens returns how many tokens text takes for model. If the encoding can't be
+// loaded it falls back to the ~4 characters per token estimate, warning once.
+func countTokens(text, model string) int {
+	name := encodingForModel(model)
+	encoding, err := getEncoding(name)
+	if err != nil {
+		if _, warned := tokenizerFallbacks.LoadOrStore(name, true); !warned {
+			fmt.Printf("  ⚠ Tokenizer %s unavailable (%v), estimating ~%d characters per token\n", name, err, avgCharsPerToken)
+		}
+		return len(text) / avgCharsPerToken
+	}
+	return encoding.countTokens(text)
+}
+
+// getEncoding loads an encoding's embedded ranks the first time it is needed
+func getEncoding(name string) (*bpeEncoding, error) {
+	encodingsMu.Lock()
+	loaded, ok := encodings[name]
+	if !ok {
+		loaded = &loadedEncoding{}
+		encodings[name] = loaded
+	}
+	encodingsMu.Unlock()
+
+	loaded.once.Do(func() {
+		ranks, err := loadRanks(name)
+		if err != nil {
+			loaded.err = err
+			return
+		}
+
+		split := splitCl100k
+		if name == encodingO200k {
+			split = splitO200k
+		}
+		loaded.encoding = &bpeEncoding{name: name, ranks: ranks, split: split}
+	})
+
+	return loaded.encoding, loaded.err
+}
+
+// loadRanks reads an embedded .tiktoken rank file
+func loadRanks(name string) (map[string]int, error) {
+	data, err := tokenizerFiles.ReadFile("tokenizers/" + name + ".tiktoken")
+	if err != nil {
+		return nil, fmt.Errorf("unknown tokenizer %s", name)
+	}
+	return parseRanks(data)
+}
+
+// parseRanks decodes "<base64 token> <rank>" lines
+func parseRanks(data []byte) (map[string]int, error) {
+	ranks := make(map[string]int, bytes.Count(data, []byte("\n")))
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid tokenizer line %d", lineNum)
+		}
+		token, err := base64.StdEncoding.DecodeString(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid token on tokenizer line %d: %w", lineNum, err)
+		}
+		rank, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid rank on tokenizer line %d: %w", lineNum, err)
+		}
+		ranks[string(token)] = rank
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read tokenizer: %w", err)
+	}
+	if len(ranks) == 0 {
+		return nil, fmt.Errorf("tokenizer file is empty")
+	}
+
+	return ranks, nil
+}
+
+// countTokens returns the number of tokens text encodes to
+func (e *bpeEncoding) countTokens(text string) int {
+	total := 0
+	for _, piece := range e.split(text) {
+		if count, ok := e.counts.Load(piece); ok {
+			total += count.(int)
+			continue
+		}
+		count := e.countPieceTokens(piece)
+		e.counts.Store(piece, count)
+		total += count
+	}
+	return total
+}
+
+// countPieceTokens runs byte pair merging on one piece: starting from single bytes, the
+// adjacent pair with the lowest rank is merged until no pair is in the vocabulary
+func (e *bpeEncoding) countPieceTokens(piece string) int {
+	if _, ok := e.ranks[piece]; ok {
+		return 1
+	}
+
+	// bounds[i] is where part i starts; the last entry is the end of the piece
+	bounds := make([]int, len(piece)+1)
+	for i := range bounds {
+		bounds[i] = i
+	}
+
+	for len(bounds) > 2 {
+		bestRank, bestIdx := -1, -1
+		for i := 0; i+2 < len(bounds); i++ {
+			rank, ok := e.ranks[piece[bounds[i]:bounds[i+2]]]
+			if ok && (bestRank < 0 || rank < bestRank) {
+				bestRank, bestIdx = rank, i
+			}
+		}
+		if bestIdx < 0 {
+			break
+		}
+		bounds = append(bounds[:bestIdx+1], bounds[bestIdx+2:]...)
+	}
+
+	return len(bounds) - 1
+}
+
+// Character classes used by the pre-tokenizers
+func isNewline(r rune) bool { return r == '\r' || r == '\n' }
+
+// isPrefixChar matches [^\r\n\p{L}\p{N}], the optional character before a word
+func isPrefixChar(r rune) bool { return !isNewline(r) && !unicode.IsLetter(r) && !unicode.IsNumber(r) }
+
+// isSymbol matches [^\s\p{L}\p{N}]
+func isSymbol(r rune) bool {
+	return !unicode.IsSpace(r) && !unicode.IsLetter(r) && !unicode.IsNumber(r)
+}
+
+// isUpperClass matches [\p{Lu}\p{Lt}\p{Lm}\p{Lo}\p{M}]
+func isUpperClass(r rune) bool {
+	return unicode.In(r, unicode.Lu, unicode.Lt, unicode.Lm, unicode.Lo, unicode.M)
+}
+
+// isLowerClass matches [\p{Ll}\p{Lm}\p{Lo}\p{M}]
+func isLowerClass(r rune) bool {
+	return unicode.In(r, unicode.Ll, unicode.Lm, unicode.Lo, unicode.M)
+}
+
+// matchContraction matches (?i:'s|'t|'re|'ve|'m|'ll|'d) at i, returning its end or -1
+func matchContraction(r []rune, i int) int {
+	if i >= len(r) || r[i] != '\'' {
+		return -1
+	}
+	for _, suffix := range []string{"s", "t", "re", "ve", "m", "ll", "d"} {
+		end := i + 1 + len(suffix)
+		if end <= len(r) && strings.EqualFold(string(r[i+1:end]), suffix) {
+			return end
+		}
+	}
+	return -1
+}
+
+// runEnd returns the end of the run of characters matching class starting at i
+func runEnd(r []rune, i int, class func(rune) bool) int {
+	for i < len(r) && class(r[i]) {
+		i++
+	}
+	return i
+}
+
+// matchNumber matches \p{N}{1,3}
+func matchNumber(r []rune, i int) int {
+	end := i
+	for end < len(r) && end-i < 3 && unicode.IsNumber(r[end]) {
+		end++
+	}
+	if end == i {
+		return -1
+	}
+	return end
+}
+
+// matchSymbols matches ` ?[^\s\p{L}\p{N}]+` followed by any characters in trailing
+func matchSymbols(r []rune, i int, trailing func(rune) bool) int {
+	start := i
+	if r[start] == ' ' && start+1 < len(r) && isSymbol(r[start+1]) {
+		start++
+	}
+	if !isSymbol(r[start]) {
+		return -1
+	}
+	return runEnd(r, runEnd(r, start, isSymbol), trailing)
+}
+
+// matchWhitespace tries, in order, \s*[\r\n]+ then \s+(?!\S) then \s+
+func matchWhitespace(r []rune, i int) int {
+	end := runEnd(r, i, unicode.IsSpace)
+	if end == i {
+		return -1
+	}
+
+	// \s*[\r\n]+ ends after the last newline in the run
+	for k := end - 1; k >= i; k-- {
+		if isNewline(r[k]) {
+			return k + 1
+		}
+	}
+
+	// \s+(?!\S) leaves the last space to start the next word
+	if end == len(r) || end-1 == i {
+		return end
+	}
+	return end - 1
+}
+
+// splitCl100k pre-tokenizes like the cl100k_base pattern:
+// (?i:'s|'t|'re|'ve|'m|'ll|'d)|[^\r\n\p{L}\p{N}]?\p{L}+|\p{N}{1,3}| ?[^\s\p{L}\p{N}]+[\r\n]*|\s*[\r\n]+|\s+(?!\S)|\s+
+func splitCl100k(text string) []string {
+	r := []rune(text)
+	var pieces []string
+
+	for i := 0; i < len(r); {
+		end := matchContraction(r, i)
+		if end < 0 {
+			if unicode.IsLetter(r[i]) {
+				end = runEnd(r, i, unicode.IsLetter)
+			} else if isPrefixChar(r[i]) && i+1 < len(r) && unicode.IsLetter(r[i+1]) {
+				end = runEnd(r, i+1, unicode.IsLetter)
+			}
+		}
+		if end < 0 {
+			end = matchNumber(r, i)
+		}
+		if end < 0 {
+			end = matchSymbols(r, i, isNewline)
+		}
+		if end < 0 {
+			end = matchWhitespace(r, i)
+		}
+		if end < 0 {
+			end = i + 1
+		}
+
+		pieces = append(pieces, string(r[i:end]))
+		i = end
+	}
+
+	return pieces
+}
+
+// matchCasedWord matches the two word alternatives of the o200k_base pattern at i,
+// with or without the optional leading character:
+// [^\r\n\p{L}\p{N}]?[\p{Lu}\p{Lt}\p{Lm}\p{Lo}\p{M}]*[\p{Ll}\p{Lm}\p{Lo}\p{M}]+(?i:'s|...)?
+// [^\r\n\p{L}\p{N}]?[\p{Lu}\p{Lt}\p{Lm}\p{Lo}\p{M}]+[\p{Ll}\p{Lm}\p{Lo}\p{M}]*(?i:'s|...)?
+func matchCasedWord(r []rune, i int) int {
+	withContraction := func(end int) int {
+		if c := matchContraction(r, end); c > 0 {
+			return c
+		}
+		return end
+	}
+
+	var starts []int
+	if isPrefixChar(r[i]) && i+1 < len(r) {
+		starts = append(starts, i+1)
+	}
+	starts = append(starts, i)
+
+	// Upper* Lower+: give back upper-class characters until a lower-class one follows
+	for _, start := range starts {
+		upperEnd := runEnd(r, start, isUpperClass)
+		for k := upperEnd; k >= start; k-- {
+			if k < len(r) && isLowerClass(r[k]) {
+				return withContraction(runEnd(r, k, isLowerClass))
+			}
+		}
+	}
+
+	// Upper+ Lower*
+	for _, start := range starts {
+		upperEnd := runEnd(r, start, isUpperClass)
+		if upperEnd > start {
+			return withContraction(runEnd(r, upperEnd, isLowerClass))
+		}
+	}
+
+	return -1
+}
+
+// splitO200k pre-tokenizes like the o200k_base pattern, which splits words on case
+// changes and keeps contractions attached; see matchCasedWord for the word rules, then
+// \p{N}{1,3}| ?[^\s\p{L}\p{N}]+[\r\n/]*|\s*[\r\n]+|\s+(?!\S)|\s+
+func splitO200k(text string) []string {
+	r := []rune(text)
+	var pieces []string
+
+	for i := 0; i < len(r); {
+		end := matchCasedWord(r, i)
+		if end < 0 {
+			end = matchNumber(r, i)
+		}
+		if end < 0 {
+			end = matchSymbols(r, i, func(c rune) bool { return isNewline(c) || c == '/' })
+		}
+		if end < 0 {
+			end = matchWhitespace(r, i)
+		}
+		if end < 0 {
+			end = i + 1
+		}
+
+		pieces = append(pieces, string(r[i:end]))
+		i = end
+	}
+
+	return pieces
+}
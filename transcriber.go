@@ -0,0 +1,316 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Transcription backends selectable with the config "transcriber.backend" field or -transcriber
+const (
+	transcriberOpenAI        = "openai"
+	transcriberAzureOpenAI   = "azure-openai"
+	transcriberWhisperCpp    = "whisper-cpp"
+	transcriberFasterWhisper = "faster-whisper"
+)
+
+// TranscriberConfig configures the speech-to-text backend
+type TranscriberConfig struct {
+	Backend    string `yaml:"backend,omitempty"`     // openai (default), azure-openai, whisper-cpp or faster-whisper
+	Binary     string `yaml:"binary,omitempty"`      // Local executable (default: whisper-cli / whisper-ctranslate2)
+	ModelPath  string `yaml:"model_path,omitempty"`  // Local model file (whisper.cpp) or directory (faster-whisper)
+	Model      string `yaml:"model,omitempty"`       // faster-whisper model name, e.g. "large-v3"
+	Language   string `yaml:"language,omitempty"`    // Spoken language code; empty lets the model detect it
+	Threads    int    `yaml:"threads,omitempty"`     // CPU threads for local backends (0 = tool default)
+	Endpoint   string `yaml:"endpoint,omitempty"`    // azure-openai: resource endpoint (default: azure.endpoint)
+	Deployment string `yaml:"deployment,omitempty"`  // azure-openai: Whisper deployment name (default: "whisper")
+	APIVersion string `yaml:"api_version,omitempty"` // azure-openai: api-version (default: azure.api_version)
+}
+
+// Transcriber turns an audio file into a transcript
+type Transcriber interface {
+	// Name is shown in progress messages
+	Name() string
+	// CacheID identifies the backend and model in transcription cache keys
+	CacheID() string
+	// MaxFileSize is the largest file the backend accepts in bytes (0 for no limit)
+	MaxFileSize() int64
+	Transcribe(audioPath string, opts TranscriptionOptions) (*Transcript, error)
+}
+
+// newTranscriber builds the backend selected in the config
+func newTranscriber(cfg TranscriberConfig, apiKey string) (Transcriber, error) {
+	switch cfg.Backend {
+	case "", transcriberOpenAI:
+		return &openAITranscriber{Endpoint: openAIEndpoint(apiKey), Provider: "OpenAI Whisper", Model: "whisper-1"}, nil
+
+	case transcriberAzureOpenAI:
+		// Whisper needs its own deployment; azure.deployment is the chat default
+		deployment := cfg.Deployment
+		if deployment == "" {
+			deployment = "whisper"
+		}
+		endpoint, err := resolveAzureEndpoint(cfg.Endpoint, deployment, cfg.APIVersion, "")
+		if err != nil {
+			return nil, err
+		}
+		return &openAITranscriber{Endpoint: endpoint, Provider: "Azure OpenAI Whisper", Model: "azure:" + deployment}, nil
+
+	case transcriberWhisperCpp:
+		if cfg.ModelPath == "" {
+			return nil, fmt.Errorf("transcriber.model_path is required for the %s backend", cfg.Backend)
+		}
+		modelPath, err := expandHome(cfg.ModelPath)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := os.Stat(modelPath); err != nil {
+			return nil, fmt.Errorf("whisper.cpp model not found: %w", err)
+		}
+		binary := cfg.Binary
+		if binary == "" {
+			binary = "whisper-cli"
+		}
+		return &whisperCppTranscriber{Binary: binary, ModelPath: modelPath, Language: cfg.Language, Threads: cfg.Threads}, nil
+
+	case transcriberFasterWhisper:
+		if cfg.ModelPath == "" && cfg.Model == "" {
+			return nil, fmt.Errorf("transcriber.model_path or transcriber.model is required for the %s backend", cfg.Backend)
+		}
+		modelPath := ""
+		if cfg.ModelPath != "" {
+			var err error
+			if modelPath, err = expandHome(cfg.ModelPath); err != nil {
+				return nil, err
+			}
+		}
+		binary := cfg.Binary
+		if binary == "" {
+			binary = "whisper-ctranslate2"
+		}
+		return &fasterWhisperTranscriber{Binary: binary, ModelPath: modelPath, Model: cfg.Model, Language: cfg.Language, Threads: cfg.Threads}, nil
+
+	default:
+		return nil, fmt.Errorf("unknown transcriber backend '%s' (valid: %s, %s, %s, %s)",
+			cfg.Backend, transcriberOpenAI, transcriberAzureOpenAI, transcriberWhisperCpp, transcriberFasterWhisper)
+	}
+}
+
+// expandHome replaces a leading ~/ with the user's home directory
+func expandHome(path string) (string, error) {
+	if !strings.HasPrefix(path, "~/") {
+		return path, nil
+	}
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to get home directory: %w", err)
+	}
+	return filepath.Join(homeDir, path[2:]), nil
+}
+
+// openAITranscriber uploads audio to the OpenAI Whisper API, Azure OpenAI or a
+// compatible server
+type openAITranscriber struct {
+	Endpoint apiEndpoint
+	Provider string // Shown in progress messages
+	Model    string // Model or deployment, part of the cache key
+}
+
+func (t *openAITranscriber) Name() string       { return t.Provider }
+func (t *openAITranscriber) MaxFileSize() int64 { return maxFileSizeBytes }
+
+// CacheID includes the server unless it is api.openai.com, so transcripts from a
+// gateway or another Azure resource aren't mixed up with OpenAI's
+func (t *openAITranscriber) CacheID() string {
+	if t.Endpoint.BaseURL == defaultOpenAIBaseURL {
+		return t.Model
+	}
+	return t.Model + "@" + strings.TrimRight(t.Endpoint.BaseURL, "/")
+}
+
+func (t *openAITranscriber) Transcribe(audioPath string, opts TranscriptionOptions) (*Transcript, error) {
+	return transcribeAudio(audioPath, t.Endpoint, opts)
+}
+
+// whisperCppTranscriber runs a local whisper.cpp binary, so audio never leaves the machine
+type whisperCppTranscriber struct {
+	Binary    string
+	ModelPath string
+	Language  string
+	Threads   int
+}
+
+func (t *whisperCppTranscriber) Name() string       { return "whisper.cpp (local)" }
+func (t *whisperCppTranscriber) MaxFileSize() int64 { return 0 }
+
+func (t *whisperCppTranscriber) CacheID() string {
+	return "whisper-cpp:" + filepath.Base(t.ModelPath) + ":" + t.Language
+}
+
+func (t *whisperCppTranscriber) Transcribe(audioPath string, opts TranscriptionOptions) (*Transcript, error) {
+	tmpDir, err := createTempDir("goscribe-whispercpp-*")
+	if err != nil {
+		return nil, err
+	}
+	defer removeTempDir(tmpDir)
+
+	// whisper.cpp only reads 16 kHz 16-bit WAV
+	wavPath := filepath.Join(tmpDir, "input.wav")
+	if err := convertToWAV(audioPath, wavPath); err != nil {
+		return nil, err
+	}
+
+	outputBase := filepath.Join(tmpDir, "output")
+	args := []string{"-m", t.ModelPath, "-f", wavPath, "-oj", "-of", outputBase, "-np"}
+	if t.Language != "" {
+		args = append(args, "-l", t.Language)
+	}
+	if t.Threads > 0 {
+		args = append(args, "-t", fmt.Sprint(t.Threads))
+	}
+	if opts.Prompt != "" {
+		args = append(args, "--prompt", opts.Prompt)
+	}
+
+	if err := runLocalTranscriber(t.Binary, args); err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(outputBase + ".json")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read whisper.cpp output: %w", err)
+	}
+
+	return parseWhisperCppJSON(data)
+}
+
+// fasterWhisperTranscriber runs a local faster-whisper CLI (whisper-ctranslate2 or any
+// tool with the same openai-whisper compatible options)
+type fasterWhisperTranscriber struct {
+	Binary    string
+	ModelPath string
+	Model     string
+	Language  string
+	Threads   int
+}
+
+func (t *fasterWhisperTranscriber) Name() string       { return "faster-whisper (local)" }
+func (t *fasterWhisperTranscriber) MaxFileSize() int64 { return 0 }
+
+func (t *fasterWhisperTranscriber) CacheID() string {
+	model := t.Model
+	if t.ModelPath != "" {
+		model = filepath.Base(t.ModelPath)
+	}
+	return "faster-whisper:" + model + ":" + t.Language
+}
+
+func (t *fasterWhisperTranscriber) Transcribe(audioPath string, opts TranscriptionOptions) (*Transcript, error) {
+	tmpDir, err := createTempDir("goscribe-fasterwhisper-*")
+	if err != nil {
+		return nil, err
+	}
+	defer removeTempDir(tmpDir)
+
+	args := []string{audioPath, "--output_dir", tmpDir, "--output_format", "json", "--verbose", "False"}
+	if t.Model != "" {
+		args = append(args, "--model", t.Model)
+	}
+	if t.ModelPath != "" {
+		args = append(args, "--model_directory", t.ModelPath)
+	}
+	if t.Language != "" {
+		args = append(args, "--language", t.Language)
+	}
+	if t.Threads > 0 {
+		args = append(args, "--threads", fmt.Sprint(t.Threads))
+	}
+	if opts.Prompt != "" {
+		args = append(args, "--initial_prompt", opts.Prompt)
+	}
+
+	if err := runLocalTranscriber(t.Binary, args); err != nil {
+		return nil, err
+	}
+
+	baseName := filepath.Base(audioPath)
+	outputPath := filepath.Join(tmpDir, strings.TrimSuffix(baseName, filepath.Ext(baseName))+".json")
+	data, err := os.ReadFile(outputPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read faster-whisper output: %w", err)
+	}
+
+	return parseWhisperJSON(data)
+}
+
+// runLocalTranscriber runs a local transcription binary, including its output in the error
+func runLocalTranscriber(binary string, args []string) error {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = shellescape(arg)
+	}
+	cmd := shellescape(binary) + " " + strings.Join(quoted, " ")
+
+	output, err := exec.Command("bash", "-c", cmd).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s failed: %w\nOutput: %s", filepath.Base(binary), err, string(output))
+	}
+	return nil
+}
+
+// parseWhisperCppJSON converts the file written by whisper.cpp's -oj option, whose
+// segment offsets are in milliseconds
+func parseWhisperCppJSON(data []byte) (*Transcript, error) {
+	var output struct {
+		Transcription []struct {
+			Offsets struct {
+				From int64 `json:"from"`
+				To   int64 `json:"to"`
+			} `json:"offsets"`
+			Text string `json:"text"`
+		} `json:"transcription"`
+	}
+	if err := json.Unmarshal(data, &output); err != nil {
+		return nil, fmt.Errorf("failed to parse whisper.cpp output: %w", err)
+	}
+
+	transcript := &Transcript{}
+	var texts []string
+	for _, seg := range output.Transcription {
+		text := strings.TrimSpace(seg.Text)
+		if text == "" {
+			continue
+		}
+		texts = append(texts, text)
+		transcript.Segments = append(transcript.Segments, TranscriptSegment{
+			Start: float64(seg.Offsets.From) / 1000,
+			End:   float64(seg.Offsets.To) / 1000,
+			Text:  text,
+		})
+	}
+	transcript.Text = strings.Join(texts, " ")
+
+	return transcript, nil
+}
+
+// parseWhisperJSON converts the openai-whisper style JSON written by faster-whisper
+// front-ends, whose segment times are already in seconds
+func parseWhisperJSON(data []byte) (*Transcript, error) {
+	var output TranscriptionResponse
+	if err := json.Unmarshal(data, &output); err != nil {
+		return nil, fmt.Errorf("failed to parse faster-whisper output: %w", err)
+	}
+
+	transcript := &Transcript{Text: strings.TrimSpace(output.Text)}
+	for _, seg := range output.Segments {
+		seg.Text = strings.TrimSpace(seg.Text)
+		if seg.Text != "" {
+			transcript.Segments = append(transcript.Segments, seg)
+		}
+	}
+
+	return transcript, nil
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// Usage steps that aren't an action
+const (
+	usageStepTranscription = "transcription"
+	usageStepAutoSelect    = "auto-select"
+)
+
+// tokenUsage is what one chat call consumed, as reported by the API
+type tokenUsage struct {
+	InputTokens  int
+	OutputTokens int
+	Estimated    bool // Counted locally because the server reported no usage
+}
+
+// usageRecord is what one step of a run consumed with one model
+type usageRecord struct {
+	Step         string  `json:"step"`
+	Model        string  `json:"model"`
+	Calls        int     `json:"calls"`
+	InputTokens  int     `json:"input_tokens,omitempty"`
+	OutputTokens int     `json:"output_tokens,omitempty"`
+	AudioSeconds float64 `json:"audio_seconds,omitempty"`
+	Cost         float64 `json:"cost"`
+	Unpriced     bool    `json:"unpriced,omitempty"`  // The model registry has no price for the model
+	Estimated    bool    `json:"estimated,omitempty"` // Some token counts were counted locally
+	Local        bool    `json:"local,omitempty"`     // Ran on this machine, nothing was billed
+}
+
+// usageTracker adds up what a run consumes; API calls from concurrent chunks and
+// actions record into it at the same time
+type usageTracker struct {
+	mu      sync.Mutex
+	records []*usageRecord
+}
+
+// runUsage collects this run's usage for the summary and the ledger
+var runUsage = &usageTracker{}
+
+// record finds or creates the record for a step and model and updates it
+func (u *usageTracker) record(step, model string, update func(r *usageRecord)) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	for _, r := range u.records {
+		if r.Step == step && r.Model == model {
+			update(r)
+			return
+		}
+	}
+	r := &usageRecord{Step: step, Model: model}
+	u.records = append(u.records, r)
+	update(r)
+}
+
+// addChat records one chat call; local calls (Ollama) are counted but not priced
+func (u *usageTracker) addChat(step, model string, usage tokenUsage, local bool) {
+	cost, priced := 0.0, true
+	if !local {
+		cost, priced = priceTokens(model, usage.InputTokens, usage.OutputTokens)
+	}
+	u.record(step, model, func(r *usageRecord) {
+		r.Calls++
+		r.InputTokens += usage.InputTokens
+		r.OutputTokens += usage.OutputTokens
+		r.Cost += cost
+		r.Unpriced = r.Unpriced || !priced
+		r.Estimated = r.Estimated || usage.Estimated
+		r.Local = local
+	})
+}
+
+// addAudio records one transcription upload (or local transcription) of seconds of audio
+func (u *usageTracker) addAudio(model string, seconds float64, local bool) {
+	info, _ := lookupModel(activeConfig.Models, strings.TrimPrefix(model, "azure:"))
+	priced := local || info.AudioPriced
+	u.record(usageStepTranscription, model, func(r *usageRecord) {
+		r.Calls++
+		r.AudioSeconds += seconds
+		if !local {
+			r.Cost += seconds / 60 * info.AudioPrice
+		}
+		r.Unpriced = r.Unpriced || !priced
+		r.Local = local
+	})
+}
+
+// snapshot returns a copy of the records in the order steps were first seen
+func (u *usageTracker) snapshot() []usageRecord {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	records := make([]usageRecord, len(u.records))
+	for i, r := range u.records {
+		records[i] = *r
+	}
+	return records
+}
+
+// step adds up a step's records across models
+func (u *usageTracker) step(step string) (usageRecord, bool) {
+	total := usageRecord{Step: step}
+	found := false
+	for _, r := range u.snapshot() {
+		if r.Step == step {
+			total = addUsageRecords(total, r)
+			total.Model = r.Model
+			total.Local = r.Local && (total.Local || !found) // Local only if every model was
+			found = true
+		}
+	}
+	return total, found
+}
+
+// addUsageRecords sums two records
+func addUsageRecords(a, b usageRecord) usageRecord {
+	a.Calls += b.Calls
+	a.InputTokens += b.InputTokens
+	a.OutputTokens += b.OutputTokens
+	a.AudioSeconds += b.AudioSeconds
+	a.Cost += b.Cost
+	a.Unpriced = a.Unpriced || b.Unpriced
+	a.Estimated = a.Estimated || b.Estimated
+	return a
+}
+
+// usageStep names the step a chat call belongs to: its action, or --auto selection for
+// calls made without one
+func usageStep(action *PostAction) string {
+	if action == nil || action.ID == "" {
+		return usageStepAutoSelect
+	}
+	return action.ID
+}
+
+// countChatUsage counts a call's tokens locally, for servers that don't report usage
+func countChatUsage(reqBody ChatCompletionRequest, reply string) tokenUsage {
+	usage := tokenUsage{OutputTokens: countTokens(reply, reqBody.Model), Estimated: true}
+	for _, msg := range reqBody.Messages {
+		usage.InputTokens += countTokens(msg.Content, reqBody.Model)
+	}
+	return usage
+}
+
+// transcribeRecorded transcribes a file within the budget and adds its duration to
+// the run's usage
+func transcribeRecorded(transcriber Transcriber, audioPath string, opts TranscriptionOptions) (*Transcript, error) {
+	// Without ffprobe the duration is unknown; transcription still works unless a
+	// budget needs the duration to price the upload
+	info, probeErr := probeAudio(audioPath)
+	remote, isRemote := transcriber.(*openAITranscriber)
+
+	release := func() {}
+	if isRemote && runBudget != nil {
+		if probeErr != nil {
+			return nil, fmt.Errorf("%w: can't price the upload without its duration: %v", errBudgetExceeded, probeErr)
+		}
+		var err error
+		if release, err = reserveAudio(remote.Model, info.Duration); err != nil {
+			return nil, err
+		}
+	}
+
+	transcript, err := transcriber.Transcribe(audioPath, opts)
+	if err == nil && probeErr == nil {
+		if isRemote {
+			runUsage.addAudio(remote.Model, info.Duration, false)
+		} else {
+			runUsage.addAudio(transcriber.Name(), info.Duration, true)
+		}
+	}
+	release()
+	if err != nil {
+		return nil, err
+	}
+
+	return transcript, nil
+}
+
+// formatUsage describes a record for the run summary
+func formatUsage(r usageRecord) string {
+	var parts []string
+	if r.AudioSeconds > 0 {
+		parts = append(parts, fmt.Sprintf("%.1f min audio", r.AudioSeconds/60))
+	}
+	if r.InputTokens > 0 || r.OutputTokens > 0 {
+		approx := ""
+		if r.Estimated {
+			approx = "~"
+		}
+		parts = append(parts, fmt.Sprintf("%s%d in / %s%d out tokens", approx, r.InputTokens, approx, r.OutputTokens))
+	}
+	switch {
+	case r.Local:
+		parts = append(parts, "local")
+	case r.Unpriced:
+		parts = append(parts, "no price")
+	default:
+		parts = append(parts, fmt.Sprintf("$%.2f", r.Cost))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// printRunUsage adds the transcription and --auto usage and the run's total cost to the summary
+func printRunUsage() {
+	records := runUsage.snapshot()
+	if len(records) == 0 {
+		return
+	}
+
+	var total usageRecord
+	for _, r := range records {
+		total = addUsageRecords(total, r)
+	}
+	for _, step := range []string{usageStepTranscription, usageStepAutoSelect} {
+		if usage, ok := runUsage.step(step); ok {
+			fmt.Printf("  %-11s %s (%d calls, %s)\n", strings.ToUpper(step[:1])+step[1:]+":", usage.Model, usage.Calls, formatUsage(usage))
+		}
+	}
+
+	note := ""
+	if total.Unpriced {
+		note = " (some models have no price in the registry)"
+	}
+	fmt.Printf("  Cost:       $%.2f%s\n", total.Cost, note)
+}
+
+// usageLogged makes sure a run is written to the ledger once, even when an interrupt
+// arrives while the run is finishing
+var usageLogged sync.Once
+
+// logRunUsage appends the run's usage to the ledger, if it used anything
+func logRunUsage(inputs []string) {
+	usageLogged.Do(func() {
+		records := runUsage.snapshot()
+		if len(records) == 0 {
+			return
+		}
+		if err := appendUsageLedger(ledgerEntry{Time: time.Now(), Profile: runProfile, Inputs: inputs, Steps: records}); err != nil {
+			fmt.Printf("⚠ Warning: failed to record usage: %v\n", err)
+		}
+	})
+}
+
+// exitWithUsage records what the run has been billed so far in the ledger, then exits
+// with status 1. Failures after the first paid request go through it, so the monthly
+// budget sees that spending.
+func exitWithUsage(inputs []string) {
+	logRunUsage(inputs)
+	os.Exit(1)
+}
+
+// ledgerEntry is one run in the usage ledger
+type ledgerEntry struct {
+	Time    time.Time     `json:"time"`
+	Profile string        `json:"profile,omitempty"` // Config file the run used
+	Inputs  []string      `json:"inputs"`            // Audio file or transcript files
+	Steps   []usageRecord `json:"steps"`
+	Cost    float64       `json:"cost"`
+}
+
+// usageLedgerPath returns ~/.goscribe/usage.jsonl
+func usageLedgerPath() (string, error) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to get home directory: %w", err)
+	}
+	return filepath.Join(homeDir, ".goscribe", "usage.jsonl"), nil
+}
+
+// appendUsageLedger adds a run to the ledger, one JSON object per line
+func appendUsageLedger(entry ledgerEntry) error {
+	path, err := usageLedgerPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create config directory: %w", err)
+	}
+
+	for _, step := range entry.Steps {
+		entry.Cost += step.Cost
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal usage: %w", err)
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open usage ledger: %w", err)
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write usage ledger: %w", err)
+	}
+	return nil
+}
+
+// readUsageLedger loads every run in the ledger, skipping lines it can't parse
+func readUsageLedger(path string) ([]ledgerEntry, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open usage ledger: %w", err)
+	}
+	defer f.Close()
+
+	var entries []ledgerEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 10*1024*1024)
+	for scanner.Scan() {
+		var entry ledgerEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err == nil {
+			entries = append(entries, entry)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read usage ledger: %w", err)
+	}
+	return entries, nil
+}
+
+// runUsageCommand implements `goscribe usage`, summarizing the ledger by day or month
+func runUsageCommand(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("usage", flag.ContinueOnError)
+	by := flags.String("by", "day", "Group runs by 'day' or 'month'")
+	since := flags.String("since", "", "Only include runs on or after this date (YYYY-MM-DD)")
+	byModel := flags.Bool("models", false, "Break each period down by model")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	layout := map[string]string{"day": "2006-01-02", "month": "2006-01"}[*by]
+	if layout == "" {
+		return fmt.Errorf("invalid -by '%s' (valid: day, month)", *by)
+	}
+	var sinceTime time.Time
+	if *since != "" {
+		t, err := time.ParseInLocation("2006-01-02", *since, time.Local)
+		if err != nil {
+			return fmt.Errorf("invalid -since '%s' (use YYYY-MM-DD)", *since)
+		}
+		sinceTime = t
+	}
+
+	path, err := usageLedgerPath()
+	if err != nil {
+		return err
+	}
+	entries, err := readUsageLedger(path)
+	if err != nil {
+		return err
+	}
+
+	type row struct {
+		runs  map[int]bool
+		usage usageRecord
+	}
+	rows := map[string]*row{}
+	var total usageRecord
+	runs := 0
+	for i, entry := range entries {
+		if entry.Time.Before(sinceTime) {
+			continue
+		}
+		runs++
+		period := entry.Time.Local().Format(layout)
+		for _, step := range entry.Steps {
+			key := period
+			if *byModel {
+				key = period + "\t" + step.Model
+			}
+			if rows[key] == nil {
+				rows[key] = &row{runs: map[int]bool{}}
+			}
+			rows[key].runs[i] = true
+			rows[key].usage = addUsageRecords(rows[key].usage, step)
+			total = addUsageRecords(total, step)
+		}
+	}
+
+	if runs == 0 {
+		fmt.Fprintf(out, "No usage recorded in %s\n", path)
+		return nil
+	}
+
+	keys := make([]string, 0, len(rows))
+	for key := range rows {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	header := "Period\tRuns\tCalls\tAudio min\tInput tok\tOutput tok\tCost\t"
+	if *byModel {
+		header = "Period\tModel\tRuns\tCalls\tAudio min\tInput tok\tOutput tok\tCost\t"
+	}
+	fmt.Fprintln(w, header)
+	for _, key := range keys {
+		r := rows[key]
+		fmt.Fprintf(w, "%s\t%d\t%d\t%.1f\t%d\t%d\t$%.2f\t\n", key, len(r.runs), r.usage.Calls,
+			r.usage.AudioSeconds/60, r.usage.InputTokens, r.usage.OutputTokens, r.usage.Cost)
+	}
+	totalLabel := "Total"
+	if *byModel {
+		totalLabel = "Total\t"
+	}
+	fmt.Fprintf(w, "%s\t%d\t%d\t%.1f\t%d\t%d\t$%.2f\t\n", totalLabel, runs, total.Calls,
+		total.AudioSeconds/60, total.InputTokens, total.OutputTokens, total.Cost)
+	w.Flush()
+
+	if total.Unpriced {
+		fmt.Fprintln(out, "⚠ Some usage has no price in the model registry and is not included in the cost")
+	}
+	return nil
+}